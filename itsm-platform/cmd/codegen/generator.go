@@ -144,6 +144,7 @@ type CreateRequest struct {
 type UpdateRequest struct {
 	TenantID string                 ` + "`" + `json:"tenant_id"` + "`" + `
 	ID       string                 ` + "`" + `json:"id"` + "`" + `
+	Version  int                    ` + "`" + `json:"version,omitempty"` + "`" + `
 	Data     map[string]interface{} ` + "`" + `json:"data"` + "`" + `
 }
 
@@ -17,33 +17,76 @@ CREATE TABLE IF NOT EXISTS dal_system.service_registry (
     updated_at TIMESTAMPTZ DEFAULT NOW()
 );
 
+-- Every distinct DSL version a service has registered
+CREATE TABLE IF NOT EXISTS dal_system.service_registry_history (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    service_name VARCHAR(100) NOT NULL,
+    dsl_definition JSONB NOT NULL,
+    version VARCHAR(20),
+    registered_at TIMESTAMPTZ DEFAULT NOW()
+);
+
 -- Tenant registry
 CREATE TABLE IF NOT EXISTS dal_system.tenants (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     tenant_id VARCHAR(100) UNIQUE NOT NULL,
     tenant_name VARCHAR(255),
-    status VARCHAR(50) DEFAULT 'active',
+    status VARCHAR(50) DEFAULT 'active', -- active | suspended | archived | deleting
+    tenancy VARCHAR(20) NOT NULL DEFAULT 'schema', -- schema (own tenant_<id> schema) | shared (dal_shared tables)
     metadata JSONB,
     created_at TIMESTAMPTZ DEFAULT NOW(),
-    updated_at TIMESTAMPTZ DEFAULT NOW()
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    purge_after TIMESTAMPTZ -- set when status is deleting
 );
 
 -- Migration history
 CREATE TABLE IF NOT EXISTS dal_system.migration_history (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    run_id UUID,
     service_name VARCHAR(100),
     tenant_id VARCHAR(100),
     migration_type VARCHAR(50),
     migration_detail TEXT,
+    target_version VARCHAR(20),
     executed_at TIMESTAMPTZ DEFAULT NOW(),
     success BOOLEAN DEFAULT true,
     error_message TEXT
 );
 
+-- Latest migration outcome per service and tenant, used to resume a
+-- migration that failed for some tenants
+CREATE TABLE IF NOT EXISTS dal_system.tenant_migrations (
+    service_name VARCHAR(100) NOT NULL,
+    tenant_id VARCHAR(100) NOT NULL,
+    target_hash VARCHAR(64) NOT NULL,
+    target_version VARCHAR(20),
+    status VARCHAR(20) NOT NULL,
+    error_message TEXT,
+    run_id UUID,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (service_name, tenant_id)
+);
+
+-- Tables and columns removed from a DSL are renamed rather than dropped;
+-- they are dropped by dal.schema.purge
+CREATE TABLE IF NOT EXISTS dal_system.deprecated_objects (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    service_name VARCHAR(100) NOT NULL,
+    tenant_id VARCHAR(100) NOT NULL,
+    table_name VARCHAR(63) NOT NULL,
+    column_name VARCHAR(63),
+    deprecated_name VARCHAR(63) NOT NULL,
+    deprecated_at TIMESTAMPTZ DEFAULT NOW(),
+    purged_at TIMESTAMPTZ
+);
+
 -- Create indexes
 CREATE INDEX idx_service_registry_name ON dal_system.service_registry(service_name);
+CREATE INDEX idx_service_registry_history_name ON dal_system.service_registry_history(service_name, registered_at DESC);
+CREATE INDEX idx_deprecated_objects_service ON dal_system.deprecated_objects(service_name, tenant_id) WHERE purged_at IS NULL;
 CREATE INDEX idx_tenants_tenant_id ON dal_system.tenants(tenant_id);
 CREATE INDEX idx_migration_history_service ON dal_system.migration_history(service_name, tenant_id);
+CREATE INDEX idx_migration_history_run ON dal_system.migration_history(run_id);
 
 -- Create default tenant for development
 INSERT INTO dal_system.tenants (tenant_id, tenant_name, metadata)
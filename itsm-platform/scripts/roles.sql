@@ -0,0 +1,59 @@
+-- Database roles for the DAL service
+--
+-- The database owner created by the postgres image (itsm_user) is a
+-- superuser, and superusers bypass row-level security, so the DAL must not
+-- connect as it:
+--   dal_app   - the role the DAL connects as. It owns dal_system, dal_shared
+--               and every tenant schema and is subject to the
+--               tenant_isolation policies.
+--   dal_admin - cross-tenant jobs, such as migrations backfilling the shared
+--               schema. BYPASSRLS exempts it from the policies; as a member
+--               of dal_app it can alter dal_app's tables.
+--
+-- Runs after init.sql on a new database. It is safe to re-run against an
+-- existing one: it creates the missing roles and hands the DAL's schemas to
+-- dal_app.
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'dal_app') THEN
+        CREATE ROLE dal_app LOGIN PASSWORD 'dal_app_pass';
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'dal_admin') THEN
+        CREATE ROLE dal_admin LOGIN PASSWORD 'dal_admin_pass';
+    END IF;
+END $$;
+
+ALTER ROLE dal_app NOSUPERUSER NOBYPASSRLS NOCREATEDB NOCREATEROLE;
+ALTER ROLE dal_admin NOSUPERUSER BYPASSRLS NOCREATEDB NOCREATEROLE;
+GRANT dal_app TO dal_admin;
+
+-- dal_app creates the tenant schemas and dal_shared
+DO $$
+BEGIN
+    EXECUTE format('GRANT CONNECT, CREATE ON DATABASE %I TO dal_app', current_database());
+    EXECUTE format('GRANT CONNECT ON DATABASE %I TO dal_admin', current_database());
+END $$;
+
+-- Hand the DAL's schemas and their tables to dal_app. Indexes and owned
+-- sequences follow their table.
+DO $$
+DECLARE
+    obj RECORD;
+BEGIN
+    FOR obj IN
+        SELECT nspname FROM pg_namespace
+        WHERE nspname IN ('dal_system', 'dal_shared') OR nspname LIKE 'tenant\_%'
+    LOOP
+        EXECUTE format('ALTER SCHEMA %I OWNER TO dal_app', obj.nspname);
+    END LOOP;
+
+    FOR obj IN
+        SELECT n.nspname, c.relname FROM pg_class c
+        JOIN pg_namespace n ON n.oid = c.relnamespace
+        WHERE (n.nspname IN ('dal_system', 'dal_shared') OR n.nspname LIKE 'tenant\_%')
+        AND c.relkind IN ('r', 'p')
+    LOOP
+        EXECUTE format('ALTER TABLE %I.%I OWNER TO dal_app', obj.nspname, obj.relname);
+    END LOOP;
+END $$;
@@ -21,27 +21,30 @@ type Metadata struct {
 
 // Node represents an entity (graph node = DB table)
 type Node struct {
-	Name       string      `json:"name"`
-	Table      string      `json:"table"`
-	Properties []Property  `json:"properties"`
-	Indexes    []Index     `json:"indexes"`
-	DAL        DALConfig   `json:"dal"`
-	Relations  []Relation  `json:"relations,omitempty"`
-	Hooks      HookConfig  `json:"hooks,omitempty"`
-	Graph      GraphConfig `json:"graph,omitempty"`
+	Name        string      `json:"name"`
+	RenamedFrom string      `json:"renamed_from,omitempty"` // previous node name; the DAL renames its table
+	Table       string      `json:"table"`
+	Properties  []Property  `json:"properties"`
+	Indexes     []Index     `json:"indexes"`
+	DAL         DALConfig   `json:"dal"`
+	Relations   []Relation  `json:"relations,omitempty"`
+	Hooks       HookConfig  `json:"hooks,omitempty"`
+	Graph       GraphConfig `json:"graph,omitempty"`
 }
 
 type Property struct {
-	Name      string      `json:"name"`
-	Type      string      `json:"type"`
-	Primary   bool        `json:"primary,omitempty"`
-	Required  bool        `json:"required,omitempty"`
-	Indexed   bool        `json:"indexed,omitempty"`
-	MaxLength int         `json:"max_length,omitempty"`
-	Default   interface{} `json:"default,omitempty"`
-	Values    []string    `json:"values,omitempty"` // For enum type
-	Precision int         `json:"precision,omitempty"`
-	Scale     int         `json:"scale,omitempty"`
+	Name        string      `json:"name"`
+	RenamedFrom string      `json:"renamed_from,omitempty"` // previous property name; the DAL renames its column
+	Type        string      `json:"type"`
+	Primary     bool        `json:"primary,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Indexed     bool        `json:"indexed,omitempty"`
+	MaxLength   int         `json:"max_length,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Values      []string    `json:"values,omitempty"` // For enum type
+	Precision   int         `json:"precision,omitempty"`
+	Scale       int         `json:"scale,omitempty"`
+	Backfill    string      `json:"backfill,omitempty"` // SQL expression for existing rows when the property becomes required
 }
 
 type Index struct {
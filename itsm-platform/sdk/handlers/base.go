@@ -17,6 +17,7 @@ type CreateRequest struct {
 type UpdateRequest struct {
 	TenantID string                 `json:"tenant_id"`
 	ID       string                 `json:"id"`
+	Version  int                    `json:"version,omitempty"` // Version the caller read (optimistic locking)
 	Data     map[string]interface{} `json:"data"`
 }
 
@@ -74,3 +75,16 @@ func (b *BaseHandlers) ReplyError(msg *nats.Msg, err error) {
 	payload, _ := json.Marshal(response)
 	msg.Respond(payload)
 }
+
+// ReplyConflict sends an optimistic lock conflict back through NATS,
+// including the current entity so the caller can merge and retry
+func (b *BaseHandlers) ReplyConflict(msg *nats.Msg, err error, current map[string]interface{}) {
+	response := map[string]interface{}{
+		"success": false,
+		"error":   err.Error(),
+		"code":    "conflict",
+		"current": current,
+	}
+	payload, _ := json.Marshal(response)
+	msg.Respond(payload)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// dateTruncIntervals are the date_trunc units allowed in group_by
+var dateTruncIntervals = map[string]bool{
+	"minute": true, "hour": true, "day": true, "week": true,
+	"month": true, "quarter": true, "year": true,
+}
+
+// executeAggregate runs a group_by/aggregates query. It shares the tenant,
+// soft delete and where filtering of Execute and returns one row per group.
+func (qe *QueryExecutor) executeAggregate(ctx context.Context, tenantID string, node *NodeDefinition, query Query) (*QueryResult, error) {
+	if query.After != "" || len(query.Relations) > 0 || len(query.Select) > 0 {
+		return nil, fmt.Errorf("select, after and relations are not supported in aggregate queries")
+	}
+
+	aggregates := query.Aggregates
+	if len(aggregates) == 0 {
+		aggregates = []Aggregate{{Function: "count"}}
+	}
+
+	columns := make([]string, 0, len(query.GroupBy)+len(aggregates))
+	groupPositions := make([]string, 0, len(query.GroupBy))
+	aliases := make(map[string]bool)
+
+	for i, group := range query.GroupBy {
+		expr, alias, err := qe.buildGroupExpr(group, node)
+		if err != nil {
+			return nil, err
+		}
+		if aliases[alias] {
+			return nil, fmt.Errorf("duplicate aggregate column %s", alias)
+		}
+		aliases[alias] = true
+		columns = append(columns, fmt.Sprintf("%s AS %s", expr, quoteIdent(alias)))
+		groupPositions = append(groupPositions, fmt.Sprintf("%d", i+1))
+	}
+
+	for _, agg := range aggregates {
+		expr, alias, err := qe.buildAggregateExpr(agg, node)
+		if err != nil {
+			return nil, err
+		}
+		if aliases[alias] {
+			return nil, fmt.Errorf("duplicate aggregate column %s", alias)
+		}
+		aliases[alias] = true
+		columns = append(columns, fmt.Sprintf("%s AS %s", expr, quoteIdent(alias)))
+	}
+
+	whereClause, params, err := qe.buildWhereClause(query.Where, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+		strings.Join(columns, ", "), tableName, whereClause)
+
+	if len(groupPositions) > 0 {
+		sql += " GROUP BY " + strings.Join(groupPositions, ", ")
+	}
+
+	// Order by output columns; default to the group columns so time
+	// buckets come back in order
+	if len(query.OrderBy) > 0 {
+		orders := make([]string, len(query.OrderBy))
+		for i, order := range query.OrderBy {
+			if !aliases[order.Field] {
+				return nil, fmt.Errorf("order_by %s must be a group_by or aggregate alias", order.Field)
+			}
+			direction := "ASC"
+			if order.Desc {
+				direction = "DESC"
+			}
+			orders[i] = fmt.Sprintf("%s %s", quoteIdent(order.Field), direction)
+		}
+		sql += " ORDER BY " + strings.Join(orders, ", ")
+	} else if len(groupPositions) > 0 {
+		sql += " ORDER BY " + strings.Join(groupPositions, ", ")
+	}
+
+	if query.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+	if query.Offset > 0 {
+		sql += fmt.Sprintf(" OFFSET %d", query.Offset)
+	}
+
+	rows, err := qe.db.Query(ctx, sql, params...)
+	if err != nil {
+		return nil, fmt.Errorf("aggregate query failed: %w", err)
+	}
+	defer rows.Close()
+
+	results, err := qe.scanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryResult{Data: results}, nil
+}
+
+// buildGroupExpr returns the SQL expression and output name for a group_by
+func (qe *QueryExecutor) buildGroupExpr(group GroupBy, node *NodeDefinition) (string, string, error) {
+	column, err := qe.quoteField(group.Field, node)
+	if err != nil {
+		return "", "", err
+	}
+
+	alias := group.Alias
+	if alias == "" {
+		alias = group.Field
+	}
+
+	if group.Interval == "" {
+		return column, alias, nil
+	}
+
+	if !dateTruncIntervals[group.Interval] {
+		return "", "", fmt.Errorf("unsupported group_by interval %q", group.Interval)
+	}
+	if !isTimestampField(group.Field, node) {
+		return "", "", fmt.Errorf("group_by interval requires a timestamp field, got %s", group.Field)
+	}
+	return fmt.Sprintf("date_trunc('%s', %s)", group.Interval, column), alias, nil
+}
+
+// buildAggregateExpr returns the SQL expression and output name for an aggregate
+func (qe *QueryExecutor) buildAggregateExpr(agg Aggregate, node *NodeDefinition) (string, string, error) {
+	var value string
+	switch {
+	case agg.From != "":
+		to, err := qe.quoteField(agg.Field, node)
+		if err != nil {
+			return "", "", err
+		}
+		from, err := qe.quoteField(agg.From, node)
+		if err != nil {
+			return "", "", err
+		}
+		if !isTimestampField(agg.Field, node) || !isTimestampField(agg.From, node) {
+			return "", "", fmt.Errorf("aggregate from requires timestamp fields, got %s and %s", agg.Field, agg.From)
+		}
+		// Subtracting dates gives days as an integer rather than an
+		// interval, so both ends are compared as timestamps
+		value = fmt.Sprintf("EXTRACT(EPOCH FROM (%s::timestamptz - %s::timestamptz))", to, from)
+	case agg.Field != "":
+		column, err := qe.quoteField(agg.Field, node)
+		if err != nil {
+			return "", "", err
+		}
+		value = column
+	}
+
+	alias := agg.Alias
+	if alias == "" {
+		alias = agg.Function
+		if agg.Field != "" {
+			alias += "_" + agg.Field
+		}
+	}
+
+	switch agg.Function {
+	case "count":
+		if value == "" {
+			return "COUNT(*)", alias, nil
+		}
+		return fmt.Sprintf("COUNT(%s)", value), alias, nil
+	case "count_distinct", "sum", "avg", "min", "max":
+		if value == "" {
+			return "", "", fmt.Errorf("aggregate %s requires a field", agg.Function)
+		}
+		if agg.Function == "count_distinct" {
+			return fmt.Sprintf("COUNT(DISTINCT %s)", value), alias, nil
+		}
+		return fmt.Sprintf("%s(%s)", strings.ToUpper(agg.Function), value), alias, nil
+	default:
+		return "", "", fmt.Errorf("unsupported aggregate function %q", agg.Function)
+	}
+}
+
+// isTimestampField reports whether a property or system field holds a timestamp
+func isTimestampField(field string, node *NodeDefinition) bool {
+	if prop := findProperty(node, field); prop != nil {
+		switch prop.Type {
+		case "timestamp", "datetime", "date":
+			return true
+		}
+		return false
+	}
+	switch field {
+	case "created_at", "updated_at", "deleted_at":
+		return isSystemField(field, node)
+	}
+	return false
+}
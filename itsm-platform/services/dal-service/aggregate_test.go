@@ -0,0 +1,122 @@
+package main
+
+import "testing"
+
+// incidentNode has a timestamp, a date and a non-temporal property
+func incidentNode() *NodeDefinition {
+	return &NodeDefinition{
+		Name:  "Incident",
+		Table: "incidents",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "priority", Type: "string"},
+			{Name: "resolved_at", Type: "timestamp"},
+			{Name: "due_on", Type: "date"},
+			{Name: "effort", Type: "integer"},
+		},
+	}
+}
+
+func TestBuildGroupExpr(t *testing.T) {
+	tests := []struct {
+		group     GroupBy
+		wantExpr  string
+		wantAlias string
+		wantErr   bool
+	}{
+		{group: GroupBy{Field: "priority"}, wantExpr: `"priority"`, wantAlias: "priority"},
+		{group: GroupBy{Field: "priority", Alias: "p"}, wantExpr: `"priority"`, wantAlias: "p"},
+		{
+			group:    GroupBy{Field: "created_at", Interval: "day"},
+			wantExpr: `date_trunc('day', "created_at")`, wantAlias: "created_at",
+		},
+		{
+			group:    GroupBy{Field: "resolved_at", Interval: "week", Alias: "week"},
+			wantExpr: `date_trunc('week', "resolved_at")`, wantAlias: "week",
+		},
+		{
+			group:    GroupBy{Field: "due_on", Interval: "month"},
+			wantExpr: `date_trunc('month', "due_on")`, wantAlias: "due_on",
+		},
+		{group: GroupBy{Field: "resolved_at", Interval: "fortnight"}, wantErr: true},
+		{group: GroupBy{Field: "resolved_at", Interval: "day'); DROP TABLE incidents; --"}, wantErr: true},
+		{group: GroupBy{Field: "priority", Interval: "day"}, wantErr: true},
+		{group: GroupBy{Field: "deleted_at", Interval: "day"}, wantErr: true},
+		{group: GroupBy{Field: "severity"}, wantErr: true},
+	}
+
+	qe := &QueryExecutor{}
+	for _, tt := range tests {
+		t.Run(tt.group.Field+" "+tt.group.Interval, func(t *testing.T) {
+			expr, alias, err := qe.buildGroupExpr(tt.group, incidentNode())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %s AS %s, want an error", expr, alias)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expr != tt.wantExpr || alias != tt.wantAlias {
+				t.Errorf("got %s AS %s, want %s AS %s", expr, alias, tt.wantExpr, tt.wantAlias)
+			}
+		})
+	}
+}
+
+func TestBuildAggregateExpr(t *testing.T) {
+	tests := []struct {
+		name      string
+		agg       Aggregate
+		wantExpr  string
+		wantAlias string
+		wantErr   bool
+	}{
+		{name: "count", agg: Aggregate{Function: "count"}, wantExpr: `COUNT(*)`, wantAlias: "count"},
+		{
+			name: "count_distinct", agg: Aggregate{Function: "count_distinct", Field: "priority"},
+			wantExpr: `COUNT(DISTINCT "priority")`, wantAlias: "count_distinct_priority",
+		},
+		{
+			name: "sum", agg: Aggregate{Function: "sum", Field: "effort", Alias: "total"},
+			wantExpr: `SUM("effort")`, wantAlias: "total",
+		},
+		{
+			name:      "duration between timestamps",
+			agg:       Aggregate{Function: "avg", Field: "resolved_at", From: "created_at", Alias: "resolution"},
+			wantExpr:  `AVG(EXTRACT(EPOCH FROM ("resolved_at"::timestamptz - "created_at"::timestamptz)))`,
+			wantAlias: "resolution",
+		},
+		{
+			name:      "duration to a date",
+			agg:       Aggregate{Function: "max", Field: "due_on", From: "created_at"},
+			wantExpr:  `MAX(EXTRACT(EPOCH FROM ("due_on"::timestamptz - "created_at"::timestamptz)))`,
+			wantAlias: "max_due_on",
+		},
+		{name: "duration from a non-timestamp", agg: Aggregate{Function: "avg", Field: "resolved_at", From: "effort"}, wantErr: true},
+		{name: "duration from an unknown field", agg: Aggregate{Function: "avg", Field: "resolved_at", From: "opened_at"}, wantErr: true},
+		{name: "duration without soft delete", agg: Aggregate{Function: "avg", Field: "deleted_at", From: "created_at"}, wantErr: true},
+		{name: "sum without a field", agg: Aggregate{Function: "sum"}, wantErr: true},
+		{name: "unknown function", agg: Aggregate{Function: "median", Field: "effort"}, wantErr: true},
+	}
+
+	qe := &QueryExecutor{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, alias, err := qe.buildAggregateExpr(tt.agg, incidentNode())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %s AS %s, want an error", expr, alias)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expr != tt.wantExpr || alias != tt.wantAlias {
+				t.Errorf("got %s AS %s, want %s AS %s", expr, alias, tt.wantExpr, tt.wantAlias)
+			}
+		})
+	}
+}
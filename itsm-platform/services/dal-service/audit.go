@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// auditLogTable is the table, next to a tenant's entity tables, that every
+// write through the QueryExecutor is recorded in
+const auditLogTable = "audit_log"
+
+// Audit log actions
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+// maxAuditRowsPerInsert keeps multi-row audit inserts well below the
+// 65535 bind parameter limit
+const maxAuditRowsPerInsert = 1000
+
+// auditIgnoredFields are bookkeeping columns left out of audit diffs: they
+// are either the entry's own key or change on every write
+var auditIgnoredFields = map[string]bool{
+	"id":         true,
+	"tenant_id":  true,
+	"created_at": true,
+	"updated_at": true,
+	"version":    true,
+}
+
+type actorKey struct{}
+
+// withActor returns ctx carrying the ID of the user making a change, which
+// is recorded as user_id on the audit entries of writes made with it. An
+// empty userID leaves the actor unknown.
+func withActor(ctx context.Context, userID string) (context.Context, error) {
+	if userID == "" {
+		return ctx, nil
+	}
+	if _, err := uuid.Parse(userID); err != nil {
+		return nil, fmt.Errorf("user_id must be a UUID: %q", userID)
+	}
+	return context.WithValue(ctx, actorKey{}, userID), nil
+}
+
+// actorFrom returns the actor set by withActor, or nil
+func actorFrom(ctx context.Context) interface{} {
+	if userID, ok := ctx.Value(actorKey{}).(string); ok {
+		return userID
+	}
+	return nil
+}
+
+// auditChange is one write to be recorded. Before is nil for creates and
+// After is nil for hard deletes.
+type auditChange struct {
+	action string
+	before map[string]interface{}
+	after  map[string]interface{}
+}
+
+// auditDiff returns the fields whose values differ between before and
+// after. Values are compared by their JSON encoding, which is also how they
+// are stored.
+func auditDiff(before, after map[string]interface{}) (map[string]FieldChange, error) {
+	changes := make(map[string]FieldChange)
+
+	compare := func(field string) error {
+		if auditIgnoredFields[field] {
+			return nil
+		}
+		if _, done := changes[field]; done {
+			return nil
+		}
+		old, err := json.Marshal(before[field])
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", field, err)
+		}
+		updated, err := json.Marshal(after[field])
+		if err != nil {
+			return fmt.Errorf("failed to encode %s: %w", field, err)
+		}
+		if !bytes.Equal(old, updated) {
+			changes[field] = FieldChange{Before: before[field], After: after[field]}
+		}
+		return nil
+	}
+
+	for field := range before {
+		if err := compare(field); err != nil {
+			return nil, err
+		}
+	}
+	for field := range after {
+		if err := compare(field); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// audit writes one audit_log entry per change in the executor's
+// transaction, so the entries commit or roll back with the writes
+func (qe *QueryExecutor) audit(ctx context.Context, tenantID string, node *NodeDefinition, changes ...auditChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	tableName, err := qe.router.Table(ctx, tenantID, auditLogTable)
+	if err != nil {
+		return err
+	}
+
+	metadata := map[string]interface{}{"service": qe.service.Name}
+	actor := actorFrom(ctx)
+
+	for start := 0; start < len(changes); start += maxAuditRowsPerInsert {
+		end := start + maxAuditRowsPerInsert
+		if end > len(changes) {
+			end = len(changes)
+		}
+
+		rows := make([]string, 0, end-start)
+		params := make([]interface{}, 0, (end-start)*7)
+		for _, change := range changes[start:end] {
+			diff, err := auditDiff(change.before, change.after)
+			if err != nil {
+				return fmt.Errorf("failed to audit %s: %w", node.Name, err)
+			}
+
+			row := change.after
+			if row == nil {
+				row = change.before
+			}
+
+			// clock_timestamp orders the entries of one transaction
+			rows = append(rows, fmt.Sprintf("(%s, %s, %s, %s, %s, %s, %s, clock_timestamp())",
+				bindParam(&params, tenantID),
+				bindParam(&params, node.Name),
+				bindParam(&params, relationKey(row["id"])),
+				bindParam(&params, change.action),
+				bindParam(&params, diff),
+				bindParam(&params, actor),
+				bindParam(&params, metadata)))
+		}
+
+		query := fmt.Sprintf(`INSERT INTO %s (tenant_id, entity_type, entity_id, action, changes, user_id, metadata, timestamp)
+			VALUES %s`, tableName, strings.Join(rows, ", "))
+		if _, err := qe.db.Exec(ctx, query, params...); err != nil {
+			return fmt.Errorf("failed to write audit log: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// History returns the audit entries of one record, oldest first. Entries
+// outlive the record, so the history of a deleted record ends with its
+// delete.
+func (qe *QueryExecutor) History(ctx context.Context, tenantID, entityName, id string) ([]AuditEntry, error) {
+	var result []AuditEntry
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, err = qe.history(ctx, tenantID, entityName, id)
+		return err
+	})
+	return result, err
+}
+
+func (qe *QueryExecutor) history(ctx context.Context, tenantID, entityName, id string) ([]AuditEntry, error) {
+	node := qe.service.GetNode(entityName)
+	if node == nil {
+		return nil, fmt.Errorf("entity %s not found", entityName)
+	}
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, fmt.Errorf("invalid id %q", id)
+	}
+
+	tableName, err := qe.router.Table(ctx, tenantID, auditLogTable)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id::text, action, changes, user_id::text, timestamp
+		FROM %s
+		WHERE tenant_id = $1 AND entity_type = $2 AND entity_id = $3 AND metadata->>'service' = $4
+		ORDER BY timestamp, id`, tableName)
+
+	rows, err := qe.db.Query(ctx, query, tenantID, node.Name, id, qe.service.Name)
+	if err != nil {
+		return nil, fmt.Errorf("history failed: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry := AuditEntry{EntityType: node.Name, EntityID: id}
+		var userID *string
+		var timestamp time.Time
+		if err := rows.Scan(&entry.ID, &entry.Action, &entry.Changes, &userID, &timestamp); err != nil {
+			return nil, err
+		}
+		if userID != nil {
+			entry.UserID = *userID
+		}
+		entry.Timestamp = timestamp.UTC()
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// deleteChange returns the audit change of a row returned by a delete. A
+// soft-deleted row is diffed against itself as it was before the delete.
+func deleteChange(node *NodeDefinition, row map[string]interface{}) auditChange {
+	if !node.DAL.SoftDelete {
+		return auditChange{action: AuditDelete, before: row}
+	}
+
+	before := make(map[string]interface{}, len(row))
+	for field, value := range row {
+		before[field] = value
+	}
+	before["deleted_at"] = nil
+	return auditChange{action: AuditDelete, before: before, after: row}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditDiff(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		before  map[string]interface{}
+		after   map[string]interface{}
+		want    map[string]FieldChange
+		wantErr string
+	}{
+		{
+			name:   "create",
+			before: nil,
+			after:  map[string]interface{}{"id": "1", "title": "Printer", "priority": 2},
+			want: map[string]FieldChange{
+				"title":    {Before: nil, After: "Printer"},
+				"priority": {Before: nil, After: 2},
+			},
+		},
+		{
+			name:   "hard delete",
+			before: map[string]interface{}{"id": "1", "title": "Printer"},
+			after:  nil,
+			want:   map[string]FieldChange{"title": {Before: "Printer", After: nil}},
+		},
+		{
+			name:   "changed field",
+			before: map[string]interface{}{"title": "Printer", "status": "open"},
+			after:  map[string]interface{}{"title": "Printer", "status": "closed"},
+			want:   map[string]FieldChange{"status": {Before: "open", After: "closed"}},
+		},
+		{
+			name:   "field set to null",
+			before: map[string]interface{}{"assigned_to": "u1"},
+			after:  map[string]interface{}{"assigned_to": nil},
+			want:   map[string]FieldChange{"assigned_to": {Before: "u1", After: nil}},
+		},
+		{
+			name:   "field missing on one side",
+			before: map[string]interface{}{"title": "Printer"},
+			after:  map[string]interface{}{"title": "Printer", "metadata": map[string]interface{}{"floor": 2}},
+			want:   map[string]FieldChange{"metadata": {Before: nil, After: map[string]interface{}{"floor": 2}}},
+		},
+		{
+			name: "bookkeeping fields are ignored",
+			before: map[string]interface{}{
+				"id": "1", "tenant_id": "acme", "version": 1, "created_at": now, "updated_at": now,
+			},
+			after: map[string]interface{}{
+				"id": "2", "tenant_id": "other", "version": 2, "created_at": now.Add(time.Hour), "updated_at": now.Add(time.Hour),
+			},
+			want: map[string]FieldChange{},
+		},
+		{
+			name:   "deleted_at is not ignored",
+			before: map[string]interface{}{"deleted_at": nil},
+			after:  map[string]interface{}{"deleted_at": now},
+			want:   map[string]FieldChange{"deleted_at": {Before: nil, After: now}},
+		},
+		{
+			name:   "values with the same JSON encoding are equal",
+			before: map[string]interface{}{"priority": int32(2), "tags": []interface{}{"a", "b"}, "due": now},
+			after:  map[string]interface{}{"priority": float64(2), "tags": []string{"a", "b"}, "due": now.In(time.UTC)},
+			want:   map[string]FieldChange{},
+		},
+		{
+			name:   "nested change",
+			before: map[string]interface{}{"metadata": map[string]interface{}{"floor": 2}},
+			after:  map[string]interface{}{"metadata": map[string]interface{}{"floor": 3}},
+			want: map[string]FieldChange{"metadata": {
+				Before: map[string]interface{}{"floor": 2},
+				After:  map[string]interface{}{"floor": 3},
+			}},
+		},
+		{
+			name:    "value that cannot be encoded",
+			before:  map[string]interface{}{"title": "Printer"},
+			after:   map[string]interface{}{"title": make(chan int)},
+			wantErr: "failed to encode title",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := auditDiff(tt.before, tt.after)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeleteChange(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	row := map[string]interface{}{"id": "1", "title": "Printer", "deleted_at": now}
+
+	hard := ticketNode()
+	hard.DAL.SoftDelete = false
+
+	tests := []struct {
+		name string
+		node *NodeDefinition
+		want map[string]FieldChange
+	}{
+		{
+			name: "soft delete records deleted_at",
+			node: ticketNode(),
+			want: map[string]FieldChange{"deleted_at": {Before: nil, After: now}},
+		},
+		{
+			name: "hard delete records every field",
+			node: hard,
+			want: map[string]FieldChange{
+				"title":      {Before: "Printer", After: nil},
+				"deleted_at": {Before: now, After: nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			change := deleteChange(tt.node, row)
+			if change.action != AuditDelete {
+				t.Errorf("action %s, want %s", change.action, AuditDelete)
+			}
+			got, err := auditDiff(change.before, change.after)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changes:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+
+	// The returned row itself is left as it was
+	if row["deleted_at"] != now {
+		t.Errorf("deleteChange modified the row: %v", row)
+	}
+}
+
+func TestWithActor(t *testing.T) {
+	userID := "0b0f2d6e-8c1a-4f0e-9a55-2f3c4d5e6f70"
+
+	tests := []struct {
+		name    string
+		userID  string
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "user", userID: userID, want: userID},
+		{name: "unknown actor", userID: "", want: nil},
+		{name: "not a UUID", userID: "alice", wantErr: true},
+		{name: "SQL in the ID", userID: "'; DROP TABLE audit_log; --", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, err := withActor(context.Background(), tt.userID)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got actor %v, want an error", actorFrom(ctx))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := actorFrom(ctx); got != tt.want {
+				t.Errorf("actor %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
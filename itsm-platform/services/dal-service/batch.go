@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// maxBatchOperations bounds the size of a single batch transaction
+const maxBatchOperations = 1000
+
+// ExecuteBatch runs all operations in order in a single transaction. Either
+// every operation is applied and their results returned, or none is.
+func (qe *QueryExecutor) ExecuteBatch(ctx context.Context, tenantID string, operations []BatchOperation) ([]BatchResult, error) {
+	if len(operations) == 0 {
+		return nil, fmt.Errorf("batch has no operations")
+	}
+	if len(operations) > maxBatchOperations {
+		return nil, fmt.Errorf("batch has %d operations, maximum is %d", len(operations), maxBatchOperations)
+	}
+
+	tx, err := qe.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setTenant(ctx, tx, tenantID); err != nil {
+		return nil, err
+	}
+
+	txExec := qe.withTx(tx)
+	results := make([]BatchResult, 0, len(operations))
+	refs := make(map[string]map[string]interface{})
+
+	for i, op := range operations {
+		result, err := txExec.executeBatchOperation(ctx, tenantID, op, refs)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s) failed: %w", i, op.Op, op.Entity, err)
+		}
+
+		if op.Ref != "" {
+			if _, exists := refs[op.Ref]; exists {
+				return nil, fmt.Errorf("operation %d: duplicate ref %s", i, op.Ref)
+			}
+			refs[op.Ref] = result.Data
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit batch: %w", err)
+	}
+
+	return results, nil
+}
+
+func (qe *QueryExecutor) executeBatchOperation(ctx context.Context, tenantID string, op BatchOperation, refs map[string]map[string]interface{}) (BatchResult, error) {
+	result := BatchResult{Ref: op.Ref, Op: op.Op, Entity: op.Entity}
+
+	data := make(map[string]interface{}, len(op.Data))
+	for field, value := range op.Data {
+		resolved, err := resolveBatchRef(value, refs)
+		if err != nil {
+			return result, err
+		}
+		data[field] = resolved
+	}
+
+	var id string
+	if op.ID != nil {
+		resolved, err := resolveBatchRef(op.ID, refs)
+		if err != nil {
+			return result, err
+		}
+		id = relationKey(resolved)
+	}
+
+	switch op.Op {
+	case "create":
+		created, err := qe.create(ctx, tenantID, op.Entity, data)
+		if err != nil {
+			return result, err
+		}
+		result.ID = relationKey(created["id"])
+		result.Data = created
+	case "update":
+		if id == "" {
+			return result, fmt.Errorf("update requires an id")
+		}
+		updated, err := qe.update(ctx, tenantID, op.Entity, id, op.Version, data)
+		if err != nil {
+			return result, err
+		}
+		result.ID = id
+		result.Data = updated
+	case "delete":
+		if id == "" {
+			return result, fmt.Errorf("delete requires an id")
+		}
+		if err := qe.delete(ctx, tenantID, op.Entity, id); err != nil {
+			return result, err
+		}
+		result.ID = id
+		result.Data = map[string]interface{}{"id": id}
+	default:
+		return result, fmt.Errorf("unsupported batch operation %q", op.Op)
+	}
+
+	return result, nil
+}
+
+// resolveBatchRef replaces a {"$ref": "name.field"} value with the field
+// from the result of an earlier operation
+func resolveBatchRef(value interface{}, refs map[string]map[string]interface{}) (interface{}, error) {
+	ref, ok := value.(map[string]interface{})
+	if !ok || len(ref) != 1 {
+		return value, nil
+	}
+	target, ok := ref["$ref"].(string)
+	if !ok {
+		return value, nil
+	}
+
+	name, field, found := strings.Cut(target, ".")
+	if !found {
+		return nil, fmt.Errorf("invalid ref %q, expected name.field", target)
+	}
+	data, ok := refs[name]
+	if !ok {
+		return nil, fmt.Errorf("ref %s does not match an earlier operation", name)
+	}
+	resolved, ok := data[field]
+	if !ok {
+		return nil, fmt.Errorf("ref %s has no field %s", name, field)
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveBatchRef(t *testing.T) {
+	refs := map[string]map[string]interface{}{
+		"ticket": {"id": "7d0c", "title": "Printer on fire"},
+	}
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    interface{}
+		wantErr string
+	}{
+		{name: "plain value", value: "open", want: "open"},
+		{name: "nil", value: nil, want: nil},
+		{
+			name:  "map with other keys is data",
+			value: map[string]interface{}{"$ref": "ticket.id", "note": "x"},
+			want:  map[string]interface{}{"$ref": "ticket.id", "note": "x"},
+		},
+		{
+			name:  "non-string ref is data",
+			value: map[string]interface{}{"$ref": 1},
+			want:  map[string]interface{}{"$ref": 1},
+		},
+		{name: "ref to id", value: map[string]interface{}{"$ref": "ticket.id"}, want: "7d0c"},
+		{name: "ref to other field", value: map[string]interface{}{"$ref": "ticket.title"}, want: "Printer on fire"},
+		{name: "missing field name", value: map[string]interface{}{"$ref": "ticket"}, wantErr: "expected name.field"},
+		{name: "unknown operation", value: map[string]interface{}{"$ref": "comment.id"}, wantErr: "does not match an earlier operation"},
+		{name: "unknown field", value: map[string]interface{}{"$ref": "ticket.status"}, wantErr: "has no field status"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveBatchRef(tt.value, refs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecuteBatchResolvesRefsAndRollsBack(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	dsl := DSLDefinition{
+		Metadata: ServiceMetadata{Service: "batch-test"},
+		Nodes: []NodeDefinition{
+			{
+				Name:  "Ticket",
+				Table: "tickets",
+				Properties: []PropertyDefinition{
+					{Name: "id", Type: "uuid", Primary: true},
+					{Name: "title", Type: "string"},
+					{Name: "created_at", Type: "timestamp"},
+					{Name: "updated_at", Type: "timestamp"},
+				},
+			},
+			{
+				Name:  "Comment",
+				Table: "comments",
+				Properties: []PropertyDefinition{
+					{Name: "id", Type: "uuid", Primary: true},
+					{Name: "ticket_id", Type: "uuid"},
+					{Name: "body", Type: "string"},
+					{Name: "created_at", Type: "timestamp"},
+					{Name: "updated_at", Type: "timestamp"},
+				},
+			},
+		},
+	}
+	tenantID, router := testTenant(t, db, dsl)
+	qe := NewQueryExecutor(db, nil, newServiceDefinition("batch-test", dsl), router)
+
+	results, err := qe.ExecuteBatch(ctx, tenantID, []BatchOperation{
+		{Ref: "t", Op: "create", Entity: "Ticket", Data: map[string]interface{}{"title": "draft"}},
+		{Op: "create", Entity: "Comment", Data: map[string]interface{}{"ticket_id": map[string]interface{}{"$ref": "t.id"}, "body": "first"}},
+		{Op: "update", Entity: "Ticket", ID: map[string]interface{}{"$ref": "t.id"}, Data: map[string]interface{}{"title": "final"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticketID := results[0].ID
+	if got := relationKey(results[1].Data["ticket_id"]); got != ticketID {
+		t.Errorf("comment ticket_id %s, want %s", got, ticketID)
+	}
+	if results[2].ID != ticketID || results[2].Data["title"] != "final" {
+		t.Errorf("update result %+v, want ticket %s titled final", results[2], ticketID)
+	}
+
+	_, err = qe.ExecuteBatch(ctx, tenantID, []BatchOperation{
+		{Op: "create", Entity: "Ticket", Data: map[string]interface{}{"title": "rolled back"}},
+		{Op: "create", Entity: "Comment", Data: map[string]interface{}{"ticket_id": map[string]interface{}{"$ref": "missing.id"}}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "operation 1") {
+		t.Fatalf("got error %v, want operation 1 to fail", err)
+	}
+
+	found, err := qe.Execute(ctx, tenantID, "Ticket", Query{
+		Where: []Condition{{Field: "title", Operator: "eq", Value: "rolled back"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found.Data) != 0 {
+		t.Errorf("failed batch left %d tickets behind", len(found.Data))
+	}
+}
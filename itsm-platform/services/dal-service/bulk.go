@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UpdateMany applies data to every live row matching where in a single
+// statement, bumping version for optimistically locked entities, and
+// returns the updated rows
+func (qe *QueryExecutor) UpdateMany(ctx context.Context, tenantID, entityName string, where []Condition, data map[string]interface{}) ([]map[string]interface{}, error) {
+	var result []map[string]interface{}
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, err = qe.updateMany(ctx, tenantID, entityName, where, data)
+		return err
+	})
+	return result, err
+}
+
+func (qe *QueryExecutor) updateMany(ctx context.Context, tenantID, entityName string, where []Condition, data map[string]interface{}) ([]map[string]interface{}, error) {
+	node := qe.service.GetNode(entityName)
+	if node == nil {
+		return nil, fmt.Errorf("entity %s not found", entityName)
+	}
+	if len(where) == 0 {
+		return nil, fmt.Errorf("update_many requires at least one where condition")
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("update_many requires data")
+	}
+
+	if err := checkUpdatableFields(data, "update_many"); err != nil {
+		return nil, err
+	}
+
+	var params []interface{}
+	setClauses := make([]string, 0, len(data)+2)
+	for col, val := range data {
+		column, err := qe.quoteField(col, node)
+		if err != nil {
+			return nil, err
+		}
+		setClauses = append(setClauses, fmt.Sprintf("%s = %s", column, bindParam(&params, val)))
+	}
+
+	setClauses = append(setClauses, fmt.Sprintf("updated_at = %s", bindParam(&params, time.Now().UTC())))
+	if node.DAL.OptimisticLock {
+		setClauses = append(setClauses, "version = version + 1")
+	}
+
+	whereClause, whereParams, err := qe.buildWhereClause(where, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	// Lock the matching rows and keep their values for the audit diff. The
+	// update is keyed on the locked IDs, so rows that start or stop matching
+	// the filter in the meantime are left alone.
+	locked, err := qe.db.Query(ctx, fmt.Sprintf("SELECT * FROM %s WHERE %s FOR UPDATE", tableName, whereClause), whereParams...)
+	if err != nil {
+		return nil, fmt.Errorf("update_many failed: %w", err)
+	}
+	beforeRows, err := qe.scanRows(locked)
+	locked.Close()
+	if err != nil {
+		return nil, fmt.Errorf("update_many failed: %w", err)
+	}
+	if len(beforeRows) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(beforeRows))
+	before := make(map[string]map[string]interface{}, len(beforeRows))
+	for i, row := range beforeRows {
+		ids[i] = relationKey(row["id"])
+		before[ids[i]] = row
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = ANY(%s) AND tenant_id = %s RETURNING *",
+		tableName, strings.Join(setClauses, ", "), bindParam(&params, ids), bindParam(&params, tenantID))
+
+	rows, err := qe.db.Query(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("update_many failed: %w", err)
+	}
+	defer rows.Close()
+
+	results, err := qe.scanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]auditChange, len(results))
+	for i, row := range results {
+		changes[i] = auditChange{action: AuditUpdate, before: before[relationKey(row["id"])], after: row}
+	}
+	if err := qe.audit(ctx, tenantID, node, changes...); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// DeleteMany deletes every live row matching where (soft or hard based on
+// DSL) and returns the affected IDs
+func (qe *QueryExecutor) DeleteMany(ctx context.Context, tenantID, entityName string, where []Condition) ([]string, error) {
+	var result []string
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, err = qe.deleteMany(ctx, tenantID, entityName, where)
+		return err
+	})
+	return result, err
+}
+
+func (qe *QueryExecutor) deleteMany(ctx context.Context, tenantID, entityName string, where []Condition) ([]string, error) {
+	node := qe.service.GetNode(entityName)
+	if node == nil {
+		return nil, fmt.Errorf("entity %s not found", entityName)
+	}
+	if len(where) == 0 {
+		return nil, fmt.Errorf("delete_many requires at least one where condition")
+	}
+
+	whereClause, params, err := qe.buildWhereClause(where, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	var query string
+	if node.DAL.SoftDelete {
+		// Soft delete
+		setClause := fmt.Sprintf("deleted_at = %s", bindParam(&params, time.Now().UTC()))
+		if node.DAL.OptimisticLock {
+			setClause += ", version = version + 1"
+		}
+		query = fmt.Sprintf("UPDATE %s SET %s WHERE %s RETURNING *", tableName, setClause, whereClause)
+	} else {
+		// Hard delete
+		query = fmt.Sprintf("DELETE FROM %s WHERE %s RETURNING *", tableName, whereClause)
+	}
+
+	rows, err := qe.db.Query(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("delete_many failed: %w", err)
+	}
+	defer rows.Close()
+
+	results, err := qe.scanRows(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(results))
+	changes := make([]auditChange, len(results))
+	for i, row := range results {
+		ids[i] = relationKey(row["id"])
+		changes[i] = deleteChange(node, row)
+	}
+	if err := qe.audit(ctx, tenantID, node, changes...); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
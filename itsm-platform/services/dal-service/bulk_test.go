@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestUpdatesRejectManagedFields(t *testing.T) {
+	node := ticketNode()
+	node.DAL.OptimisticLock = true
+	qe := &QueryExecutor{service: newServiceDefinition("test", DSLDefinition{Nodes: []NodeDefinition{*node}})}
+	where := []Condition{{Field: "status", Operator: "eq", Value: "open"}}
+
+	for _, field := range []string{"id", "tenant_id", "version", "created_at", "created_by", "updated_at", "deleted_at", "deleted_by"} {
+		t.Run(field, func(t *testing.T) {
+			_, err := qe.update(context.Background(), "acme", "Ticket", "7d0c", 1, map[string]interface{}{field: nil})
+			if want := fmt.Sprintf("field %s cannot be set by update", field); err == nil || err.Error() != want {
+				t.Errorf("update: got error %v, want %q", err, want)
+			}
+			_, err = qe.updateMany(context.Background(), "acme", "Ticket", where, map[string]interface{}{field: nil})
+			if want := fmt.Sprintf("field %s cannot be set by update_many", field); err == nil || err.Error() != want {
+				t.Errorf("update_many: got error %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestUpdateManyOnlyUpdatesLockedRows(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	dsl := DSLDefinition{
+		Metadata: ServiceMetadata{Service: "bulk-test"},
+		Nodes: []NodeDefinition{{
+			Name:  "Ticket",
+			Table: "tickets",
+			Properties: []PropertyDefinition{
+				{Name: "id", Type: "uuid", Primary: true},
+				{Name: "status", Type: "string"},
+				{Name: "created_at", Type: "timestamp"},
+				{Name: "updated_at", Type: "timestamp"},
+			},
+		}},
+	}
+	tenantID, router := testTenant(t, db, dsl)
+	qe := NewQueryExecutor(db, nil, newServiceDefinition("bulk-test", dsl), router)
+
+	ids := make([]string, 3)
+	for i, status := range []string{"open", "open", "closed"} {
+		row, err := qe.Create(ctx, tenantID, "Ticket", map[string]interface{}{"status": status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = relationKey(row["id"])
+	}
+
+	// Close the first ticket in a transaction that holds its row lock while
+	// update_many runs, so the ticket stops matching the filter
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	if err := setTenant(ctx, tx, tenantID); err != nil {
+		t.Fatal(err)
+	}
+	table, err := router.Table(ctx, tenantID, "tickets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("UPDATE %s SET status = 'closed' WHERE id = $1", table), ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	type outcome struct {
+		rows []map[string]interface{}
+		err  error
+	}
+	done := make(chan outcome)
+	go func() {
+		rows, err := qe.UpdateMany(ctx, tenantID, "Ticket",
+			[]Condition{{Field: "status", Operator: "eq", Value: "open"}},
+			map[string]interface{}{"status": "pending"})
+		done <- outcome{rows, err}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got := <-done
+	if got.err != nil {
+		t.Fatal(got.err)
+	}
+
+	if len(got.rows) != 1 || relationKey(got.rows[0]["id"]) != ids[1] {
+		t.Fatalf("updated %v, want only %s", got.rows, ids[1])
+	}
+	for i, want := range []string{"closed", "pending", "closed"} {
+		row, err := qe.GetByID(ctx, tenantID, "Ticket", ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row["status"] != want {
+			t.Errorf("ticket %d: status %v, want %s", i, row["status"], want)
+		}
+	}
+
+	if rows, err := qe.UpdateMany(ctx, tenantID, "Ticket",
+		[]Condition{{Field: "status", Operator: "eq", Value: "open"}},
+		map[string]interface{}{"status": "pending"}); err != nil || len(rows) != 0 {
+		t.Errorf("second update_many: got %d rows, %v; want none", len(rows), err)
+	}
+}
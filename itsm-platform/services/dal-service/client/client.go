@@ -3,6 +3,7 @@ package dalclient
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -37,6 +38,24 @@ func (c *Client) Query(ctx context.Context, tenantID, entity string, query inter
 	return c.request(subject, request)
 }
 
+// Aggregate executes a group_by/aggregates query and returns one row per group
+func (c *Client) Aggregate(ctx context.Context, tenantID, entity string, query interface{}) ([]map[string]interface{}, error) {
+	result, err := c.Query(ctx, tenantID, entity, query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, _ := result.Data.([]interface{})
+	groups := make([]map[string]interface{}, 0, len(rows))
+	for _, row := range rows {
+		if group, ok := row.(map[string]interface{}); ok {
+			groups = append(groups, group)
+		}
+	}
+
+	return groups, nil
+}
+
 // Create creates a new entity
 func (c *Client) Create(ctx context.Context, tenantID, entity string, data map[string]interface{}) (map[string]interface{}, error) {
 	subject := fmt.Sprintf("dal.%s.%s.create", c.service, entity)
@@ -46,6 +65,7 @@ func (c *Client) Create(ctx context.Context, tenantID, entity string, data map[s
 		"data":      data,
 	}
 
+	setActor(ctx, request)
 	result, err := c.request(subject, request)
 	if err != nil {
 		return nil, err
@@ -54,8 +74,11 @@ func (c *Client) Create(ctx context.Context, tenantID, entity string, data map[s
 	return result.Data.(map[string]interface{}), nil
 }
 
-// Update updates an entity
-func (c *Client) Update(ctx context.Context, tenantID, entity, id string, data map[string]interface{}) (map[string]interface{}, error) {
+// Update updates an entity. For entities with optimistic locking, version
+// must be the version that was read; if the entity changed since, a
+// *ConflictError (matching ErrConflict) with the current entity is returned.
+// Pass 0 for entities without optimistic locking.
+func (c *Client) Update(ctx context.Context, tenantID, entity, id string, version int, data map[string]interface{}) (map[string]interface{}, error) {
 	subject := fmt.Sprintf("dal.%s.%s.update", c.service, entity)
 
 	request := map[string]interface{}{
@@ -63,7 +86,11 @@ func (c *Client) Update(ctx context.Context, tenantID, entity, id string, data m
 		"id":        id,
 		"data":      data,
 	}
+	if version > 0 {
+		request["version"] = version
+	}
 
+	setActor(ctx, request)
 	result, err := c.request(subject, request)
 	if err != nil {
 		return nil, err
@@ -81,6 +108,7 @@ func (c *Client) Delete(ctx context.Context, tenantID, entity, id string) error
 		"id":        id,
 	}
 
+	setActor(ctx, request)
 	_, err := c.request(subject, request)
 	return err
 }
@@ -102,6 +130,149 @@ func (c *Client) Get(ctx context.Context, tenantID, entity, id string) (map[stri
 	return result.Data.(map[string]interface{}), nil
 }
 
+// History returns the audit entries of an entity, oldest first. It also
+// works for deleted entities.
+func (c *Client) History(ctx context.Context, tenantID, entity, id string) ([]AuditEntry, error) {
+	subject := fmt.Sprintf("dal.%s.%s.history", c.service, entity)
+
+	request := map[string]interface{}{
+		"tenant_id": tenantID,
+		"id":        id,
+	}
+
+	result, err := c.request(subject, request)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := result.Data.(map[string]interface{})
+	payload, err := json.Marshal(data["history"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode history: %w", err)
+	}
+
+	var entries []AuditEntry
+	if err := json.Unmarshal(payload, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode history: %w", err)
+	}
+
+	return entries, nil
+}
+
+// Upsert creates the entity or updates the one it conflicts with on a unique
+// key and reports whether it was created. conflictFields selects the key
+// (e.g. "email"); when omitted the DAL picks the first unique index covered
+// by data.
+func (c *Client) Upsert(ctx context.Context, tenantID, entity string, data map[string]interface{}, conflictFields ...string) (map[string]interface{}, bool, error) {
+	subject := fmt.Sprintf("dal.%s.%s.upsert", c.service, entity)
+
+	request := map[string]interface{}{
+		"tenant_id": tenantID,
+		"data":      data,
+	}
+	if len(conflictFields) > 0 {
+		request["conflict_fields"] = conflictFields
+	}
+
+	setActor(ctx, request)
+	result, err := c.request(subject, request)
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, _ := result.Data.(map[string]interface{})
+	record, _ := response["entity"].(map[string]interface{})
+	created, _ := response["created"].(bool)
+
+	return record, created, nil
+}
+
+// UpdateMany applies data to every entity matching where (a list of
+// conditions, e.g. QueryBuilder.Build()["where"]) and returns the affected
+// IDs. With summaryEvent set the DAL publishes a single updated_many event
+// instead of one updated event per entity.
+func (c *Client) UpdateMany(ctx context.Context, tenantID, entity string, where interface{}, data map[string]interface{}, summaryEvent bool) ([]string, error) {
+	subject := fmt.Sprintf("dal.%s.%s.update_many", c.service, entity)
+
+	request := map[string]interface{}{
+		"tenant_id":     tenantID,
+		"where":         where,
+		"data":          data,
+		"summary_event": summaryEvent,
+	}
+
+	setActor(ctx, request)
+	result, err := c.request(subject, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return affectedIDs(result), nil
+}
+
+// DeleteMany deletes every entity matching where and returns the affected IDs
+func (c *Client) DeleteMany(ctx context.Context, tenantID, entity string, where interface{}, summaryEvent bool) ([]string, error) {
+	subject := fmt.Sprintf("dal.%s.%s.delete_many", c.service, entity)
+
+	request := map[string]interface{}{
+		"tenant_id":     tenantID,
+		"where":         where,
+		"summary_event": summaryEvent,
+	}
+
+	setActor(ctx, request)
+	result, err := c.request(subject, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return affectedIDs(result), nil
+}
+
+// affectedIDs extracts the ids list of an update_many/delete_many response
+func affectedIDs(result *QueryResult) []string {
+	data, _ := result.Data.(map[string]interface{})
+	rawIDs, _ := data["ids"].([]interface{})
+
+	ids := make([]string, 0, len(rawIDs))
+	for _, id := range rawIDs {
+		if s, ok := id.(string); ok {
+			ids = append(ids, s)
+		}
+	}
+	return ids
+}
+
+// Batch executes create/update/delete operations in order in a single
+// transaction. Either all operations succeed or none are applied.
+func (c *Client) Batch(ctx context.Context, tenantID string, operations []BatchOperation) ([]BatchResult, error) {
+	subject := fmt.Sprintf("dal.%s.batch", c.service)
+
+	request := map[string]interface{}{
+		"tenant_id":  tenantID,
+		"operations": operations,
+	}
+
+	setActor(ctx, request)
+	result, err := c.request(subject, request)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _ := result.Data.(map[string]interface{})
+	payload, err := json.Marshal(data["results"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode batch results: %w", err)
+	}
+
+	var results []BatchResult
+	if err := json.Unmarshal(payload, &results); err != nil {
+		return nil, fmt.Errorf("failed to decode batch results: %w", err)
+	}
+
+	return results, nil
+}
+
 // RegisterService registers a service DSL with the DAL
 func (c *Client) RegisterService(serviceName string, dsl interface{}) error {
 	subject := "dal.register"
@@ -127,6 +298,98 @@ func (c *Client) CreateTenant(tenantID string) error {
 	return err
 }
 
+// CreateSharedTenant creates a tenant whose rows live in the shared tables
+// of all small tenants instead of its own schema
+func (c *Client) CreateSharedTenant(tenantID string) error {
+	_, err := c.request("dal.tenant.create", map[string]interface{}{
+		"tenant_id": tenantID,
+		"tenancy":   "shared",
+	})
+	return err
+}
+
+// SuspendTenant refuses all DAL operations for a tenant until it is resumed
+func (c *Client) SuspendTenant(tenantID string) error {
+	_, err := c.request("dal.tenant.suspend", map[string]interface{}{"tenant_id": tenantID})
+	return err
+}
+
+// ArchiveTenant makes a tenant read only
+func (c *Client) ArchiveTenant(tenantID string) error {
+	_, err := c.request("dal.tenant.archive", map[string]interface{}{"tenant_id": tenantID})
+	return err
+}
+
+// ResumeTenant reactivates a suspended or archived tenant, or cancels its
+// pending deletion
+func (c *Client) ResumeTenant(tenantID string) error {
+	_, err := c.request("dal.tenant.resume", map[string]interface{}{"tenant_id": tenantID})
+	return err
+}
+
+// DeleteTenant marks a tenant for deletion; its data is purged once
+// gracePeriod has passed (0 uses the DAL default of 30 days)
+func (c *Client) DeleteTenant(tenantID string, gracePeriod time.Duration) error {
+	request := map[string]interface{}{
+		"tenant_id": tenantID,
+	}
+	if gracePeriod > 0 {
+		request["grace_period"] = gracePeriod.String()
+	}
+
+	_, err := c.request("dal.tenant.delete", request)
+	return err
+}
+
+// ExportTenant exports a tenant, optionally only some services, as a
+// bundle in the DAL's bundle directory and returns the bundle's name
+func (c *Client) ExportTenant(tenantID string, services ...string) (string, error) {
+	request := map[string]interface{}{
+		"tenant_id": tenantID,
+	}
+	if len(services) > 0 {
+		request["services"] = services
+	}
+
+	result, err := c.request("dal.tenant.export", request)
+	if err != nil {
+		return "", err
+	}
+
+	manifest, _ := result.Data.(map[string]interface{})
+	bundle, _ := manifest["bundle"].(string)
+	return bundle, nil
+}
+
+// ImportTenant loads a bundle from the DAL's bundle directory into tenantID,
+// or into the tenant it was exported from if tenantID is empty
+func (c *Client) ImportTenant(bundle, tenantID string) error {
+	request := map[string]interface{}{
+		"bundle": bundle,
+	}
+	if tenantID != "" {
+		request["tenant_id"] = tenantID
+	}
+
+	_, err := c.request("dal.tenant.import", request)
+	return err
+}
+
+// CloneTenant creates tenantID as a copy of sourceTenantID's data, e.g. a
+// sandbox for training, with rules anonymizing sensitive properties
+func (c *Client) CloneTenant(sourceTenantID, tenantID string, rules ...AnonymizeRule) error {
+	request := map[string]interface{}{
+		"source_tenant_id": sourceTenantID,
+		"tenant_id":        tenantID,
+	}
+	if len(rules) > 0 {
+		request["anonymize"] = rules
+	}
+
+	_, err := c.request("dal.tenant.clone", request)
+	return err
+}
+
 // MigrateSchema performs schema migration
 func (c *Client) MigrateSchema(serviceName string, dsl interface{}) error {
 	subject := "dal.schema.migrate"
@@ -140,6 +403,21 @@ func (c *Client) MigrateSchema(serviceName string, dsl interface{}) error {
 	return err
 }
 
+type actorKey struct{}
+
+// WithActor returns ctx carrying the ID (a UUID) of the user on whose
+// behalf writes made with it are done. The DAL records it in the audit log.
+func WithActor(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, actorKey{}, userID)
+}
+
+// setActor adds the actor of ctx, if any, to a write request
+func setActor(ctx context.Context, request map[string]interface{}) {
+	if userID, ok := ctx.Value(actorKey{}).(string); ok && userID != "" {
+		request["user_id"] = userID
+	}
+}
+
 // request performs a NATS request-reply
 func (c *Client) request(subject string, data interface{}) (*QueryResult, error) {
 	payload, err := json.Marshal(data)
@@ -158,6 +436,12 @@ func (c *Client) request(subject string, data interface{}) (*QueryResult, error)
 	}
 
 	if !response.Success {
+		if response.Code == "conflict" {
+			return nil, &ConflictError{Message: response.Error, Current: response.Current}
+		}
+		if response.Code == "tenant_unavailable" {
+			return nil, fmt.Errorf("DAL error: %s: %w", response.Error, ErrTenantUnavailable)
+		}
 		return nil, fmt.Errorf("DAL error: %s", response.Error)
 	}
 
@@ -177,6 +461,10 @@ func (c *Client) request(subject string, data interface{}) (*QueryResult, error)
 				result.Total = int64(t)
 			}
 		}
+
+		if cursor, ok := dataMap["next_cursor"].(string); ok {
+			result.NextCursor = cursor
+		}
 	} else {
 		result.Data = response.Data
 	}
@@ -241,6 +529,63 @@ func (qb *QueryBuilder) Offset(offset int) *QueryBuilder {
 	return qb
 }
 
+// Cursor requests keyset pagination: the result carries a NextCursor while
+// there are further pages. Requires Limit and cannot be combined with Offset.
+func (qb *QueryBuilder) Cursor() *QueryBuilder {
+	qb.query["cursor"] = true
+	return qb
+}
+
+// After continues a keyset-paginated query from a previous NextCursor.
+// Requires Limit and cannot be combined with Offset.
+func (qb *QueryBuilder) After(cursor string) *QueryBuilder {
+	qb.query["after"] = cursor
+	return qb
+}
+
+// SkipTotal omits the COUNT(*) query; QueryResult.Total is left at zero
+func (qb *QueryBuilder) SkipTotal() *QueryBuilder {
+	qb.query["skip_total"] = true
+	return qb
+}
+
+// GroupBy groups an aggregate query by a field. interval is an optional
+// date_trunc unit (hour, day, week, month, ...) for timestamp fields.
+func (qb *QueryBuilder) GroupBy(field, interval string) *QueryBuilder {
+	if qb.query["group_by"] == nil {
+		qb.query["group_by"] = []interface{}{}
+	}
+
+	groups := qb.query["group_by"].([]interface{})
+	group := map[string]interface{}{"field": field}
+	if interval != "" {
+		group["interval"] = interval
+	}
+	qb.query["group_by"] = append(groups, group)
+
+	return qb
+}
+
+// Aggregate adds count, count_distinct, sum, avg, min or max over field
+// (empty for count(*)) returned under alias
+func (qb *QueryBuilder) Aggregate(function, field, alias string) *QueryBuilder {
+	if qb.query["aggregates"] == nil {
+		qb.query["aggregates"] = []interface{}{}
+	}
+
+	aggregates := qb.query["aggregates"].([]interface{})
+	aggregate := map[string]interface{}{"function": function}
+	if field != "" {
+		aggregate["field"] = field
+	}
+	if alias != "" {
+		aggregate["alias"] = alias
+	}
+	qb.query["aggregates"] = append(aggregates, aggregate)
+
+	return qb
+}
+
 func (qb *QueryBuilder) WithRelations(relations ...string) *QueryBuilder {
 	rels := make([]interface{}, len(relations))
 	for i, rel := range relations {
@@ -256,14 +601,93 @@ func (qb *QueryBuilder) Build() map[string]interface{} {
 	return qb.query
 }
 
+// BatchOperation is one create, update or delete in a Batch. Use Ref to
+// pass a value produced by an earlier operation, e.g. Ref("ticket", "id").
+type BatchOperation struct {
+	Ref     string                 `json:"ref,omitempty"`
+	Op      string                 `json:"op"`
+	Entity  string                 `json:"entity"`
+	ID      interface{}            `json:"id,omitempty"`
+	Version int                    `json:"version,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// BatchResult is the outcome of one operation of a committed Batch
+type BatchResult struct {
+	Ref    string                 `json:"ref,omitempty"`
+	Op     string                 `json:"op"`
+	Entity string                 `json:"entity"`
+	ID     string                 `json:"id"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+// AuditEntry is one recorded write of an entity. Changes maps each changed
+// field to its values before and after the write.
+type AuditEntry struct {
+	ID         string                 `json:"id"`
+	EntityType string                 `json:"entity_type"`
+	EntityID   string                 `json:"entity_id"`
+	Action     string                 `json:"action"`
+	Changes    map[string]FieldChange `json:"changes"`
+	UserID     string                 `json:"user_id,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+// FieldChange is a field's value before and after a write
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AnonymizeRule replaces a property's values in a CloneTenant copy.
+// Strategy is "mask", "email", "hash", "null" or "fixed" (with Value).
+type AnonymizeRule struct {
+	Service  string `json:"service,omitempty"`
+	Entity   string `json:"entity"`
+	Property string `json:"property"`
+	Strategy string `json:"strategy"`
+	Value    string `json:"value,omitempty"`
+}
+
+// Ref references field of the result of the batch operation named ref
+func Ref(ref, field string) map[string]interface{} {
+	return map[string]interface{}{"$ref": ref + "." + field}
+}
+
+// ErrConflict matches (via errors.Is) the *ConflictError returned when an
+// update's version is stale
+var ErrConflict = errors.New("optimistic lock conflict")
+
+// ErrTenantUnavailable is wrapped by errors for tenants that are unknown,
+// suspended, archived (on writes) or being deleted
+var ErrTenantUnavailable = errors.New("tenant unavailable")
+
+// ConflictError reports an optimistic lock conflict. Current is the entity
+// as currently stored.
+type ConflictError struct {
+	Message string
+	Current map[string]interface{}
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("DAL error: %s", e.Message)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
 // Response types
 type Response struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Success bool                   `json:"success"`
+	Data    interface{}            `json:"data,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+	Code    string                 `json:"code,omitempty"`
+	Current map[string]interface{} `json:"current,omitempty"`
 }
 
 type QueryResult struct {
-	Data  interface{} `json:"data"`
-	Total int64       `json:"total"`
+	Data       interface{} `json:"data"`
+	Total      int64       `json:"total"`
+	NextCursor string      `json:"next_cursor,omitempty"`
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// columnType maps a DSL property to its PostgreSQL column type. It is the
+// single mapping used for CREATE TABLE, ADD COLUMN and ALTER COLUMN TYPE.
+func columnType(prop PropertyDefinition) string {
+	switch prop.Type {
+	case "string":
+		if prop.MaxLength > 0 {
+			return fmt.Sprintf("VARCHAR(%d)", prop.MaxLength)
+		}
+		return "TEXT"
+	case "int", "integer":
+		return "INTEGER"
+	case "bigint":
+		return "BIGINT"
+	case "decimal":
+		if prop.Precision > 0 {
+			return fmt.Sprintf("DECIMAL(%d,%d)", prop.Precision, prop.Scale)
+		}
+		return "DECIMAL"
+	case "boolean", "bool":
+		return "BOOLEAN"
+	case "uuid":
+		return "UUID"
+	case "date":
+		return "DATE"
+	case "datetime", "timestamp":
+		return "TIMESTAMPTZ"
+	case "json", "jsonb":
+		return "JSONB"
+	case "enum":
+		// For enums, use VARCHAR with CHECK constraint
+		return "VARCHAR(50)"
+	case "text":
+		return "TEXT"
+	case "array":
+		return "JSONB" // Store arrays as JSONB
+	default:
+		return "TEXT"
+	}
+}
+
+// typeFamily groups column types whose values convert into each other
+// without a USING clause
+func typeFamily(sqlType string) string {
+	switch {
+	case sqlType == "TEXT", strings.HasPrefix(sqlType, "VARCHAR"):
+		return "text"
+	case sqlType == "INTEGER", sqlType == "BIGINT":
+		return "integer"
+	case strings.HasPrefix(sqlType, "DECIMAL"):
+		return "numeric"
+	default:
+		return strings.ToLower(sqlType)
+	}
+}
+
+// conversionUsing returns the USING expression that converts column, a
+// quoted identifier, from the old property's type to the new one, or ""
+// when Postgres' own assignment cast is enough
+func conversionUsing(column string, old, new PropertyDefinition) string {
+	from, to := typeFamily(columnType(old)), typeFamily(columnType(new))
+	target := columnType(new)
+	if from == to {
+		return ""
+	}
+
+	// Empty strings are treated as NULL when parsing text
+	parsed := fmt.Sprintf("NULLIF(trim(%s), '')::%s", column, target)
+	unwrapped := fmt.Sprintf("(%s #>> '{}')::%s", column, target)
+
+	switch to {
+	case "text":
+		if from == "jsonb" {
+			return fmt.Sprintf("%s #>> '{}'", column)
+		}
+		return ""
+	case "integer", "numeric":
+		switch from {
+		case "text":
+			return parsed
+		case "boolean":
+			return fmt.Sprintf("CASE WHEN %s THEN 1 ELSE 0 END", column)
+		case "jsonb":
+			return unwrapped
+		}
+	case "boolean":
+		switch from {
+		case "text":
+			return parsed
+		case "integer", "numeric":
+			return fmt.Sprintf("%s <> 0", column)
+		case "jsonb":
+			return unwrapped
+		}
+	case "uuid", "date", "timestamptz":
+		switch from {
+		case "text":
+			return parsed
+		case "jsonb":
+			return unwrapped
+		case "date", "timestamptz":
+			if to != "uuid" {
+				return ""
+			}
+		}
+	case "jsonb":
+		if from == "text" {
+			// Text that is not a JSON document is kept as a JSON string
+			return fmt.Sprintf("CASE WHEN trim(%s) = '' THEN NULL WHEN pg_input_is_valid(%s, 'jsonb') THEN %s::jsonb ELSE to_jsonb(%s) END",
+				column, column, column, column)
+		}
+		return fmt.Sprintf("to_jsonb(%s)", column)
+	}
+
+	return fmt.Sprintf("%s::%s", column, target)
+}
@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestConversionUsing(t *testing.T) {
+	const (
+		jsonText = `CASE WHEN trim("c") = '' THEN NULL WHEN pg_input_is_valid("c", 'jsonb') THEN "c"::jsonb ELSE to_jsonb("c") END`
+		toJSON   = `to_jsonb("c")`
+	)
+
+	tests := []struct {
+		from, to string
+		want     string
+	}{
+		// Within a family Postgres converts on its own
+		{"string", "text", ""},
+		{"text", "string", ""},
+		{"integer", "bigint", ""},
+		{"bigint", "integer", ""},
+		{"date", "datetime", ""},
+		{"datetime", "date", ""},
+
+		{"string", "integer", `NULLIF(trim("c"), '')::INTEGER`},
+		{"string", "decimal", `NULLIF(trim("c"), '')::DECIMAL`},
+		{"string", "boolean", `NULLIF(trim("c"), '')::BOOLEAN`},
+		{"string", "uuid", `NULLIF(trim("c"), '')::UUID`},
+		{"string", "date", `NULLIF(trim("c"), '')::DATE`},
+		{"string", "datetime", `NULLIF(trim("c"), '')::TIMESTAMPTZ`},
+		{"string", "jsonb", jsonText},
+
+		{"integer", "string", ""},
+		{"integer", "decimal", `"c"::DECIMAL`},
+		{"integer", "boolean", `"c" <> 0`},
+		{"integer", "uuid", `"c"::UUID`},
+		{"integer", "date", `"c"::DATE`},
+		{"integer", "datetime", `"c"::TIMESTAMPTZ`},
+		{"integer", "jsonb", toJSON},
+
+		{"decimal", "string", ""},
+		{"decimal", "integer", `"c"::INTEGER`},
+		{"decimal", "boolean", `"c" <> 0`},
+		{"decimal", "jsonb", toJSON},
+
+		{"boolean", "string", ""},
+		{"boolean", "integer", `CASE WHEN "c" THEN 1 ELSE 0 END`},
+		{"boolean", "decimal", `CASE WHEN "c" THEN 1 ELSE 0 END`},
+		{"boolean", "jsonb", toJSON},
+
+		{"uuid", "string", ""},
+		{"uuid", "integer", `"c"::INTEGER`},
+		{"uuid", "date", `"c"::DATE`},
+		{"uuid", "jsonb", toJSON},
+
+		{"date", "string", ""},
+		{"date", "uuid", `"c"::UUID`},
+		{"date", "jsonb", toJSON},
+		{"datetime", "string", ""},
+		{"datetime", "jsonb", toJSON},
+
+		{"jsonb", "string", `"c" #>> '{}'`},
+		{"jsonb", "integer", `("c" #>> '{}')::INTEGER`},
+		{"jsonb", "decimal", `("c" #>> '{}')::DECIMAL`},
+		{"jsonb", "boolean", `("c" #>> '{}')::BOOLEAN`},
+		{"jsonb", "uuid", `("c" #>> '{}')::UUID`},
+		{"jsonb", "date", `("c" #>> '{}')::DATE`},
+		{"jsonb", "datetime", `("c" #>> '{}')::TIMESTAMPTZ`},
+		{"jsonb", "array", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			got := conversionUsing(`"c"`, PropertyDefinition{Name: "c", Type: tt.from}, PropertyDefinition{Name: "c", Type: tt.to})
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
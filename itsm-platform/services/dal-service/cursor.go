@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// cursor is the decoded form of an opaque keyset pagination token. It holds
+// the order_by values of the last row of a page, ending with its id.
+type cursor struct {
+	Order  string        `json:"o"`
+	Values []interface{} `json:"v"`
+}
+
+// withIDTiebreaker appends id to the ordering so that every row has a
+// unique position, which keyset pagination relies on
+func withIDTiebreaker(orderBy []OrderBy) []OrderBy {
+	for _, order := range orderBy {
+		if order.Field == "id" {
+			return orderBy
+		}
+	}
+	return append(append([]OrderBy{}, orderBy...), OrderBy{Field: "id"})
+}
+
+// orderSignature identifies an ordering so a cursor can't be replayed
+// against a query sorted differently
+func orderSignature(orderBy []OrderBy) string {
+	parts := make([]string, len(orderBy))
+	for i, order := range orderBy {
+		direction := "asc"
+		if order.Desc {
+			direction = "desc"
+		}
+		parts[i] = order.Field + ":" + direction
+	}
+	return strings.Join(parts, ",")
+}
+
+func encodeCursor(orderBy []OrderBy, row map[string]interface{}) (string, error) {
+	c := cursor{Order: orderSignature(orderBy), Values: make([]interface{}, len(orderBy))}
+	for i, order := range orderBy {
+		c.Values[i] = row[order.Field]
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(token string, orderBy []OrderBy) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	// Numbers are decoded exactly; float64 would round large bigint values
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var c cursor
+	if err := decoder.Decode(&c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if c.Order != orderSignature(orderBy) || len(c.Values) != len(orderBy) {
+		return nil, fmt.Errorf("cursor does not match the query order_by")
+	}
+	for i, value := range c.Values {
+		if n, ok := value.(json.Number); ok {
+			number, err := cursorNumber(n)
+			if err != nil {
+				return nil, err
+			}
+			c.Values[i] = number
+		}
+	}
+	return c.Values, nil
+}
+
+// cursorNumber converts a cursor number to a value pgx binds without loss:
+// an int64 for integers, a Numeric otherwise
+func cursorNumber(n json.Number) (interface{}, error) {
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	var numeric pgtype.Numeric
+	if err := numeric.Scan(n.String()); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return numeric, nil
+}
+
+// buildKeysetClause matches rows that sort after the cursor values, e.g. for
+// (a DESC, id ASC): (a < $2) OR (a = $3 AND id > $4). NULLs sort after every
+// value (NULLS LAST for ASC, NULLS FIRST for DESC, as buildOrderClause
+// orders), so a NULL cursor value is compared with IS NULL and IS NOT NULL.
+// Fields must already be validated by buildOrderClause.
+func buildKeysetClause(orderBy []OrderBy, values []interface{}, params *[]interface{}) string {
+	branches := make([]string, 0, len(orderBy))
+	for i, order := range orderBy {
+		// Nothing sorts after a NULL in ascending order
+		if values[i] == nil && !order.Desc {
+			continue
+		}
+
+		parts := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			parts = append(parts, keysetEqual(orderBy[j], values[j], params))
+		}
+		parts = append(parts, keysetAfter(order, values[i], params))
+
+		branches = append(branches, "("+strings.Join(parts, " AND ")+")")
+	}
+	if len(branches) == 0 {
+		return "FALSE"
+	}
+	return "(" + strings.Join(branches, " OR ") + ")"
+}
+
+// keysetEqual matches rows whose field equals the cursor value
+func keysetEqual(order OrderBy, value interface{}, params *[]interface{}) string {
+	column := quoteIdent(order.Field)
+	if value == nil {
+		return column + " IS NULL"
+	}
+	return fmt.Sprintf("%s = %s", column, bindParam(params, value))
+}
+
+// keysetAfter matches rows whose field sorts strictly after the cursor
+// value, which must not be NULL for ascending order. id is never NULL.
+func keysetAfter(order OrderBy, value interface{}, params *[]interface{}) string {
+	column := quoteIdent(order.Field)
+	switch {
+	case value == nil:
+		return column + " IS NOT NULL"
+	case order.Desc:
+		return fmt.Sprintf("%s < %s", column, bindParam(params, value))
+	case order.Field == "id":
+		return fmt.Sprintf("%s > %s", column, bindParam(params, value))
+	default:
+		return fmt.Sprintf("(%s > %s OR %s IS NULL)", column, bindParam(params, value), column)
+	}
+}
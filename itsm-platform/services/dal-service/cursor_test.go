@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestBuildKeysetClause(t *testing.T) {
+	tests := []struct {
+		name       string
+		orderBy    []OrderBy
+		values     []interface{}
+		wantClause string
+		wantParams []interface{}
+	}{
+		{
+			name:       "ascending",
+			orderBy:    []OrderBy{{Field: "due_date"}, {Field: "id"}},
+			values:     []interface{}{"2024-05-01", "a"},
+			wantClause: `((("due_date" > $1 OR "due_date" IS NULL)) OR ("due_date" = $2 AND "id" > $3))`,
+			wantParams: []interface{}{"2024-05-01", "2024-05-01", "a"},
+		},
+		{
+			name:       "descending",
+			orderBy:    []OrderBy{{Field: "due_date", Desc: true}, {Field: "id"}},
+			values:     []interface{}{"2024-05-01", "a"},
+			wantClause: `(("due_date" < $1) OR ("due_date" = $2 AND "id" > $3))`,
+			wantParams: []interface{}{"2024-05-01", "2024-05-01", "a"},
+		},
+		{
+			name:       "ascending after NULL",
+			orderBy:    []OrderBy{{Field: "assigned_to"}, {Field: "id"}},
+			values:     []interface{}{nil, "a"},
+			wantClause: `(("assigned_to" IS NULL AND "id" > $1))`,
+			wantParams: []interface{}{"a"},
+		},
+		{
+			name:       "descending after NULL",
+			orderBy:    []OrderBy{{Field: "assigned_to", Desc: true}, {Field: "id"}},
+			values:     []interface{}{nil, "a"},
+			wantClause: `(("assigned_to" IS NOT NULL) OR ("assigned_to" IS NULL AND "id" > $1))`,
+			wantParams: []interface{}{"a"},
+		},
+		{
+			name:       "NULL in a middle field",
+			orderBy:    []OrderBy{{Field: "priority"}, {Field: "resolved_at"}, {Field: "id"}},
+			values:     []interface{}{"high", nil, "a"},
+			wantClause: `((("priority" > $1 OR "priority" IS NULL)) OR ("priority" = $2 AND "resolved_at" IS NULL AND "id" > $3))`,
+			wantParams: []interface{}{"high", "high", "a"},
+		},
+		{
+			name:       "last row of a descending id order",
+			orderBy:    []OrderBy{{Field: "id", Desc: true}},
+			values:     []interface{}{"a"},
+			wantClause: `(("id" < $1))`,
+			wantParams: []interface{}{"a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params []interface{}
+			clause := buildKeysetClause(tt.orderBy, tt.values, &params)
+			if clause != tt.wantClause {
+				t.Errorf("clause = %s\nwant %s", clause, tt.wantClause)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("params = %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestBuildKeysetClauseEmpty(t *testing.T) {
+	var params []interface{}
+	clause := buildKeysetClause([]OrderBy{{Field: "assigned_to"}}, []interface{}{nil}, &params)
+	if clause != "FALSE" || len(params) != 0 {
+		t.Errorf("got %s with %v, want FALSE without params", clause, params)
+	}
+}
+
+func TestCursorRoundTripKeepsNull(t *testing.T) {
+	orderBy := withIDTiebreaker([]OrderBy{{Field: "assigned_to"}})
+	token, err := encodeCursor(orderBy, map[string]interface{}{"assigned_to": nil, "id": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := decodeCursor(token, orderBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []interface{}{nil, "a"}) {
+		t.Errorf("values = %v", values)
+	}
+}
+
+func TestCursorRoundTripKeepsNumbersExact(t *testing.T) {
+	orderBy := withIDTiebreaker([]OrderBy{{Field: "sequence"}, {Field: "amount"}})
+	token, err := encodeCursor(orderBy, map[string]interface{}{
+		"sequence": int64(9007199254740993), // 2^53 + 1, not representable as float64
+		"amount":   json.Number("12345678901234567890.25"),
+		"id":       "a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := decodeCursor(token, orderBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if values[0] != int64(9007199254740993) {
+		t.Errorf("sequence = %#v, want int64 9007199254740993", values[0])
+	}
+	amount, ok := values[1].(pgtype.Numeric)
+	if !ok {
+		t.Fatalf("amount = %#v, want a pgtype.Numeric", values[1])
+	}
+	if text, err := amount.MarshalJSON(); err != nil || string(text) != "12345678901234567890.25" {
+		t.Errorf("amount = %s (%v), want 12345678901234567890.25", text, err)
+	}
+	if values[2] != "a" {
+		t.Errorf("id = %#v, want a", values[2])
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// maxIdentifierLength is Postgres' NAMEDATALEN - 1
+const maxIdentifierLength = 63
+
+const deprecatedMarker = "_deprecated_"
+
+// deprecateDrops replaces DROP_TABLE and DROP_COLUMN migrations with renames
+// to <name>_deprecated_<timestamp>, so data removed from the DSL is kept
+// until it is purged explicitly
+func deprecateDrops(migrations []Migration, now time.Time) []Migration {
+	suffix := deprecatedMarker + now.Format("20060102150405")
+
+	result := make([]Migration, len(migrations))
+	for i, migration := range migrations {
+		switch migration.Type {
+		case "DROP_TABLE":
+			migration.Type = "DEPRECATE_TABLE"
+			migration.NewName = deprecatedName(migration.Table, suffix)
+		case "DROP_COLUMN":
+			migration.Type = "DEPRECATE_COLUMN"
+			migration.NewName = deprecatedName(migration.Column, suffix)
+		}
+		result[i] = migration
+	}
+	return result
+}
+
+func deprecatedName(name, suffix string) string {
+	if max := maxIdentifierLength - len(suffix); len(name) > max {
+		name = name[:max]
+	}
+	return name + suffix
+}
+
+// renameIndexesSQL renames every index of a deprecated table with the
+// table's deprecation suffix, so recreating the table later does not
+// collide with the old index names
+func renameIndexesSQL(schema, table string) string {
+	suffix := table[strings.LastIndex(table, deprecatedMarker):]
+	return fmt.Sprintf(`DO $$
+DECLARE r record;
+BEGIN
+	FOR r IN SELECT indexname FROM pg_indexes WHERE schemaname = %s AND tablename = %s LOOP
+		EXECUTE format('ALTER INDEX %%I.%%I RENAME TO %%I', %s, r.indexname,
+			left(r.indexname, %d) || %s);
+	END LOOP;
+END $$`, quoteLiteral(schema), quoteLiteral(table), quoteLiteral(schema),
+		maxIdentifierLength-len(suffix), quoteLiteral(suffix))
+}
+
+// recordDeprecation remembers a deprecated table or column so it can be
+// purged later. It runs in the tenant's migration transaction.
+func recordDeprecation(ctx context.Context, tx pgx.Tx, serviceName, tenant string, migration Migration) error {
+	var column *string
+	if migration.Type == "DEPRECATE_COLUMN" {
+		column = &migration.Column
+	}
+
+	_, err := tx.Exec(ctx, `
+		INSERT INTO dal_system.deprecated_objects
+			(service_name, tenant_id, table_name, column_name, deprecated_name)
+		VALUES ($1, $2, $3, $4, $5)`,
+		serviceName, tenant, migration.Table, column, migration.NewName)
+	return err
+}
+
+// renameDeprecations moves the deprecated columns of a table that is being
+// renamed to its new name. It runs in the tenant's migration transaction.
+func renameDeprecations(ctx context.Context, tx pgx.Tx, serviceName, tenant string, migration Migration) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE dal_system.deprecated_objects SET table_name = $4
+		WHERE service_name = $1 AND tenant_id = $2 AND table_name = $3
+		  AND column_name IS NOT NULL AND purged_at IS NULL`,
+		serviceName, tenant, migration.Table, migration.NewName)
+	return err
+}
+
+// Purge drops the deprecated tables and columns of a service that have not
+// been purged yet. An empty TenantID purges every tenant; Before limits the
+// purge to objects deprecated earlier than that time. With DryRun the
+// objects are only listed.
+func (m *Migrator) Purge(ctx context.Context, req PurgeRequest) ([]DeprecatedObject, error) {
+	unlock, err := m.lockService(ctx, req.Service)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	query := `
+		SELECT id, service_name, tenant_id, table_name, column_name, deprecated_name, deprecated_at
+		FROM dal_system.deprecated_objects
+		WHERE service_name = $1 AND purged_at IS NULL`
+	args := []interface{}{req.Service}
+	if req.TenantID != "" {
+		args = append(args, req.TenantID)
+		query += fmt.Sprintf(" AND tenant_id = $%d", len(args))
+	}
+	if req.Before != nil {
+		args = append(args, *req.Before)
+		query += fmt.Sprintf(" AND deprecated_at < $%d", len(args))
+	}
+	query += " ORDER BY deprecated_at"
+
+	rows, err := m.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deprecated objects: %w", err)
+	}
+	objects, err := pgx.CollectRows(rows, pgx.RowToStructByPos[DeprecatedObject])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deprecated objects: %w", err)
+	}
+
+	if req.DryRun {
+		return objects, nil
+	}
+
+	for i, obj := range objects {
+		if err := m.purgeObject(ctx, obj); err != nil {
+			return objects[:i], err
+		}
+	}
+
+	return objects, nil
+}
+
+// purgeObject drops a deprecated table or column and marks it purged in one
+// transaction. An object that cannot be found fails the purge instead of
+// being marked purged.
+func (m *Migrator) purgeObject(ctx context.Context, obj DeprecatedObject) error {
+	schema, err := m.router.Schema(ctx, obj.TenantID)
+	if err != nil {
+		return err
+	}
+
+	var sql string
+	if obj.ColumnName != nil {
+		sql = fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s",
+			qualifiedTable(schema, obj.TableName), quoteIdent(obj.DeprecatedName))
+	} else {
+		sql = fmt.Sprintf("DROP TABLE %s CASCADE", qualifiedTable(schema, obj.DeprecatedName))
+	}
+
+	tx, err := m.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("failed to purge %s in tenant %s: %w", obj.DeprecatedName, obj.TenantID, err)
+	}
+	if _, err := tx.Exec(ctx,
+		`UPDATE dal_system.deprecated_objects SET purged_at = NOW() WHERE id = $1`, obj.ID); err != nil {
+		return fmt.Errorf("failed to mark %s purged: %w", obj.DeprecatedName, err)
+	}
+
+	return tx.Commit(ctx)
+}
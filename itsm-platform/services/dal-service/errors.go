@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UnknownFieldError is returned when a query or write references a column
+// that is neither a DSL property nor a DAL system field of the entity
+type UnknownFieldError struct {
+	Entity string
+	Field  string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("unknown field %q on entity %s", e.Field, e.Entity)
+}
+
+// ConflictError is returned when an update's expected version no longer
+// matches the stored row. Current is the row as it is now, so the caller
+// can merge and retry.
+type ConflictError struct {
+	Entity          string
+	ID              string
+	ExpectedVersion int
+	Current         map[string]interface{}
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("optimistic lock conflict on %s %s: expected version %d, current version %v",
+		e.Entity, e.ID, e.ExpectedVersion, e.Current["version"])
+}
+
+// MigrationError is returned when a migration failed for some tenants. Those
+// tenants were rolled back; the others are migrated.
+type MigrationError struct {
+	Report *MigrationReport
+}
+
+func (e *MigrationError) Error() string {
+	tenants := make([]string, len(e.Report.Failed))
+	for i, failure := range e.Report.Failed {
+		tenants[i] = failure.TenantID
+	}
+	return fmt.Sprintf("migration of %s failed for tenants %s; migrate again to resume",
+		e.Report.Service, strings.Join(tenants, ", "))
+}
+
+// TenantUnavailableError is returned for operations on a tenant that is not
+// registered or whose lifecycle status does not allow them
+type TenantUnavailableError struct {
+	TenantID string
+	Status   string
+}
+
+func (e *TenantUnavailableError) Error() string {
+	if e.Status == "not_found" {
+		return fmt.Sprintf("tenant %s not found", e.TenantID)
+	}
+	return fmt.Sprintf("tenant %s is %s", e.TenantID, e.Status)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// planSchema stands in for the tenant schema in plan output
+const planSchema = "tenant_{tenant_id}"
+
+// dslHash identifies a DSL definition, so a resumed migration can tell which
+// tenants already reached it
+func dslHash(dsl DSLDefinition) (string, error) {
+	data, err := json.Marshal(dsl)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal DSL: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// recordStatement logs one applied migration statement for a tenant in
+// dal_system.migration_history. Logging failures never fail the migration.
+func (m *Migrator) recordStatement(ctx context.Context, runID uuid.UUID, plan *MigrationPlan, tenant, migrationType, sql string, execErr error) {
+	var errMsg *string
+	if execErr != nil {
+		msg := execErr.Error()
+		errMsg = &msg
+	}
+
+	_, err := m.db.Exec(ctx, `
+		INSERT INTO dal_system.migration_history
+			(run_id, service_name, tenant_id, migration_type, migration_detail, target_version, success, error_message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		runID, plan.Service, tenant, migrationType, sql, plan.ToVersion, execErr == nil, errMsg)
+	if err != nil {
+		log.Printf("Failed to record migration history for tenant %s: %v", tenant, err)
+	}
+}
+
+// Tenant migration states in dal_system.tenant_migrations
+const (
+	tenantApplied        = "applied"
+	tenantFailed         = "failed"
+	tenantIndexesPending = "indexes_pending" // schema migrated, online index builds failed
+)
+
+// recordTenantState stores how far a tenant got towards the plan's target
+// DSL
+func (m *Migrator) recordTenantState(ctx context.Context, runID uuid.UUID, plan *MigrationPlan, tenant, status string, migrateErr error) {
+	var errMsg *string
+	if migrateErr != nil {
+		msg := migrateErr.Error()
+		errMsg = &msg
+	}
+
+	_, err := m.db.Exec(ctx, `
+		INSERT INTO dal_system.tenant_migrations
+			(service_name, tenant_id, target_hash, target_version, status, error_message, run_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (service_name, tenant_id) DO UPDATE
+		SET target_hash = EXCLUDED.target_hash,
+		    target_version = EXCLUDED.target_version,
+		    status = EXCLUDED.status,
+		    error_message = EXCLUDED.error_message,
+		    run_id = EXCLUDED.run_id,
+		    updated_at = NOW()`,
+		plan.Service, tenant, plan.TargetHash, plan.ToVersion, status, errMsg, runID)
+	if err != nil {
+		log.Printf("Failed to record migration state for tenant %s: %v", tenant, err)
+	}
+}
+
+// tenantStates returns the recorded state of each tenant that already
+// worked towards the DSL with the given hash
+func (m *Migrator) tenantStates(ctx context.Context, serviceName, hash string) (map[string]string, error) {
+	rows, err := m.db.Query(ctx, `
+		SELECT tenant_id, status FROM dal_system.tenant_migrations
+		WHERE service_name = $1 AND target_hash = $2`,
+		serviceName, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migration state: %w", err)
+	}
+	defer rows.Close()
+
+	states := make(map[string]string)
+	for rows.Next() {
+		var tenant, status string
+		if err := rows.Scan(&tenant, &status); err != nil {
+			return nil, err
+		}
+		states[tenant] = status
+	}
+	return states, rows.Err()
+}
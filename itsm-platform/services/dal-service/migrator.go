@@ -3,58 +3,209 @@ package main
 import (
 	"context"
 	"fmt"
+	"log"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 // Migrator handles schema migrations
 type Migrator struct {
 	db       *pgxpool.Pool
+	admin    *pgxpool.Pool // bypasses row-level security
 	registry *ServiceRegistry
+	router   *TenantRouter
 }
 
-func NewMigrator(db *pgxpool.Pool, registry *ServiceRegistry) *Migrator {
+func NewMigrator(db, admin *pgxpool.Pool, registry *ServiceRegistry, router *TenantRouter) *Migrator {
 	return &Migrator{
 		db:       db,
+		admin:    admin,
 		registry: registry,
+		router:   router,
 	}
 }
 
-// Migrate performs schema migration for a service
-func (m *Migrator) Migrate(ctx context.Context, serviceName string, newDSL DSLDefinition) error {
-	// Get existing DSL
-	existingService := m.registry.GetService(serviceName)
+// Migrate performs schema migration for a service. Each tenant is migrated
+// in its own transaction; tenants that fail are rolled back, recorded and
+// retried by the next Migrate call with the same DSL, while tenants already
+// migrated are skipped. The registry is only updated once every tenant has
+// succeeded. Concurrent migrations of the same service are refused.
+func (m *Migrator) Migrate(ctx context.Context, serviceName string, newDSL DSLDefinition, opts MigrateOptions) (*MigrationReport, error) {
+	unlock, err := m.lockService(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	if existingService == nil {
-		// New service - create schemas for all tenants
-		return m.createNewService(ctx, serviceName, newDSL)
+	plan, migrations, err := m.plan(ctx, serviceName, newDSL, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// Compare and migrate
-	oldDSL := existingService.DSL
-	migrations := m.compareDSL(oldDSL, newDSL)
+	report := &MigrationReport{
+		Service:     serviceName,
+		FromVersion: plan.FromVersion,
+		ToVersion:   plan.ToVersion,
+		Skipped:     plan.Completed,
+	}
 
 	if len(migrations) == 0 {
-		return nil // No changes
+		return report, nil // No changes
+	}
+
+	// With online indexes, index builds run after the tenant's transaction
+	schemaMigrations, indexMigrations := migrations, []Migration(nil)
+	if opts.ConcurrentIndexes {
+		schemaMigrations, indexMigrations = splitIndexMigrations(migrations)
+	}
+
+	runID := uuid.New()
+	report.RunID = runID.String()
+	for i, tenant := range plan.Tenants {
+		log.Printf("Migrating %s for tenant %s (%d/%d)", serviceName, tenant, i+1, len(plan.Tenants))
+
+		if !containsString(plan.IndexesPending, tenant) {
+			err := m.applyMigrations(ctx, runID, plan, tenant, schemaMigrations)
+			if err != nil {
+				m.recordTenantState(ctx, runID, plan, tenant, tenantFailed, err)
+				log.Printf("Migration of %s failed for tenant %s: %v", serviceName, tenant, err)
+				report.Failed = append(report.Failed, TenantFailure{TenantID: tenant, Error: err.Error()})
+				continue
+			}
+		}
+
+		builds, err := m.buildIndexesOnline(ctx, runID, plan, tenant, indexMigrations)
+		report.IndexBuilds = append(report.IndexBuilds, builds...)
+		if err != nil {
+			m.recordTenantState(ctx, runID, plan, tenant, tenantIndexesPending, err)
+			log.Printf("Index build of %s failed for tenant %s: %v", serviceName, tenant, err)
+			report.Failed = append(report.Failed, TenantFailure{TenantID: tenant, Error: err.Error()})
+			continue
+		}
+
+		m.recordTenantState(ctx, runID, plan, tenant, tenantApplied, nil)
+		report.Migrated = append(report.Migrated, tenant)
+	}
+
+	if len(report.Failed) > 0 {
+		return report, &MigrationError{Report: report}
+	}
+
+	// Update registry
+	if err := m.registry.RegisterService(serviceName, newDSL); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// lockService takes the per-service migration advisory lock on a dedicated
+// connection and returns the function that releases it
+func (m *Migrator) lockService(ctx context.Context, serviceName string) (func(), error) {
+	conn, err := m.db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	key := "dal_migrate:" + serviceName
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", key).Scan(&locked); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("failed to take migration lock: %w", err)
+	}
+	if !locked {
+		conn.Release()
+		return nil, fmt.Errorf("a migration of service %s is already running", serviceName)
+	}
+
+	return func() {
+		if _, err := conn.Exec(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", key); err != nil {
+			log.Printf("Failed to release migration lock for %s: %v", serviceName, err)
+		}
+		conn.Release()
+	}, nil
+}
+
+// Plan returns the migrations Migrate would apply for newDSL without
+// executing anything
+func (m *Migrator) Plan(ctx context.Context, serviceName string, newDSL DSLDefinition, opts MigrateOptions) (*MigrationPlan, error) {
+	plan, _, err := m.plan(ctx, serviceName, newDSL, opts)
+	return plan, err
+}
+
+func (m *Migrator) plan(ctx context.Context, serviceName string, newDSL DSLDefinition, opts MigrateOptions) (*MigrationPlan, []Migration, error) {
+	hash, err := dslHash(newDSL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plan := &MigrationPlan{
+		Service:    serviceName,
+		ToVersion:  newDSL.Metadata.Version,
+		TargetHash: hash,
+		Steps:      []MigrationStep{},
+	}
+
+	// A new service is migrated from an empty DSL, i.e. all its tables are
+	// created
+	var oldDSL DSLDefinition
+	if existingService := m.registry.GetService(serviceName); existingService != nil {
+		oldDSL = existingService.DSL
+		plan.FromVersion = oldDSL.Metadata.Version
+	} else {
+		plan.NewService = true
+	}
+
+	migrations := m.compareDSL(oldDSL, applyRenames(newDSL))
+	if !opts.AllowDestructive {
+		migrations = deprecateDrops(migrations, time.Now().UTC())
+	}
+
+	for _, migration := range migrations {
+		step := MigrationStep{
+			Type:     migration.Type,
+			Table:    migration.Table,
+			Column:   migration.Column,
+			Index:    migration.indexName(),
+			RenameTo: migration.NewName,
+			SQL:      m.generateSQL(planSchema, migration),
+		}
+		if opts.ConcurrentIndexes && isIndexBuild(migration) {
+			step.Online = true
+			step.SQL = onlineIndexSQL(planSchema, migration)
+		}
+		plan.Steps = append(plan.Steps, step)
+	}
+
+	if len(migrations) == 0 {
+		return plan, nil, nil
 	}
 
-	// Get all tenants
 	tenants, err := m.listTenants(ctx)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	states, err := m.tenantStates(ctx, serviceName, hash)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Apply migrations to each tenant
 	for _, tenant := range tenants {
-		schemaName := fmt.Sprintf("tenant_%s", tenant)
-		if err := m.applyMigrations(ctx, schemaName, migrations); err != nil {
-			return fmt.Errorf("migration failed for tenant %s: %w", tenant, err)
+		switch states[tenant] {
+		case tenantApplied:
+			plan.Completed = append(plan.Completed, tenant)
+		case tenantIndexesPending:
+			plan.IndexesPending = append(plan.IndexesPending, tenant)
+			plan.Tenants = append(plan.Tenants, tenant)
+		default:
+			plan.Tenants = append(plan.Tenants, tenant)
 		}
 	}
 
-	// Update registry
-	return m.registry.RegisterService(serviceName, newDSL)
+	return plan, migrations, nil
 }
 
 // compareDSL compares old and new DSL to generate migrations
@@ -72,9 +223,16 @@ func (m *Migrator) compareDSL(old, new DSLDefinition) []Migration {
 		newNodes[node.Name] = node
 	}
 
-	// Find new tables
-	for name, node := range newNodes {
-		if _, exists := oldNodes[name]; !exists {
+	// Find new and renamed tables
+	matched := make(map[string]bool)
+	for _, node := range new.Nodes {
+		oldName := node.Name
+		if _, exists := oldNodes[oldName]; !exists && node.RenamedFrom != "" {
+			oldName = node.RenamedFrom
+		}
+
+		oldNode, exists := oldNodes[oldName]
+		if !exists || matched[oldName] {
 			migrations = append(migrations, Migration{
 				Type:  "CREATE_TABLE",
 				Table: node.Table,
@@ -82,15 +240,15 @@ func (m *Migrator) compareDSL(old, new DSLDefinition) []Migration {
 			})
 		} else {
 			// Compare properties
-			oldNode := oldNodes[name]
+			matched[oldName] = true
 			tableMigrations := m.compareNodes(oldNode, node)
 			migrations = append(migrations, tableMigrations...)
 		}
 	}
 
 	// Find dropped tables
-	for name, node := range oldNodes {
-		if _, exists := newNodes[name]; !exists {
+	for _, node := range old.Nodes {
+		if !matched[node.Name] {
 			migrations = append(migrations, Migration{
 				Type:  "DROP_TABLE",
 				Table: node.Table,
@@ -101,93 +259,182 @@ func (m *Migrator) compareDSL(old, new DSLDefinition) []Migration {
 	return migrations
 }
 
-// compareNodes compares two node definitions
+// compareNodes compares two node definitions. A table or property renamed
+// through renamed_from is renamed in place, keeping its data. All renames,
+// including those of the indexes and CHECK constraints named after the
+// table and columns, come first, so later steps find objects by their new
+// names.
 func (m *Migrator) compareNodes(old, new NodeDefinition) []Migration {
 	var migrations []Migration
 
+	if old.Table != new.Table {
+		migrations = append(migrations, Migration{
+			Type:    "RENAME_TABLE",
+			Table:   old.Table,
+			NewName: new.Table,
+		})
+	}
+
 	// Compare properties
 	oldProps := make(map[string]PropertyDefinition)
 	for _, prop := range old.Properties {
 		oldProps[prop.Name] = prop
 	}
 
-	newProps := make(map[string]PropertyDefinition)
+	// Match new properties to old columns, renaming those that moved
+	type columnPair struct {
+		old *PropertyDefinition
+		new PropertyDefinition
+	}
+	pairs := make([]columnPair, 0, len(new.Properties))
+	matched := make(map[string]bool)
+	renames := make(map[string]string)
 	for _, prop := range new.Properties {
-		newProps[prop.Name] = prop
+		oldName := prop.Name
+		if _, exists := oldProps[oldName]; !exists && prop.RenamedFrom != "" {
+			oldName = prop.RenamedFrom
+		}
+
+		oldProp, exists := oldProps[oldName]
+		if !exists || matched[oldName] {
+			pairs = append(pairs, columnPair{new: prop})
+			continue
+		}
+
+		matched[oldName] = true
+		if oldName != prop.Name {
+			migrations = append(migrations, Migration{
+				Type:    "RENAME_COLUMN",
+				Table:   new.Table,
+				Column:  oldName,
+				NewName: prop.Name,
+			})
+			renames[oldName] = prop.Name
+			oldProp.Name = prop.Name
+		}
+		pairs = append(pairs, columnPair{old: &oldProp, new: prop})
 	}
 
-	// Find new columns
-	for name, prop := range newProps {
-		if _, exists := oldProps[name]; !exists {
+	// Carry the renames over to the old indexes and constraints
+	renamed := renamedNode(old, new.Table, renames)
+	migrations = append(migrations, m.compareRenamedObjects(old, renamed)...)
+
+	// Find new and changed columns
+	for _, pair := range pairs {
+		prop := pair.new
+		if pair.old == nil {
 			migrations = append(migrations, Migration{
 				Type:     "ADD_COLUMN",
 				Table:    new.Table,
-				Column:   name,
+				Column:   prop.Name,
 				Property: &prop,
 			})
-		} else {
-			// Check if type changed
-			oldProp := oldProps[name]
-			if oldProp.Type != prop.Type {
-				migrations = append(migrations, Migration{
-					Type:     "ALTER_COLUMN",
-					Table:    new.Table,
-					Column:   name,
-					Property: &prop,
-				})
-			}
+			continue
 		}
+		migrations = append(migrations, m.compareProperty(new.Table, *pair.old, prop)...)
 	}
 
 	// Find dropped columns
-	for name := range oldProps {
-		if _, exists := newProps[name]; !exists {
+	for _, prop := range old.Properties {
+		if !matched[prop.Name] {
 			migrations = append(migrations, Migration{
 				Type:   "DROP_COLUMN",
 				Table:  new.Table,
-				Column: name,
+				Column: prop.Name,
 			})
 		}
 	}
 
-	// Compare indexes
-	migrations = append(migrations, m.compareIndexes(old, new)...)
+	migrations = append(migrations, m.compareIndexes(renamed, new)...)
+
+	return migrations
+}
+
+// compareProperty compares two definitions of the same column. Constraints
+// that could block the type change are dropped before it and re-added after.
+func (m *Migrator) compareProperty(table string, old, new PropertyDefinition) []Migration {
+	var migrations []Migration
+	prop := new
+
+	typeChanged := columnType(old) != columnType(new)
+	checkChanged := checkExpression(old) != checkExpression(new)
+	oldDefault, newDefault := defaultExpression(old), defaultExpression(new)
+
+	if checkChanged && checkExpression(old) != "" {
+		migrations = append(migrations, Migration{Type: "DROP_CHECK", Table: table, Column: new.Name, Property: &prop})
+	}
+	if typeChanged && oldDefault != "" {
+		migrations = append(migrations, Migration{Type: "DROP_DEFAULT", Table: table, Column: new.Name, Property: &prop})
+		oldDefault = ""
+	}
+
+	if typeChanged {
+		migrations = append(migrations, Migration{Type: "ALTER_COLUMN", Table: table, Column: new.Name, Property: &prop, OldProperty: &old})
+	}
+
+	if checkChanged && checkExpression(new) != "" {
+		migrations = append(migrations, Migration{Type: "ADD_CHECK", Table: table, Column: new.Name, Property: &prop})
+	}
+	if oldDefault != newDefault {
+		defaultType := "SET_DEFAULT"
+		if newDefault == "" {
+			defaultType = "DROP_DEFAULT"
+		}
+		migrations = append(migrations, Migration{Type: defaultType, Table: table, Column: new.Name, Property: &prop})
+	}
+	if old.Required != new.Required && !new.Primary {
+		nullType := "DROP_NOT_NULL"
+		if new.Required {
+			nullType = "SET_NOT_NULL"
+		}
+		migrations = append(migrations, Migration{Type: nullType, Table: table, Column: new.Name, Property: &prop})
+	}
 
 	return migrations
 }
 
-// compareIndexes compares indexes between nodes
+// compareIndexes compares the physical indexes of two node definitions,
+// including those implied by indexed and unique_per_tenant properties.
+// An index whose fields or uniqueness changed is recreated.
 func (m *Migrator) compareIndexes(old, new NodeDefinition) []Migration {
 	var migrations []Migration
 
 	oldIndexes := make(map[string]IndexDefinition)
-	for _, idx := range old.Indexes {
+	for _, idx := range nodeIndexes(old) {
 		oldIndexes[idx.Name] = idx
 	}
 
 	newIndexes := make(map[string]IndexDefinition)
-	for _, idx := range new.Indexes {
+	for _, idx := range nodeIndexes(new) {
 		newIndexes[idx.Name] = idx
 	}
 
-	// Find new indexes
-	for name, idx := range newIndexes {
-		if _, exists := oldIndexes[name]; !exists {
+	// Find dropped indexes
+	for _, idx := range nodeIndexes(old) {
+		if _, exists := newIndexes[idx.Name]; !exists {
 			migrations = append(migrations, Migration{
-				Type:  "CREATE_INDEX",
-				Table: new.Table,
-				Index: &idx,
+				Type:      "DROP_INDEX",
+				Table:     new.Table,
+				IndexName: idx.Name,
 			})
 		}
 	}
 
-	// Find dropped indexes
-	for name := range oldIndexes {
-		if _, exists := newIndexes[name]; !exists {
+	// Find new and changed indexes
+	for _, idx := range nodeIndexes(new) {
+		oldIdx, exists := oldIndexes[idx.Name]
+		switch {
+		case !exists:
 			migrations = append(migrations, Migration{
-				Type:      "DROP_INDEX",
-				Table:     new.Table,
-				IndexName: name,
+				Type:  "CREATE_INDEX",
+				Table: new.Table,
+				Index: &idx,
+			})
+		case oldIdx.Unique != idx.Unique || strings.Join(oldIdx.Fields, ",") != strings.Join(idx.Fields, ","):
+			migrations = append(migrations, Migration{
+				Type:  "RECREATE_INDEX",
+				Table: new.Table,
+				Index: &idx,
 			})
 		}
 	}
@@ -195,149 +442,247 @@ func (m *Migrator) compareIndexes(old, new NodeDefinition) []Migration {
 	return migrations
 }
 
-// applyMigrations applies migrations to a schema
-func (m *Migrator) applyMigrations(ctx context.Context, schema string, migrations []Migration) error {
+// applyMigrations applies migrations to a tenant schema in one transaction,
+// recording every statement in the migration history once the outcome is
+// known. It stops and rolls back at the first failure.
+func (m *Migrator) applyMigrations(ctx context.Context, runID uuid.UUID, plan *MigrationPlan, tenant string, migrations []Migration) error {
+	schema, err := m.router.Schema(ctx, tenant)
+	if err != nil {
+		return err
+	}
+
+	type statement struct {
+		migrationType string
+		sql           string
+		err           error
+	}
+	var executed []statement
+
+	// Backfills are subject to the tenant policy like any other write. In
+	// the shared schema they cover every tenant, so its migrations run as
+	// the admin role, which bypasses the policy.
+	db := m.db
+	if tenant == sharedTarget {
+		db = m.admin
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if tenant != sharedTarget {
+		if err := setTenant(ctx, tx, tenant); err != nil {
+			return err
+		}
+	}
+
+	var failure error
 	for _, migration := range migrations {
-		sql := m.generateSQL(schema, migration)
-		if sql == "" {
-			continue
+		statements := m.generateSQL(schema, migration)
+		if tenant == sharedTarget && migration.Type == "CREATE_TABLE" {
+			// Tables belong to the role the DAL connects as, not the admin
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s OWNER TO %s",
+				qualifiedTable(schema, migration.Table), quoteIdent(m.db.Config().ConnConfig.User)))
+		}
+		for _, sql := range statements {
+			_, err := tx.Exec(ctx, sql)
+			executed = append(executed, statement{migration.Type, sql, err})
+			if err != nil {
+				failure = fmt.Errorf("migration failed: %s - %w", sql, err)
+				break
+			}
+		}
+		if failure != nil {
+			break
 		}
 
-		if _, err := m.db.Exec(ctx, sql); err != nil {
-			return fmt.Errorf("migration failed: %s - %w", sql, err)
+		if migration.Type == "DEPRECATE_TABLE" || migration.Type == "DEPRECATE_COLUMN" {
+			if err := recordDeprecation(ctx, tx, plan.Service, tenant, migration); err != nil {
+				failure = fmt.Errorf("failed to record deprecation of %s: %w", migration.NewName, err)
+				break
+			}
+		}
+		if migration.Type == "RENAME_TABLE" {
+			if err := renameDeprecations(ctx, tx, plan.Service, tenant, migration); err != nil {
+				failure = fmt.Errorf("failed to move deprecations of %s: %w", migration.Table, err)
+				break
+			}
 		}
 	}
-	return nil
+
+	if failure == nil {
+		if err := tx.Commit(ctx); err != nil {
+			failure = fmt.Errorf("commit failed: %w", err)
+		}
+	}
+
+	// Statements that ran before a failure were rolled back with it
+	for _, stmt := range executed {
+		if stmt.err == nil && failure != nil {
+			stmt.err = fmt.Errorf("rolled back: %w", failure)
+		}
+		m.recordStatement(ctx, runID, plan, tenant, stmt.migrationType, stmt.sql, stmt.err)
+	}
+
+	return failure
 }
 
-// generateSQL generates SQL for a migration
-func (m *Migrator) generateSQL(schema string, migration Migration) string {
-	tableName := fmt.Sprintf("%s.%s", schema, migration.Table)
+// generateSQL generates the SQL statements for a migration
+func (m *Migrator) generateSQL(schema string, migration Migration) []string {
+	tableName := qualifiedTable(schema, migration.Table)
+	column := quoteIdent(migration.Column)
+	newName := quoteIdent(migration.NewName)
 
 	switch migration.Type {
 	case "CREATE_TABLE":
-		return m.generateCreateTable(schema, migration.Node)
+		sm := NewSchemaManager(m.db, m.router)
+		queries := append([]string{sm.createTableSQL(schema, *migration.Node)},
+			rowLevelSecuritySQL(schema, migration.Table)...)
+		return append(queries, sm.createIndexesSQL(schema, *migration.Node)...)
 
 	case "DROP_TABLE":
-		return fmt.Sprintf("DROP TABLE IF EXISTS %s CASCADE", tableName)
+		return []string{fmt.Sprintf("DROP TABLE IF EXISTS %s CASCADE", tableName)}
 
 	case "ADD_COLUMN":
-		colDef := m.buildColumnDef(migration.Property)
-		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", tableName, colDef)
+		prop := *migration.Property
+		if !prop.Required || prop.Backfill == "" {
+			colDef := NewSchemaManager(m.db, m.router).buildColumnDefinition(prop)
+			return []string{fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", tableName, colDef)}
+		}
+
+		// Add the column nullable, fill existing rows, then require it
+		prop.Required = false
+		colDef := NewSchemaManager(m.db, m.router).buildColumnDefinition(prop)
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", tableName, colDef),
+			backfillSQL(tableName, prop),
+			fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", tableName, column),
+		}
 
 	case "DROP_COLUMN":
-		return fmt.Sprintf("ALTER TABLE %s DROP COLUMN IF EXISTS %s", tableName, migration.Column)
+		return []string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN IF EXISTS %s", tableName, column)}
+
+	case "RENAME_TABLE":
+		return []string{fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tableName, newName)}
+
+	case "RENAME_COLUMN":
+		return []string{fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", tableName, column, newName)}
+
+	case "RENAME_INDEX":
+		return []string{fmt.Sprintf("ALTER INDEX IF EXISTS %s RENAME TO %s", qualifiedTable(schema, migration.IndexName), newName)}
+
+	case "RENAME_CONSTRAINT":
+		// Columns added before enum checks were generated may lack the
+		// constraint
+		return []string{fmt.Sprintf(`DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_constraint WHERE conname = %s AND conrelid = %s::regclass) THEN
+		ALTER TABLE %s RENAME CONSTRAINT %s TO %s;
+	END IF;
+END $$`, quoteLiteral(migration.Constraint), quoteLiteral(tableName),
+			tableName, quoteIdent(migration.Constraint), newName)}
+
+	case "DEPRECATE_TABLE":
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tableName, newName),
+			renameIndexesSQL(schema, migration.NewName),
+		}
+
+	case "DEPRECATE_COLUMN":
+		// The column no longer receives values, so it must accept NULLs
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", tableName, column, newName),
+			fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", tableName, newName),
+		}
 
 	case "ALTER_COLUMN":
-		// This is simplified - real implementation would handle type conversions
-		return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s",
-			tableName, migration.Column, m.mapType(migration.Property.Type))
+		query := fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s",
+			tableName, column, columnType(*migration.Property))
+		if using := conversionUsing(column, *migration.OldProperty, *migration.Property); using != "" {
+			query += " USING " + using
+		}
+		return []string{query}
 
-	case "CREATE_INDEX":
-		idxName := fmt.Sprintf("%s_%s", migration.Table, migration.Index.Name)
-		unique := ""
-		if migration.Index.Unique {
-			unique = "UNIQUE "
+	case "SET_NOT_NULL":
+		var queries []string
+		if migration.Property.Backfill != "" {
+			queries = append(queries, backfillSQL(tableName, *migration.Property))
 		}
-		fields := strings.Join(migration.Index.Fields, ", ")
-		return fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s(%s)",
-			unique, idxName, tableName, fields)
+		return append(queries, fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET NOT NULL", tableName, column))
 
-	case "DROP_INDEX":
-		idxName := fmt.Sprintf("%s_%s", migration.Table, migration.IndexName)
-		return fmt.Sprintf("DROP INDEX IF EXISTS %s.%s", schema, idxName)
+	case "DROP_NOT_NULL":
+		return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL", tableName, column)}
 
-	default:
-		return ""
-	}
-}
+	case "SET_DEFAULT":
+		return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s SET DEFAULT %s",
+			tableName, column, defaultExpression(*migration.Property))}
 
-// generateCreateTable generates CREATE TABLE SQL
-func (m *Migrator) generateCreateTable(schema string, node *NodeDefinition) string {
-	sm := NewSchemaManager(m.db)
-	// Reuse SchemaManager's createTable logic
-	ctx := context.Background()
-	sm.createTable(ctx, schema, *node)
-	return "" // Already executed
-}
+	case "DROP_DEFAULT":
+		return []string{fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP DEFAULT", tableName, column)}
 
-// buildColumnDef builds column definition SQL
-func (m *Migrator) buildColumnDef(prop *PropertyDefinition) string {
-	var col strings.Builder
-	col.WriteString(prop.Name)
-	col.WriteString(" ")
-	col.WriteString(m.mapType(prop.Type))
+	case "DROP_CHECK":
+		return []string{fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s",
+			tableName, quoteIdent(checkConstraintName(migration.Table, migration.Column)))}
 
-	if prop.Required {
-		col.WriteString(" NOT NULL")
-	}
+	case "ADD_CHECK":
+		name := quoteIdent(checkConstraintName(migration.Table, migration.Column))
+		return []string{
+			fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s", tableName, name),
+			fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s CHECK (%s)",
+				tableName, name, checkExpression(*migration.Property)),
+		}
 
-	if prop.Default != "" {
-		col.WriteString(fmt.Sprintf(" DEFAULT %s", prop.Default))
-	}
+	case "CREATE_INDEX":
+		return []string{createIndexSQL(schema, migration.Table, *migration.Index)}
 
-	return col.String()
-}
+	case "RECREATE_INDEX":
+		return []string{
+			fmt.Sprintf("DROP INDEX IF EXISTS %s", qualifiedTable(schema, migration.indexName())),
+			createIndexSQL(schema, migration.Table, *migration.Index),
+		}
+
+	case "DROP_INDEX":
+		return []string{fmt.Sprintf("DROP INDEX IF EXISTS %s", qualifiedTable(schema, migration.indexName()))}
 
-// mapType maps DSL type to SQL type
-func (m *Migrator) mapType(dslType string) string {
-	switch dslType {
-	case "string":
-		return "TEXT"
-	case "int", "integer":
-		return "INTEGER"
-	case "bigint":
-		return "BIGINT"
-	case "boolean", "bool":
-		return "BOOLEAN"
-	case "uuid":
-		return "UUID"
-	case "datetime", "timestamp":
-		return "TIMESTAMPTZ"
-	case "json", "jsonb":
-		return "JSONB"
 	default:
-		return "TEXT"
+		return nil
 	}
 }
 
-// createNewService creates schema for a new service
-func (m *Migrator) createNewService(ctx context.Context, serviceName string, dsl DSLDefinition) error {
-	// Register service
-	if err := m.registry.RegisterService(serviceName, dsl); err != nil {
-		return err
-	}
-
-	// Get all tenants
-	tenants, err := m.listTenants(ctx)
-	if err != nil {
-		return err
-	}
-
-	// Create schemas for all tenants
-	sm := NewSchemaManager(m.db)
-	for _, tenant := range tenants {
-		if err := sm.CreateServiceSchema(ctx, tenant, serviceName, dsl); err != nil {
-			return fmt.Errorf("failed to create schema for tenant %s: %w", tenant, err)
-		}
-	}
-
-	return nil
+// backfillSQL fills the NULL values of a column with its DSL backfill
+// expression, which may reference the row's other columns
+func backfillSQL(tableName string, prop PropertyDefinition) string {
+	column := quoteIdent(prop.Name)
+	return fmt.Sprintf("UPDATE %s SET %s = (%s) WHERE %s IS NULL",
+		tableName, column, prop.Backfill, column)
 }
 
-// listTenants lists all tenant IDs
+// listTenants lists the migration targets: schema tenants and the shared
+// schema
 func (m *Migrator) listTenants(ctx context.Context) ([]string, error) {
-	sm := NewSchemaManager(m.db)
-	return sm.ListTenants(ctx)
+	return m.router.Targets(ctx)
 }
 
 // Migration represents a schema change
 type Migration struct {
-	Type      string
-	Table     string
-	Column    string
-	Property  *PropertyDefinition
-	Node      *NodeDefinition
-	Index     *IndexDefinition
-	IndexName string
+	Type        string
+	Table       string
+	Column      string
+	Property    *PropertyDefinition
+	OldProperty *PropertyDefinition // definition replaced by an ALTER_COLUMN
+	Node        *NodeDefinition
+	Index       *IndexDefinition // physical index, see nodeIndexes
+	IndexName   string           // physical name of a dropped or renamed index
+	Constraint  string           // name of a renamed constraint
+	NewName     string           // target name of a RENAME_* or DEPRECATE_* migration
+}
+
+// indexName returns the physical name of the index a migration touches
+func (mg Migration) indexName() string {
+	if mg.Index != nil {
+		return mg.Index.Name
+	}
+	return mg.IndexName
 }
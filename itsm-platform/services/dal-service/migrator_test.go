@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// describeSteps reduces migrations to their type and the object they act on
+func describeSteps(migrations []Migration) []string {
+	steps := make([]string, len(migrations))
+	for i, migration := range migrations {
+		step := migration.Type + " " + migration.Table
+		switch {
+		case migration.Constraint != "":
+			step += " " + migration.Constraint
+		case migration.IndexName != "":
+			step += " " + migration.IndexName
+		case migration.Index != nil:
+			step += " " + migration.Index.Name
+		case migration.Column != "":
+			step += " " + migration.Column
+		}
+		if migration.NewName != "" {
+			step += " -> " + migration.NewName
+		}
+		steps[i] = step
+	}
+	return steps
+}
+
+func TestCompareNodesRenamesColumnBeforeCheckChange(t *testing.T) {
+	old := NodeDefinition{
+		Name:  "Ticket",
+		Table: "tickets",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "status", Type: "enum", Values: []string{"open", "closed"}},
+		},
+	}
+	new := NodeDefinition{
+		Name:  "Ticket",
+		Table: "tickets",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "state", RenamedFrom: "status", Type: "enum", Values: []string{"open", "pending", "closed"}},
+		},
+	}
+
+	got := describeSteps((&Migrator{}).compareNodes(old, new))
+	want := []string{
+		"RENAME_COLUMN tickets status -> state",
+		"RENAME_CONSTRAINT tickets tickets_status_check -> tickets_state_check",
+		"DROP_CHECK tickets state",
+		"ADD_CHECK tickets state",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("steps:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestCompareNodesRenamesTableBeforeCheckAndIndexChanges(t *testing.T) {
+	old := NodeDefinition{
+		Name:  "Ticket",
+		Table: "tickets",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "status", Type: "enum", Values: []string{"open", "closed"}, Indexed: true},
+			{Name: "code", Type: "string", UniquePerTenant: true},
+		},
+	}
+	new := NodeDefinition{
+		Name:        "Incident",
+		RenamedFrom: "Ticket",
+		Table:       "incidents",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "status", Type: "enum", Values: []string{"open", "pending", "closed"}, Indexed: true},
+			{Name: "code", Type: "string"},
+			{Name: "priority", Type: "string", Indexed: true},
+		},
+	}
+
+	got := describeSteps((&Migrator{}).compareNodes(old, new))
+	want := []string{
+		"RENAME_TABLE tickets -> incidents",
+		"RENAME_INDEX incidents idx_tickets_status -> idx_incidents_status",
+		"RENAME_INDEX incidents uniq_tickets_code_tenant -> uniq_incidents_code_tenant",
+		"RENAME_INDEX incidents idx_tickets_tenant_id -> idx_incidents_tenant_id",
+		"RENAME_INDEX incidents idx_tickets_not_deleted -> idx_incidents_not_deleted",
+		"RENAME_CONSTRAINT incidents tickets_status_check -> incidents_status_check",
+		"DROP_CHECK incidents status",
+		"ADD_CHECK incidents status",
+		"ADD_COLUMN incidents priority",
+		"DROP_INDEX incidents uniq_incidents_code_tenant",
+		"CREATE_INDEX incidents idx_incidents_priority",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("steps:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestGenerateSQLQuotesNames(t *testing.T) {
+	group := PropertyDefinition{Name: "group", Type: "string", Required: true, Backfill: "'none'"}
+	tests := []struct {
+		migration Migration
+		want      []string
+	}{
+		{
+			Migration{Type: "ADD_COLUMN", Table: "tickets", Column: "group", Property: &group},
+			[]string{
+				`ALTER TABLE "tenant_acme"."tickets" ADD COLUMN IF NOT EXISTS "group" TEXT`,
+				`UPDATE "tenant_acme"."tickets" SET "group" = ('none') WHERE "group" IS NULL`,
+				`ALTER TABLE "tenant_acme"."tickets" ALTER COLUMN "group" SET NOT NULL`,
+			},
+		},
+		{
+			Migration{Type: "DROP_COLUMN", Table: "tickets", Column: "group"},
+			[]string{`ALTER TABLE "tenant_acme"."tickets" DROP COLUMN IF EXISTS "group"`},
+		},
+		{
+			Migration{Type: "RENAME_TABLE", Table: "tickets", NewName: "order"},
+			[]string{`ALTER TABLE "tenant_acme"."tickets" RENAME TO "order"`},
+		},
+		{
+			Migration{Type: "RENAME_COLUMN", Table: "tickets", Column: "user", NewName: "group"},
+			[]string{`ALTER TABLE "tenant_acme"."tickets" RENAME COLUMN "user" TO "group"`},
+		},
+		{
+			Migration{Type: "RENAME_INDEX", Table: "tickets", IndexName: "idx_tickets_user", NewName: "idx_tickets_group"},
+			[]string{`ALTER INDEX IF EXISTS "tenant_acme"."idx_tickets_user" RENAME TO "idx_tickets_group"`},
+		},
+		{
+			Migration{Type: "DROP_NOT_NULL", Table: "tickets", Column: "group"},
+			[]string{`ALTER TABLE "tenant_acme"."tickets" ALTER COLUMN "group" DROP NOT NULL`},
+		},
+		{
+			Migration{Type: "DROP_CHECK", Table: "tickets", Column: "group"},
+			[]string{`ALTER TABLE "tenant_acme"."tickets" DROP CONSTRAINT IF EXISTS "tickets_group_check"`},
+		},
+		{
+			Migration{Type: "DROP_INDEX", Table: "tickets", IndexName: "idx_tickets_group"},
+			[]string{`DROP INDEX IF EXISTS "tenant_acme"."idx_tickets_group"`},
+		},
+	}
+
+	m := &Migrator{}
+	for _, tt := range tests {
+		t.Run(tt.migration.Type, func(t *testing.T) {
+			got := m.generateSQL("tenant_acme", tt.migration)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statements:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrationErrorListsFailedTenants(t *testing.T) {
+	err := &MigrationError{Report: &MigrationReport{
+		Service:  "tickets",
+		Migrated: []string{"acme"},
+		Failed: []TenantFailure{
+			{TenantID: "globex", Error: "boom"},
+			{TenantID: "initech", Error: "boom"},
+		},
+	}}
+
+	want := "migration of tickets failed for tenants globex, initech; migrate again to resume"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err.Error(), want)
+	}
+}
+
+func TestApplyMigrationsRollsBackTenantOnFailure(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	dsl := DSLDefinition{
+		Metadata: ServiceMetadata{Service: "migrate-test"},
+		Nodes: []NodeDefinition{{
+			Name:       "Ticket",
+			Table:      "tickets",
+			Properties: []PropertyDefinition{{Name: "id", Type: "uuid", Primary: true}},
+		}},
+	}
+	tenantID, router := testTenant(t, db, dsl)
+	m := NewMigrator(db, nil, NewServiceRegistry(nil), router)
+
+	priority := PropertyDefinition{Name: "priority", Type: "integer"}
+	broken := PropertyDefinition{Name: "score", Type: "integer", Required: true, Backfill: "no_such_column"}
+	plan := &MigrationPlan{Service: "migrate-test"}
+	err := m.applyMigrations(ctx, uuid.New(), plan, tenantID, []Migration{
+		{Type: "ADD_COLUMN", Table: "tickets", Column: "priority", Property: &priority},
+		{Type: "ADD_COLUMN", Table: "tickets", Column: "score", Property: &broken},
+	})
+	if err == nil || !strings.Contains(err.Error(), "no_such_column") {
+		t.Fatalf("got error %v, want the backfill to fail", err)
+	}
+
+	schema, err := router.Schema(ctx, tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var columns int
+	err = db.QueryRow(ctx, `
+		SELECT count(*) FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = 'tickets' AND column_name IN ('priority', 'score')`,
+		schema).Scan(&columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if columns != 0 {
+		t.Errorf("%d columns of the failed migration were left behind", columns)
+	}
+}
+
+func TestLockServiceRefusesConcurrentMigrations(t *testing.T) {
+	ctx := context.Background()
+	m := NewMigrator(testDB(t), nil, nil, nil)
+	service := "lock-" + uuid.NewString()
+
+	unlock, err := m.lockService(ctx, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.lockService(ctx, service); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Errorf("second lock: got error %v, want already running", err)
+	}
+	other, err := m.lockService(ctx, service+"-other")
+	if err != nil {
+		t.Errorf("lock of another service: %v", err)
+	} else {
+		other()
+	}
+
+	unlock()
+	relock, err := m.lockService(ctx, service)
+	if err != nil {
+		t.Fatalf("lock after release: %v", err)
+	}
+	relock()
+}
+
+func TestCompareProperty(t *testing.T) {
+	status := PropertyDefinition{Name: "status", Type: "enum", Values: []string{"open", "closed"}, Default: "open"}
+	title := PropertyDefinition{Name: "title", Type: "string", MaxLength: 100}
+	amount := PropertyDefinition{Name: "amount", Type: "decimal", Precision: 10, Scale: 2}
+
+	with := func(prop PropertyDefinition, change func(*PropertyDefinition)) PropertyDefinition {
+		change(&prop)
+		return prop
+	}
+
+	tests := []struct {
+		name     string
+		old, new PropertyDefinition
+		want     []string
+	}{
+		{"unchanged", status, status, []string{}},
+		{
+			"enum value added",
+			status,
+			with(status, func(p *PropertyDefinition) { p.Values = []string{"open", "on_hold", "closed"} }),
+			[]string{"DROP_CHECK tickets status", "ADD_CHECK tickets status"},
+		},
+		{
+			"default changed",
+			status,
+			with(status, func(p *PropertyDefinition) { p.Default = "closed" }),
+			[]string{"SET_DEFAULT tickets status"},
+		},
+		{
+			"default removed",
+			status,
+			with(status, func(p *PropertyDefinition) { p.Default = nil }),
+			[]string{"DROP_DEFAULT tickets status"},
+		},
+		{
+			"now required",
+			title,
+			with(title, func(p *PropertyDefinition) { p.Required = true }),
+			[]string{"SET_NOT_NULL tickets title"},
+		},
+		{
+			"no longer required",
+			with(title, func(p *PropertyDefinition) { p.Required = true }),
+			title,
+			[]string{"DROP_NOT_NULL tickets title"},
+		},
+		{
+			"primary key stays not null",
+			PropertyDefinition{Name: "id", Type: "uuid", Primary: true, Required: true},
+			PropertyDefinition{Name: "id", Type: "uuid", Primary: true},
+			[]string{},
+		},
+		{
+			"max_length changed",
+			title,
+			with(title, func(p *PropertyDefinition) { p.MaxLength = 255 }),
+			[]string{"ALTER_COLUMN tickets title"},
+		},
+		{
+			"precision changed",
+			amount,
+			with(amount, func(p *PropertyDefinition) { p.Precision = 12 }),
+			[]string{"ALTER_COLUMN tickets amount"},
+		},
+		{
+			"enum to string keeps the default around the type change",
+			status,
+			with(status, func(p *PropertyDefinition) { p.Type = "string"; p.Values = nil }),
+			[]string{"DROP_CHECK tickets status", "DROP_DEFAULT tickets status", "ALTER_COLUMN tickets status", "SET_DEFAULT tickets status"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describeSteps((&Migrator{}).compareProperty("tickets", tt.old, tt.new))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("steps:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompareIndexes(t *testing.T) {
+	node := func(props []PropertyDefinition, indexes ...IndexDefinition) NodeDefinition {
+		return NodeDefinition{Name: "Ticket", Table: "tickets", Properties: props, Indexes: indexes}
+	}
+	plain := []PropertyDefinition{{Name: "status", Type: "string"}, {Name: "code", Type: "string"}}
+	indexed := []PropertyDefinition{{Name: "status", Type: "string", Indexed: true}, {Name: "code", Type: "string", UniquePerTenant: true}}
+	byStatus := IndexDefinition{Name: "by_status", Fields: []string{"status"}}
+
+	tests := []struct {
+		name     string
+		old, new NodeDefinition
+		want     []string
+	}{
+		{"unchanged", node(indexed, byStatus), node(indexed, byStatus), []string{}},
+		{
+			"indexed and unique_per_tenant added",
+			node(plain),
+			node(indexed),
+			[]string{"CREATE_INDEX tickets idx_tickets_status", "CREATE_INDEX tickets uniq_tickets_code_tenant"},
+		},
+		{
+			"indexed and unique_per_tenant removed",
+			node(indexed),
+			node(plain),
+			[]string{"DROP_INDEX tickets idx_tickets_status", "DROP_INDEX tickets uniq_tickets_code_tenant"},
+		},
+		{
+			"fields changed",
+			node(plain, byStatus),
+			node(plain, IndexDefinition{Name: "by_status", Fields: []string{"status", "code"}}),
+			[]string{"RECREATE_INDEX tickets tickets_by_status"},
+		},
+		{
+			"field order changed",
+			node(plain, IndexDefinition{Name: "by_status", Fields: []string{"status", "code"}}),
+			node(plain, IndexDefinition{Name: "by_status", Fields: []string{"code", "status"}}),
+			[]string{"RECREATE_INDEX tickets tickets_by_status"},
+		},
+		{
+			"made unique",
+			node(plain, byStatus),
+			node(plain, IndexDefinition{Name: "by_status", Fields: []string{"status"}, Unique: true}),
+			[]string{"RECREATE_INDEX tickets tickets_by_status"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describeSteps((&Migrator{}).compareIndexes(tt.old, tt.new))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("steps:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateSQLForAttributeChanges(t *testing.T) {
+	status := PropertyDefinition{Name: "status", Type: "enum", Values: []string{"open", "on_hold"}, Default: "open"}
+	owner := PropertyDefinition{Name: "owner", Type: "string", Required: true, Backfill: "created_by::text"}
+	index := IndexDefinition{Name: "tickets_by_status", Fields: []string{"status", "owner"}, Unique: true}
+
+	tests := []struct {
+		migration Migration
+		want      []string
+	}{
+		{
+			Migration{Type: "ADD_CHECK", Table: "tickets", Column: "status", Property: &status},
+			[]string{
+				`ALTER TABLE "tenant_acme"."tickets" DROP CONSTRAINT IF EXISTS "tickets_status_check"`,
+				`ALTER TABLE "tenant_acme"."tickets" ADD CONSTRAINT "tickets_status_check" CHECK ("status" IN ('open', 'on_hold'))`,
+			},
+		},
+		{
+			Migration{Type: "SET_DEFAULT", Table: "tickets", Column: "status", Property: &status},
+			[]string{`ALTER TABLE "tenant_acme"."tickets" ALTER COLUMN "status" SET DEFAULT 'open'`},
+		},
+		{
+			Migration{Type: "DROP_DEFAULT", Table: "tickets", Column: "status", Property: &status},
+			[]string{`ALTER TABLE "tenant_acme"."tickets" ALTER COLUMN "status" DROP DEFAULT`},
+		},
+		{
+			Migration{Type: "SET_NOT_NULL", Table: "tickets", Column: "owner", Property: &owner},
+			[]string{
+				`UPDATE "tenant_acme"."tickets" SET "owner" = (created_by::text) WHERE "owner" IS NULL`,
+				`ALTER TABLE "tenant_acme"."tickets" ALTER COLUMN "owner" SET NOT NULL`,
+			},
+		},
+		{
+			Migration{Type: "RECREATE_INDEX", Table: "tickets", Index: &index},
+			[]string{
+				`DROP INDEX IF EXISTS "tenant_acme"."tickets_by_status"`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS "tickets_by_status" ON "tenant_acme"."tickets"("status", "owner")`,
+			},
+		},
+	}
+
+	m := &Migrator{}
+	for _, tt := range tests {
+		t.Run(tt.migration.Type, func(t *testing.T) {
+			got := m.generateSQL("tenant_acme", tt.migration)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statements:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
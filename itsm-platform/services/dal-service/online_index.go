@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// maxIndexAttempts bounds how often an online index build is retried after
+// it failed or left an invalid index behind
+const maxIndexAttempts = 3
+
+func isIndexBuild(migration Migration) bool {
+	return migration.Type == "CREATE_INDEX" || migration.Type == "RECREATE_INDEX"
+}
+
+// splitIndexMigrations separates the index builds that can run online from
+// the migrations that run in the tenant's transaction
+func splitIndexMigrations(migrations []Migration) (schema, indexes []Migration) {
+	for _, migration := range migrations {
+		if isIndexBuild(migration) {
+			indexes = append(indexes, migration)
+		} else {
+			schema = append(schema, migration)
+		}
+	}
+	return schema, indexes
+}
+
+// onlineIndexSQL is the concurrent form of an index build migration
+func onlineIndexSQL(schema string, migration Migration) []string {
+	create := strings.Replace(createIndexSQL(schema, migration.Table, *migration.Index),
+		"INDEX IF NOT EXISTS", "INDEX CONCURRENTLY IF NOT EXISTS", 1)
+	if migration.Type == "RECREATE_INDEX" {
+		return []string{
+			fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", qualifiedTable(schema, migration.indexName())),
+			create,
+		}
+	}
+	return []string{create}
+}
+
+// buildIndexesOnline builds index migrations for a tenant with CREATE INDEX
+// CONCURRENTLY. A build that fails or leaves an invalid index is dropped and
+// retried up to maxIndexAttempts times.
+func (m *Migrator) buildIndexesOnline(ctx context.Context, runID uuid.UUID, plan *MigrationPlan, tenant string, migrations []Migration) ([]IndexBuild, error) {
+	schema, err := m.router.Schema(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	var builds []IndexBuild
+	var failed []string
+	for _, migration := range migrations {
+		build := IndexBuild{TenantID: tenant, Index: migration.indexName()}
+
+		var err error
+		for build.Attempts < maxIndexAttempts {
+			build.Attempts++
+			if err = m.buildIndexOnline(ctx, runID, plan, tenant, schema, migration); err == nil {
+				break
+			}
+			log.Printf("Online build of index %s for tenant %s failed (attempt %d/%d): %v",
+				build.Index, tenant, build.Attempts, maxIndexAttempts, err)
+		}
+
+		if err != nil {
+			build.Error = err.Error()
+			failed = append(failed, build.Index)
+		}
+		builds = append(builds, build)
+	}
+
+	if len(failed) > 0 {
+		return builds, fmt.Errorf("online index build failed for %s", strings.Join(failed, ", "))
+	}
+	return builds, nil
+}
+
+// buildIndexOnline makes one attempt at an online index build, dropping an
+// invalid leftover of an earlier attempt first
+func (m *Migrator) buildIndexOnline(ctx context.Context, runID uuid.UUID, plan *MigrationPlan, tenant, schema string, migration Migration) error {
+	queries := onlineIndexSQL(schema, migration)
+
+	valid, exists, err := m.indexValidity(ctx, schema, migration.indexName())
+	if err != nil {
+		return err
+	}
+	if exists && !valid && migration.Type == "CREATE_INDEX" {
+		queries = append([]string{fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", qualifiedTable(schema, migration.indexName()))}, queries...)
+	}
+
+	for _, sql := range queries {
+		_, err := m.db.Exec(ctx, sql)
+		m.recordStatement(ctx, runID, plan, tenant, migration.Type, sql, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	valid, exists, err = m.indexValidity(ctx, schema, migration.indexName())
+	if err != nil {
+		return err
+	}
+	if !exists || !valid {
+		// Leave a clean slate for the next attempt
+		drop := fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s", qualifiedTable(schema, migration.indexName()))
+		_, dropErr := m.db.Exec(ctx, drop)
+		m.recordStatement(ctx, runID, plan, tenant, migration.Type, drop, dropErr)
+		return fmt.Errorf("index %s.%s is invalid after build", schema, migration.indexName())
+	}
+	return nil
+}
+
+// indexValidity reports whether an index exists and is valid
+func (m *Migrator) indexValidity(ctx context.Context, schema, name string) (valid, exists bool, err error) {
+	err = m.db.QueryRow(ctx, `
+		SELECT COALESCE(bool_and(i.indisvalid), false), count(*) > 0
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2`, schema, name).Scan(&valid, &exists)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to check index %s.%s: %w", schema, name, err)
+	}
+	return valid, exists, nil
+}
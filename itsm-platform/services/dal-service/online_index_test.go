@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSplitIndexMigrations(t *testing.T) {
+	index := &IndexDefinition{Name: "idx_tickets_status", Fields: []string{"status"}}
+	migrations := []Migration{
+		{Type: "ADD_COLUMN", Table: "tickets", Column: "status"},
+		{Type: "CREATE_INDEX", Table: "tickets", Index: index},
+		{Type: "DROP_INDEX", Table: "tickets", IndexName: "idx_tickets_code"},
+		{Type: "RECREATE_INDEX", Table: "tickets", Index: index},
+		{Type: "RENAME_INDEX", Table: "tickets", IndexName: "idx_tickets_a", NewName: "idx_tickets_b"},
+	}
+
+	schema, indexes := splitIndexMigrations(migrations)
+	wantSchema := []string{
+		"ADD_COLUMN tickets status",
+		"DROP_INDEX tickets idx_tickets_code",
+		"RENAME_INDEX tickets idx_tickets_a -> idx_tickets_b",
+	}
+	wantIndexes := []string{
+		"CREATE_INDEX tickets idx_tickets_status",
+		"RECREATE_INDEX tickets idx_tickets_status",
+	}
+	if got := describeSteps(schema); !reflect.DeepEqual(got, wantSchema) {
+		t.Errorf("schema steps:\n%v\nwant:\n%v", got, wantSchema)
+	}
+	if got := describeSteps(indexes); !reflect.DeepEqual(got, wantIndexes) {
+		t.Errorf("index steps:\n%v\nwant:\n%v", got, wantIndexes)
+	}
+}
+
+func TestOnlineIndexSQL(t *testing.T) {
+	index := &IndexDefinition{Name: "uniq_tickets_code_tenant", Fields: []string{"tenant_id", "code"}, Unique: true}
+	tests := []struct {
+		migration Migration
+		want      []string
+	}{
+		{
+			Migration{Type: "CREATE_INDEX", Table: "tickets", Index: index},
+			[]string{`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS "uniq_tickets_code_tenant" ON "tenant_acme"."tickets"("tenant_id", "code")`},
+		},
+		{
+			Migration{Type: "RECREATE_INDEX", Table: "tickets", Index: index},
+			[]string{
+				`DROP INDEX CONCURRENTLY IF EXISTS "tenant_acme"."uniq_tickets_code_tenant"`,
+				`CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS "uniq_tickets_code_tenant" ON "tenant_acme"."tickets"("tenant_id", "code")`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.migration.Type, func(t *testing.T) {
+			got := onlineIndexSQL("tenant_acme", tt.migration)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statements:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildIndexesOnlineRetriesInvalidIndexes(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	dsl := DSLDefinition{
+		Metadata: ServiceMetadata{Service: "index-test"},
+		Nodes: []NodeDefinition{{
+			Name:  "Ticket",
+			Table: "tickets",
+			Properties: []PropertyDefinition{
+				{Name: "id", Type: "uuid", Primary: true},
+				{Name: "code", Type: "string"},
+				{Name: "created_at", Type: "timestamp"},
+				{Name: "updated_at", Type: "timestamp"},
+			},
+		}},
+	}
+	tenantID, router := testTenant(t, db, dsl)
+	qe := NewQueryExecutor(db, nil, newServiceDefinition("index-test", dsl), router)
+	for i := 0; i < 2; i++ {
+		if _, err := qe.Create(ctx, tenantID, "Ticket", map[string]interface{}{"code": "T-1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := NewMigrator(db, nil, NewServiceRegistry(nil), router)
+	plan := &MigrationPlan{Service: "index-test"}
+	builds, err := m.buildIndexesOnline(ctx, uuid.New(), plan, tenantID, []Migration{
+		{Type: "CREATE_INDEX", Table: "tickets", Index: &IndexDefinition{Name: "idx_tickets_code", Fields: []string{"code"}}},
+		{Type: "CREATE_INDEX", Table: "tickets", Index: &IndexDefinition{Name: "uniq_tickets_code", Fields: []string{"code"}, Unique: true}},
+	})
+	if err == nil {
+		t.Fatal("building a unique index over duplicates succeeded")
+	}
+
+	if len(builds) != 2 {
+		t.Fatalf("got %d builds, want 2", len(builds))
+	}
+	if builds[0].Attempts != 1 || builds[0].Error != "" {
+		t.Errorf("plain index: %+v, want built on the first attempt", builds[0])
+	}
+	if builds[1].Attempts != maxIndexAttempts || builds[1].Error == "" {
+		t.Errorf("unique index: %+v, want %d failed attempts", builds[1], maxIndexAttempts)
+	}
+
+	schema, err := router.Schema(ctx, tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		name   string
+		exists bool
+	}{
+		{"idx_tickets_code", true},
+		{"uniq_tickets_code", false},
+	} {
+		valid, exists, err := m.indexValidity(ctx, schema, want.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != want.exists || exists && !valid {
+			t.Errorf("index %s: exists %t, valid %t; want exists %t and no invalid index", want.name, exists, valid, want.exists)
+		}
+	}
+}
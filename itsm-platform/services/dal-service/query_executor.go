@@ -2,102 +2,223 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
 )
 
+// relationRequestTimeout bounds cross-service relation lookups over NATS
+const relationRequestTimeout = 5 * time.Second
+
+// querier is satisfied by both *pgxpool.Pool and pgx.Tx, so the same
+// executor methods can run standalone or inside a transaction
+type querier interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
 type QueryExecutor struct {
-	db      *pgxpool.Pool
+	db      querier
+	nc      *nats.Conn
 	service *ServiceDefinition
+	router  *TenantRouter
 }
 
-func NewQueryExecutor(db *pgxpool.Pool, service *ServiceDefinition) *QueryExecutor {
+func NewQueryExecutor(db *pgxpool.Pool, nc *nats.Conn, service *ServiceDefinition, router *TenantRouter) *QueryExecutor {
 	return &QueryExecutor{
 		db:      db,
+		nc:      nc,
 		service: service,
+		router:  router,
+	}
+}
+
+// withTx returns an executor that runs its statements in tx
+func (qe *QueryExecutor) withTx(tx pgx.Tx) *QueryExecutor {
+	return &QueryExecutor{
+		db:      tx,
+		nc:      qe.nc,
+		service: qe.service,
+		router:  qe.router,
 	}
 }
 
 // Execute runs a query based on DSL Query format
-func (qe *QueryExecutor) Execute(ctx context.Context, tenantID, entityName string, query Query) ([]map[string]interface{}, int64, error) {
+func (qe *QueryExecutor) Execute(ctx context.Context, tenantID, entityName string, query Query) (*QueryResult, error) {
+	var result *QueryResult
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, err = qe.execute(ctx, tenantID, entityName, query)
+		return err
+	})
+	return result, err
+}
+
+func (qe *QueryExecutor) execute(ctx context.Context, tenantID, entityName string, query Query) (*QueryResult, error) {
 	node := qe.service.GetNode(entityName)
 	if node == nil {
-		return nil, 0, fmt.Errorf("entity %s not found", entityName)
+		return nil, fmt.Errorf("entity %s not found", entityName)
 	}
 
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
-	tableName := fmt.Sprintf("%s.%s", schemaName, node.Table)
+	if len(query.GroupBy) > 0 || len(query.Aggregates) > 0 {
+		return qe.executeAggregate(ctx, tenantID, node, query)
+	}
+
+	// Keyset pagination is requested with cursor, or by continuing from one
+	keyset := query.Cursor || query.After != ""
+	if keyset && (query.Limit <= 0 || query.Offset > 0) {
+		return nil, fmt.Errorf("cursor pagination requires a limit and cannot be combined with offset")
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keyset pages are ordered by id as a tie-breaker, and the cursor
+	// fields must be selected
+	orderBy := query.OrderBy
+	selectFields := query.Select
+	if keyset {
+		orderBy = withIDTiebreaker(orderBy)
+		if len(selectFields) > 0 && !containsString(selectFields, "*") {
+			selectFields = append([]string{}, selectFields...)
+			for _, order := range orderBy {
+				if !containsString(selectFields, order.Field) {
+					selectFields = append(selectFields, order.Field)
+				}
+			}
+		}
+	}
 
 	// Build SELECT clause
-	selectClause := qe.buildSelectClause(query.Select, node)
+	selectClause, err := qe.buildSelectClause(selectFields, node)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build WHERE clause
-	whereClause, whereParams := qe.buildWhereClause(query.Where, tenantID, node)
+	whereClause, whereParams, err := qe.buildWhereClause(query.Where, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build ORDER BY
-	orderClause := qe.buildOrderClause(query.OrderBy)
+	orderClause, err := qe.buildOrderClause(orderBy, node)
+	if err != nil {
+		return nil, err
+	}
 
-	// Build query
-	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", tableName, whereClause)
+	// Restrict to rows after the cursor; the count keeps the plain filter
+	pageClause, pageParams := whereClause, whereParams
+	if query.After != "" {
+		values, err := decodeCursor(query.After, orderBy)
+		if err != nil {
+			return nil, err
+		}
+		pageParams = append([]interface{}{}, whereParams...)
+		pageClause += " AND " + buildKeysetClause(orderBy, values, &pageParams)
+	}
 
+	// Build query
 	mainQuery := fmt.Sprintf("SELECT %s FROM %s WHERE %s",
-		selectClause, tableName, whereClause)
+		selectClause, tableName, pageClause)
 
 	if orderClause != "" {
 		mainQuery += " ORDER BY " + orderClause
 	}
 
-	// Add pagination
-	if query.Limit > 0 {
+	// Add pagination, fetching one extra row to detect a next page
+	if keyset {
+		mainQuery += fmt.Sprintf(" LIMIT %d", query.Limit+1)
+	} else if query.Limit > 0 {
 		mainQuery += fmt.Sprintf(" LIMIT %d", query.Limit)
 	}
 	if query.Offset > 0 {
 		mainQuery += fmt.Sprintf(" OFFSET %d", query.Offset)
 	}
 
+	result := &QueryResult{}
+
 	// Execute count query
-	var total int64
-	err := qe.db.QueryRow(ctx, countQuery, whereParams...).Scan(&total)
-	if err != nil {
-		return nil, 0, fmt.Errorf("count query failed: %w", err)
+	if !query.SkipTotal {
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", tableName, whereClause)
+
+		var total int64
+		if err := qe.db.QueryRow(ctx, countQuery, whereParams...).Scan(&total); err != nil {
+			return nil, fmt.Errorf("count query failed: %w", err)
+		}
+		result.Total = &total
 	}
 
 	// Execute main query
-	rows, err := qe.db.Query(ctx, mainQuery, whereParams...)
+	rows, err := qe.db.Query(ctx, mainQuery, pageParams...)
 	if err != nil {
-		return nil, 0, fmt.Errorf("query failed: %w", err)
+		return nil, fmt.Errorf("query failed: %w", err)
 	}
 	defer rows.Close()
 
 	results, err := qe.scanRows(rows)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+
+	if keyset && len(results) > query.Limit {
+		results = results[:query.Limit]
+		cursor, err := encodeCursor(orderBy, results[len(results)-1])
+		if err != nil {
+			return nil, err
+		}
+		result.NextCursor = cursor
 	}
 
 	// Handle relations if requested
 	if len(query.Relations) > 0 {
-		results = qe.fetchRelations(ctx, tenantID, results, query.Relations)
+		if err := qe.fetchRelations(ctx, tenantID, node, results, query.Relations); err != nil {
+			return nil, err
+		}
 	}
 
-	return results, total, nil
+	result.Data = results
+	return result, nil
 }
 
 // Create inserts a new record
 func (qe *QueryExecutor) Create(ctx context.Context, tenantID, entityName string, data map[string]interface{}) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, err = qe.create(ctx, tenantID, entityName, data)
+		return err
+	})
+	return result, err
+}
+
+func (qe *QueryExecutor) create(ctx context.Context, tenantID, entityName string, data map[string]interface{}) (map[string]interface{}, error) {
 	node := qe.service.GetNode(entityName)
 	if node == nil {
 		return nil, fmt.Errorf("entity %s not found", entityName)
 	}
 
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
-	tableName := fmt.Sprintf("%s.%s", schemaName, node.Table)
+	// System fields are set by the DAL alone
+	for col := range data {
+		if isSystemField(col, node) {
+			return nil, fmt.Errorf("field %s cannot be set by create", col)
+		}
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
 
-	// Add system fields
 	data["id"] = uuid.New().String()
 	data["tenant_id"] = tenantID
 	data["created_at"] = time.Now().UTC()
@@ -114,7 +235,10 @@ func (qe *QueryExecutor) Create(ctx context.Context, tenantID, entityName string
 
 	i := 1
 	for col, val := range data {
-		columns = append(columns, col)
+		if !qe.isValidField(col, node) {
+			return nil, &UnknownFieldError{Entity: node.Name, Field: col}
+		}
+		columns = append(columns, quoteIdent(col))
 		placeholders = append(placeholders, fmt.Sprintf("$%d", i))
 		values = append(values, val)
 		i++
@@ -123,119 +247,183 @@ func (qe *QueryExecutor) Create(ctx context.Context, tenantID, entityName string
 	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) RETURNING *",
 		tableName, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
 
-	row := qe.db.QueryRow(ctx, query, values...)
-	result, err := qe.scanRow(row, node)
+	result, err := qe.queryOne(ctx, query, values...)
 	if err != nil {
 		return nil, fmt.Errorf("insert failed: %w", err)
 	}
 
+	if err := qe.audit(ctx, tenantID, node, auditChange{action: AuditCreate, after: result}); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
-// Update modifies an existing record
-func (qe *QueryExecutor) Update(ctx context.Context, tenantID, entityName, id string, data map[string]interface{}) (map[string]interface{}, error) {
+// Update modifies an existing record. For optimistically locked entities
+// expectedVersion must be the version the caller read; the update only
+// applies if it still matches, otherwise a *ConflictError carrying the
+// current row is returned.
+func (qe *QueryExecutor) Update(ctx context.Context, tenantID, entityName, id string, expectedVersion int, data map[string]interface{}) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, err = qe.update(ctx, tenantID, entityName, id, expectedVersion, data)
+		return err
+	})
+	return result, err
+}
+
+func (qe *QueryExecutor) update(ctx context.Context, tenantID, entityName, id string, expectedVersion int, data map[string]interface{}) (map[string]interface{}, error) {
 	node := qe.service.GetNode(entityName)
 	if node == nil {
 		return nil, fmt.Errorf("entity %s not found", entityName)
 	}
 
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
-	tableName := fmt.Sprintf("%s.%s", schemaName, node.Table)
+	if node.DAL.OptimisticLock && expectedVersion <= 0 {
+		return nil, fmt.Errorf("version is required to update %s", entityName)
+	}
+	if err := checkUpdatableFields(data, "update"); err != nil {
+		return nil, err
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
 
-	// Get current version if using optimistic locking
-	var currentVersion int
-	if node.DAL.OptimisticLock {
-		vQuery := fmt.Sprintf("SELECT version FROM %s WHERE id = $1 AND tenant_id = $2", tableName)
-		err := qe.db.QueryRow(ctx, vQuery, id, tenantID).Scan(&currentVersion)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get current version: %w", err)
-		}
-		data["version"] = currentVersion + 1
+	// Lock the row and keep its values for the audit diff
+	before, err := qe.queryOne(ctx, fmt.Sprintf("SELECT * FROM %s WHERE id = $1 AND tenant_id = $2 FOR UPDATE", tableName), id, tenantID)
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("entity not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("update failed: %w", err)
 	}
 
 	// Add updated_at
 	data["updated_at"] = time.Now().UTC()
 
 	// Build UPDATE query
-	setClauses := make([]string, 0, len(data))
-	values := make([]interface{}, 0, len(data)+2)
+	setClauses := make([]string, 0, len(data)+1)
+	values := make([]interface{}, 0, len(data)+3)
 
-	i := 1
 	for col, val := range data {
-		setClauses = append(setClauses, fmt.Sprintf("%s = $%d", col, i))
-		values = append(values, val)
-		i++
+		if !qe.isValidField(col, node) {
+			return nil, &UnknownFieldError{Entity: node.Name, Field: col}
+		}
+		setClauses = append(setClauses, fmt.Sprintf("%s = %s", quoteIdent(col), bindParam(&values, val)))
 	}
 
-	values = append(values, id, tenantID)
+	if node.DAL.OptimisticLock {
+		setClauses = append(setClauses, "version = version + 1")
+	}
 
-	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = $%d AND tenant_id = $%d",
-		tableName, strings.Join(setClauses, ", "), i, i+1)
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE id = %s AND tenant_id = %s",
+		tableName, strings.Join(setClauses, ", "), bindParam(&values, id), bindParam(&values, tenantID))
 
-	// Add optimistic lock check
+	if node.DAL.SoftDelete {
+		query += " AND deleted_at IS NULL"
+	}
+
+	// Compare against the caller's version in the same statement
 	if node.DAL.OptimisticLock {
-		query += fmt.Sprintf(" AND version = %d", currentVersion)
+		query += fmt.Sprintf(" AND version = %s", bindParam(&values, expectedVersion))
 	}
 
 	query += " RETURNING *"
 
-	row := qe.db.QueryRow(ctx, query, values...)
-	result, err := qe.scanRow(row, node)
-	if err != nil {
-		if err == pgx.ErrNoRows && node.DAL.OptimisticLock {
-			return nil, fmt.Errorf("optimistic lock conflict")
+	result, err := qe.queryOne(ctx, query, values...)
+	if err == pgx.ErrNoRows && node.DAL.OptimisticLock {
+		current, getErr := qe.getByID(ctx, tenantID, entityName, id)
+		if getErr == pgx.ErrNoRows {
+			return nil, fmt.Errorf("entity not found")
+		}
+		if getErr != nil {
+			return nil, fmt.Errorf("update failed: %w", getErr)
+		}
+		return nil, &ConflictError{
+			Entity:          entityName,
+			ID:              id,
+			ExpectedVersion: expectedVersion,
+			Current:         current,
 		}
+	}
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("entity not found")
+	}
+	if err != nil {
 		return nil, fmt.Errorf("update failed: %w", err)
 	}
 
+	if err := qe.audit(ctx, tenantID, node, auditChange{action: AuditUpdate, before: before, after: result}); err != nil {
+		return nil, err
+	}
+
 	return result, nil
 }
 
 // Delete removes a record (soft or hard delete based on DSL)
 func (qe *QueryExecutor) Delete(ctx context.Context, tenantID, entityName, id string) error {
+	return qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) error {
+		return qe.delete(ctx, tenantID, entityName, id)
+	})
+}
+
+func (qe *QueryExecutor) delete(ctx context.Context, tenantID, entityName, id string) error {
 	node := qe.service.GetNode(entityName)
 	if node == nil {
 		return fmt.Errorf("entity %s not found", entityName)
 	}
 
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
-	tableName := fmt.Sprintf("%s.%s", schemaName, node.Table)
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return err
+	}
 
 	var query string
 	var params []interface{}
 
 	if node.DAL.SoftDelete {
 		// Soft delete
-		query = fmt.Sprintf("UPDATE %s SET deleted_at = $1 WHERE id = $2 AND tenant_id = $3",
+		query = fmt.Sprintf("UPDATE %s SET deleted_at = $1 WHERE id = $2 AND tenant_id = $3 AND deleted_at IS NULL RETURNING *",
 			tableName)
 		params = []interface{}{time.Now().UTC(), id, tenantID}
 	} else {
 		// Hard delete
-		query = fmt.Sprintf("DELETE FROM %s WHERE id = $1 AND tenant_id = $2", tableName)
+		query = fmt.Sprintf("DELETE FROM %s WHERE id = $1 AND tenant_id = $2 RETURNING *", tableName)
 		params = []interface{}{id, tenantID}
 	}
 
-	result, err := qe.db.Exec(ctx, query, params...)
+	row, err := qe.queryOne(ctx, query, params...)
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("entity not found")
+	}
 	if err != nil {
 		return fmt.Errorf("delete failed: %w", err)
 	}
 
-	if result.RowsAffected() == 0 {
-		return fmt.Errorf("entity not found")
-	}
-
-	return nil
+	return qe.audit(ctx, tenantID, node, deleteChange(node, row))
 }
 
 // GetByID retrieves a single record
 func (qe *QueryExecutor) GetByID(ctx context.Context, tenantID, entityName, id string) (map[string]interface{}, error) {
+	var result map[string]interface{}
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, err = qe.getByID(ctx, tenantID, entityName, id)
+		return err
+	})
+	return result, err
+}
+
+func (qe *QueryExecutor) getByID(ctx context.Context, tenantID, entityName, id string) (map[string]interface{}, error) {
 	node := qe.service.GetNode(entityName)
 	if node == nil {
 		return nil, fmt.Errorf("entity %s not found", entityName)
 	}
 
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
-	tableName := fmt.Sprintf("%s.%s", schemaName, node.Table)
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
 
 	query := fmt.Sprintf("SELECT * FROM %s WHERE id = $1 AND tenant_id = $2", tableName)
 
@@ -243,38 +431,33 @@ func (qe *QueryExecutor) GetByID(ctx context.Context, tenantID, entityName, id s
 		query += " AND deleted_at IS NULL"
 	}
 
-	row := qe.db.QueryRow(ctx, query, id, tenantID)
-	return qe.scanRow(row, node)
+	return qe.queryOne(ctx, query, id, tenantID)
 }
 
-func (qe *QueryExecutor) buildSelectClause(fields []string, node *NodeDefinition) string {
+func (qe *QueryExecutor) buildSelectClause(fields []string, node *NodeDefinition) (string, error) {
 	if len(fields) == 0 {
-		return "*"
+		return "*", nil
 	}
 
 	// Validate fields exist
-	validFields := make([]string, 0, len(fields))
+	columns := make([]string, 0, len(fields))
 	for _, field := range fields {
 		if field == "*" {
-			return "*"
+			return "*", nil
 		}
-		// Check if field exists in node properties or is a system field
-		if qe.isValidField(field, node) {
-			validFields = append(validFields, field)
+		column, err := qe.quoteField(field, node)
+		if err != nil {
+			return "", err
 		}
+		columns = append(columns, column)
 	}
 
-	if len(validFields) == 0 {
-		return "*"
-	}
-
-	return strings.Join(validFields, ", ")
+	return strings.Join(columns, ", "), nil
 }
 
-func (qe *QueryExecutor) buildWhereClause(conditions []Condition, tenantID string, node *NodeDefinition) (string, []interface{}) {
+func (qe *QueryExecutor) buildWhereClause(conditions []Condition, tenantID string, node *NodeDefinition) (string, []interface{}, error) {
 	clauses := []string{"tenant_id = $1"}
 	params := []interface{}{tenantID}
-	paramCount := 1
 
 	// Add soft delete filter
 	if node.DAL.SoftDelete {
@@ -282,103 +465,220 @@ func (qe *QueryExecutor) buildWhereClause(conditions []Condition, tenantID strin
 	}
 
 	for _, cond := range conditions {
-		paramCount++
-		clause, param := qe.buildCondition(cond, paramCount)
+		clause, err := qe.buildCondition(cond, node, &params)
+		if err != nil {
+			return "", nil, err
+		}
 		if clause != "" {
 			clauses = append(clauses, clause)
-			if param != nil {
-				params = append(params, param)
-			}
 		}
 	}
 
-	return strings.Join(clauses, " AND "), params
+	return strings.Join(clauses, " AND "), params, nil
 }
 
-func (qe *QueryExecutor) buildCondition(cond Condition, paramNum int) (string, interface{}) {
+// buildCondition renders a condition and its nested or/and groups,
+// appending any bound values to params
+func (qe *QueryExecutor) buildCondition(cond Condition, node *NodeDefinition, params *[]interface{}) (string, error) {
+	var parts []string
+
+	if cond.Field != "" {
+		clause, err := qe.buildPredicate(cond, node, params)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, clause)
+	}
+
+	for _, group := range []struct {
+		conditions []Condition
+		joiner     string
+	}{{cond.Or, " OR "}, {cond.And, " AND "}} {
+		clause, err := qe.buildConditionGroup(group.conditions, group.joiner, node, params)
+		if err != nil {
+			return "", err
+		}
+		if clause != "" {
+			parts = append(parts, clause)
+		}
+	}
+
+	return strings.Join(parts, " AND "), nil
+}
+
+// buildConditionGroup joins nested conditions with the given operator and
+// wraps them in parentheses
+func (qe *QueryExecutor) buildConditionGroup(conditions []Condition, joiner string, node *NodeDefinition, params *[]interface{}) (string, error) {
+	clauses := make([]string, 0, len(conditions))
+	for _, cond := range conditions {
+		clause, err := qe.buildCondition(cond, node, params)
+		if err != nil {
+			return "", err
+		}
+		if clause != "" {
+			clauses = append(clauses, clause)
+		}
+	}
+
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return "(" + strings.Join(clauses, joiner) + ")", nil
+}
+
+// buildPredicate renders a single field predicate. Fields of the form
+// "column.key.subkey" on json/jsonb properties compare against the value
+// at that path.
+func (qe *QueryExecutor) buildPredicate(cond Condition, node *NodeDefinition, params *[]interface{}) (string, error) {
+	var column string
+	isJSONColumn := false
+
+	if name, path, ok := splitJSONPath(cond.Field, node); ok {
+		column = jsonPathColumn(quoteIdent(name), path, cond.Value, params)
+	} else {
+		quoted, err := qe.quoteField(cond.Field, node)
+		if err != nil {
+			return "", err
+		}
+		column = quoted
+		if prop := findProperty(node, cond.Field); prop != nil {
+			isJSONColumn = isJSONType(prop.Type)
+		}
+	}
+
 	switch cond.Operator {
 	case "eq", "=":
-		return fmt.Sprintf("%s = $%d", cond.Field, paramNum), cond.Value
-	case "ne", "!=":
-		return fmt.Sprintf("%s != $%d", cond.Field, paramNum), cond.Value
+		return fmt.Sprintf("%s = %s", column, bindParam(params, cond.Value)), nil
+	case "ne", "neq", "!=":
+		return fmt.Sprintf("%s != %s", column, bindParam(params, cond.Value)), nil
 	case "gt", ">":
-		return fmt.Sprintf("%s > $%d", cond.Field, paramNum), cond.Value
+		return fmt.Sprintf("%s > %s", column, bindParam(params, cond.Value)), nil
 	case "gte", ">=":
-		return fmt.Sprintf("%s >= $%d", cond.Field, paramNum), cond.Value
+		return fmt.Sprintf("%s >= %s", column, bindParam(params, cond.Value)), nil
 	case "lt", "<":
-		return fmt.Sprintf("%s < $%d", cond.Field, paramNum), cond.Value
+		return fmt.Sprintf("%s < %s", column, bindParam(params, cond.Value)), nil
 	case "lte", "<=":
-		return fmt.Sprintf("%s <= $%d", cond.Field, paramNum), cond.Value
+		return fmt.Sprintf("%s <= %s", column, bindParam(params, cond.Value)), nil
 	case "like":
-		return fmt.Sprintf("%s LIKE $%d", cond.Field, paramNum), cond.Value
-	case "in":
-		// Handle array values
-		if arr, ok := cond.Value.([]interface{}); ok {
-			placeholders := make([]string, len(arr))
-			for i := range arr {
-				placeholders[i] = fmt.Sprintf("$%d", paramNum+i)
+		return fmt.Sprintf("%s LIKE %s", column, bindParam(params, cond.Value)), nil
+	case "ilike":
+		return fmt.Sprintf("%s ILIKE %s", column, bindParam(params, cond.Value)), nil
+	case "contains":
+		if isJSONColumn {
+			doc, err := json.Marshal(cond.Value)
+			if err != nil {
+				return "", fmt.Errorf("invalid value for %s contains: %w", cond.Field, err)
 			}
-			return fmt.Sprintf("%s IN (%s)", cond.Field, strings.Join(placeholders, ",")), arr
+			return fmt.Sprintf("%s @> %s::jsonb", column, bindParam(params, string(doc))), nil
 		}
-		return "", nil
+		return fmt.Sprintf("%s LIKE %s", column, bindParam(params, "%"+escapeLike(cond.Value)+"%")), nil
+	case "starts_with":
+		return fmt.Sprintf("%s LIKE %s", column, bindParam(params, escapeLike(cond.Value)+"%")), nil
+	case "ends_with":
+		return fmt.Sprintf("%s LIKE %s", column, bindParam(params, "%"+escapeLike(cond.Value))), nil
+	case "in", "not_in":
+		arr, ok := cond.Value.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("operator %s on %s requires an array value", cond.Operator, cond.Field)
+		}
+		if len(arr) == 0 {
+			// Empty IN matches nothing, empty NOT IN matches everything
+			if cond.Operator == "in" {
+				return "FALSE", nil
+			}
+			return "TRUE", nil
+		}
+		placeholders := make([]string, len(arr))
+		for i, v := range arr {
+			placeholders[i] = bindParam(params, v)
+		}
+		op := "IN"
+		if cond.Operator == "not_in" {
+			op = "NOT IN"
+		}
+		return fmt.Sprintf("%s %s (%s)", column, op, strings.Join(placeholders, ", ")), nil
+	case "between":
+		arr, ok := cond.Value.([]interface{})
+		if !ok || len(arr) != 2 {
+			return "", fmt.Errorf("operator between on %s requires a [from, to] value", cond.Field)
+		}
+		return fmt.Sprintf("%s BETWEEN %s AND %s",
+			column, bindParam(params, arr[0]), bindParam(params, arr[1])), nil
 	case "is_null":
-		return fmt.Sprintf("%s IS NULL", cond.Field), nil
+		return fmt.Sprintf("%s IS NULL", column), nil
 	case "is_not_null":
-		return fmt.Sprintf("%s IS NOT NULL", cond.Field), nil
+		return fmt.Sprintf("%s IS NOT NULL", column), nil
+	case "has_key", "has_any_keys", "has_all_keys":
+		if !isJSONColumn {
+			return "", fmt.Errorf("operator %s requires a json property, got %s", cond.Operator, cond.Field)
+		}
+		if cond.Operator == "has_key" {
+			return fmt.Sprintf("%s ? %s", column, bindParam(params, fmt.Sprint(cond.Value))), nil
+		}
+		arr, ok := cond.Value.([]interface{})
+		if !ok {
+			return "", fmt.Errorf("operator %s on %s requires an array value", cond.Operator, cond.Field)
+		}
+		keys := make([]string, len(arr))
+		for i, v := range arr {
+			keys[i] = fmt.Sprint(v)
+		}
+		op := "?|"
+		if cond.Operator == "has_all_keys" {
+			op = "?&"
+		}
+		return fmt.Sprintf("%s %s %s::text[]", column, op, bindParam(params, keys)), nil
 	default:
-		return "", nil
+		return "", fmt.Errorf("unsupported operator %q on field %s", cond.Operator, cond.Field)
 	}
 }
 
-func (qe *QueryExecutor) buildOrderClause(orderBy []OrderBy) string {
+// bindParam appends a value to params and returns its positional placeholder
+func bindParam(params *[]interface{}, value interface{}) string {
+	*params = append(*params, value)
+	return fmt.Sprintf("$%d", len(*params))
+}
+
+func (qe *QueryExecutor) buildOrderClause(orderBy []OrderBy, node *NodeDefinition) (string, error) {
 	if len(orderBy) == 0 {
-		return ""
+		return "", nil
 	}
 
 	clauses := make([]string, len(orderBy))
 	for i, order := range orderBy {
-		direction := "ASC"
+		column, err := qe.quoteField(order.Field, node)
+		if err != nil {
+			return "", err
+		}
+		// NULL placement is spelled out because keyset pagination relies on it
+		direction := "ASC NULLS LAST"
 		if order.Desc {
-			direction = "DESC"
+			direction = "DESC NULLS FIRST"
 		}
-		clauses[i] = fmt.Sprintf("%s %s", order.Field, direction)
+		clauses[i] = fmt.Sprintf("%s %s", column, direction)
 	}
 
-	return strings.Join(clauses, ", ")
+	return strings.Join(clauses, ", "), nil
 }
 
-func (qe *QueryExecutor) scanRow(row pgx.Row, node *NodeDefinition) (map[string]interface{}, error) {
-	fieldDescriptions := []string{
-		"id", "tenant_id", "created_at", "updated_at", "created_by", "updated_by",
-	}
-
-	if node.DAL.SoftDelete {
-		fieldDescriptions = append(fieldDescriptions, "deleted_at", "deleted_by")
-	}
-	if node.DAL.OptimisticLock {
-		fieldDescriptions = append(fieldDescriptions, "version")
-	}
-
-	for _, prop := range node.Properties {
-		fieldDescriptions = append(fieldDescriptions, prop.Name)
-	}
-
-	values := make([]interface{}, len(fieldDescriptions))
-	valuePtrs := make([]interface{}, len(fieldDescriptions))
-	for i := range values {
-		valuePtrs[i] = &values[i]
+// queryOne runs a query expected to return a single row, returning
+// pgx.ErrNoRows if it returns none
+func (qe *QueryExecutor) queryOne(ctx context.Context, sql string, args ...interface{}) (map[string]interface{}, error) {
+	rows, err := qe.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	if err := row.Scan(valuePtrs...); err != nil {
+	results, err := qe.scanRows(rows)
+	if err != nil {
 		return nil, err
 	}
-
-	result := make(map[string]interface{})
-	for i, field := range fieldDescriptions {
-		result[field] = values[i]
+	if len(results) == 0 {
+		return nil, pgx.ErrNoRows
 	}
 
-	return result, nil
+	return results[0], nil
 }
 
 func (qe *QueryExecutor) scanRows(rows pgx.Rows) ([]map[string]interface{}, error) {
@@ -394,6 +694,10 @@ func (qe *QueryExecutor) scanRows(rows pgx.Rows) ([]map[string]interface{}, erro
 		result := make(map[string]interface{})
 
 		for i, field := range fields {
+			// pgx returns uuid columns as raw bytes
+			if b, ok := values[i].([16]byte); ok {
+				values[i] = uuid.UUID(b).String()
+			}
 			result[string(field.Name)] = values[i]
 		}
 
@@ -403,30 +707,293 @@ func (qe *QueryExecutor) scanRows(rows pgx.Rows) ([]map[string]interface{}, erro
 	return results, rows.Err()
 }
 
-func (qe *QueryExecutor) isValidField(field string, node *NodeDefinition) bool {
-	systemFields := []string{
-		"id", "tenant_id", "created_at", "updated_at",
-		"created_by", "updated_by", "deleted_at", "deleted_by", "version",
+// systemFields returns the columns the DAL manages on a node's table: those
+// of every entity table plus the ones its soft delete and optimistic lock
+// options add
+func systemFields(node *NodeDefinition) []string {
+	fields := []string{"id", "tenant_id", "created_at", "updated_at", "created_by", "updated_by"}
+	if node.DAL.SoftDelete {
+		fields = append(fields, "deleted_at", "deleted_by")
+	}
+	if node.DAL.OptimisticLock {
+		fields = append(fields, "version")
 	}
+	return fields
+}
 
-	for _, f := range systemFields {
+func isSystemField(field string, node *NodeDefinition) bool {
+	for _, f := range systemFields(node) {
 		if f == field {
 			return true
 		}
 	}
+	return false
+}
 
-	for _, prop := range node.Properties {
-		if prop.Name == field {
-			return true
+// checkUpdatableFields rejects data that changes a field only the DAL
+// writes. updated_by is left to the caller, who knows the acting user.
+func checkUpdatableFields(data map[string]interface{}, op string) error {
+	for col := range data {
+		switch col {
+		case "id", "tenant_id", "version", "created_at", "created_by", "updated_at", "deleted_at", "deleted_by":
+			return fmt.Errorf("field %s cannot be set by %s", col, op)
 		}
 	}
+	return nil
+}
 
-	return false
+func (qe *QueryExecutor) isValidField(field string, node *NodeDefinition) bool {
+	return isSystemField(field, node) || findProperty(node, field) != nil
+}
+
+// quoteField validates a caller-supplied field against the node and returns
+// it as a quoted identifier
+func (qe *QueryExecutor) quoteField(field string, node *NodeDefinition) (string, error) {
+	if !qe.isValidField(field, node) {
+		return "", &UnknownFieldError{Entity: node.Name, Field: field}
+	}
+	return quoteIdent(field), nil
+}
+
+// tableName returns the quoted, schema-qualified table for a tenant's node
+func (qe *QueryExecutor) tableName(ctx context.Context, tenantID string, node *NodeDefinition) (string, error) {
+	return qe.router.Table(ctx, tenantID, node.Table)
+}
+
+func quoteIdent(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
+
+// findProperty returns the DSL property with the given name, if any
+func findProperty(node *NodeDefinition, name string) *PropertyDefinition {
+	for i := range node.Properties {
+		if node.Properties[i].Name == name {
+			return &node.Properties[i]
+		}
+	}
+	return nil
+}
+
+func isJSONType(dslType string) bool {
+	return dslType == "json" || dslType == "jsonb"
+}
+
+// splitJSONPath splits "metadata.plan.tier" into the json property name
+// and the key path below it
+func splitJSONPath(field string, node *NodeDefinition) (string, []string, bool) {
+	parts := strings.Split(field, ".")
+	if len(parts) < 2 {
+		return "", nil, false
+	}
+	prop := findProperty(node, parts[0])
+	if prop == nil || !isJSONType(prop.Type) {
+		return "", nil, false
+	}
+	return parts[0], parts[1:], true
+}
+
+// jsonPathColumn extracts the value at path as text, cast to match the type
+// of the value it is compared against
+func jsonPathColumn(column string, path []string, value interface{}, params *[]interface{}) string {
+	expr := fmt.Sprintf("(%s #>> %s::text[])", column, bindParam(params, path))
+
+	if arr, ok := value.([]interface{}); ok && len(arr) > 0 {
+		value = arr[0]
+	}
+	switch value.(type) {
+	case float64, int, int64:
+		return expr + "::numeric"
+	case bool:
+		return expr + "::boolean"
+	}
+	return expr
+}
+
+// escapeLike escapes LIKE wildcards so the value matches literally
+func escapeLike(value interface{}) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(fmt.Sprint(value))
+}
+
+// fetchRelations loads the requested relations for all results in one batch
+// per relation and attaches them under the relation name: a single record
+// (or nil) for belongs_to, a list for has_many
+func (qe *QueryExecutor) fetchRelations(ctx context.Context, tenantID string, node *NodeDefinition, results []map[string]interface{}, relations []RelationQuery) error {
+	for _, relQuery := range relations {
+		rel := findRelation(node, relQuery.Name)
+		if rel == nil {
+			return fmt.Errorf("relation %s not found on entity %s", relQuery.Name, node.Name)
+		}
+		if rel.Type != "belongs_to" && rel.Type != "has_many" {
+			return fmt.Errorf("unsupported relation type %s for %s", rel.Type, rel.Name)
+		}
+
+		// Collect distinct local keys
+		seen := make(map[string]bool)
+		keys := make([]interface{}, 0, len(results))
+		for _, row := range results {
+			if row[rel.LocalField] == nil {
+				continue
+			}
+			key := relationKey(row[rel.LocalField])
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+
+		var related []map[string]interface{}
+		if len(keys) > 0 {
+			query := Query{
+				Select: relQuery.Select,
+				Where: append(append([]Condition{}, relQuery.Where...),
+					Condition{Field: rel.TargetField, Operator: "in", Value: keys}),
+			}
+			// The target field is needed to match rows back to their parents
+			if len(query.Select) > 0 && !containsString(query.Select, rel.TargetField) {
+				query.Select = append(append([]string{}, query.Select...), rel.TargetField)
+			}
+
+			var err error
+			if rel.TargetService == "" || rel.TargetService == qe.service.Name {
+				related, err = qe.queryRelated(ctx, tenantID, rel.TargetNode, query)
+			} else {
+				related, err = qe.requestRelated(ctx, tenantID, rel, query)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to load relation %s: %w", rel.Name, err)
+			}
+		}
+
+		grouped := make(map[string][]map[string]interface{})
+		for _, row := range related {
+			key := relationKey(row[rel.TargetField])
+			grouped[key] = append(grouped[key], row)
+		}
+
+		for _, row := range results {
+			var matches []map[string]interface{}
+			if row[rel.LocalField] != nil {
+				matches = grouped[relationKey(row[rel.LocalField])]
+			}
+
+			if rel.Type == "belongs_to" {
+				if len(matches) > 0 {
+					row[rel.Name] = matches[0]
+				} else {
+					row[rel.Name] = nil
+				}
+			} else {
+				if matches == nil {
+					matches = []map[string]interface{}{}
+				}
+				row[rel.Name] = matches
+			}
+		}
+	}
+
+	return nil
 }
 
-func (qe *QueryExecutor) fetchRelations(ctx context.Context, tenantID string, results []map[string]interface{}, relations []RelationQuery) []map[string]interface{} {
-	// This would handle fetching related data
-	// For cross-service relations, it would make NATS calls
-	// For same-service, direct DB queries
-	return results
+// queryRelated runs a relation query against a node of the same service
+func (qe *QueryExecutor) queryRelated(ctx context.Context, tenantID, entityName string, query Query) ([]map[string]interface{}, error) {
+	node := qe.service.GetNode(entityName)
+	if node == nil {
+		return nil, fmt.Errorf("entity %s not found", entityName)
+	}
+
+	selectClause, err := qe.buildSelectClause(query.Select, node)
+	if err != nil {
+		return nil, err
+	}
+
+	whereClause, params, err := qe.buildWhereClause(query.Where, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+		selectClause, tableName, whereClause)
+
+	rows, err := qe.db.Query(ctx, sql, params...)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer rows.Close()
+
+	return qe.scanRows(rows)
+}
+
+// requestRelated runs a relation query against another service through its
+// dal.{service}.{entity}.relation subject, which serves queries without
+// waiting for a worker slot
+func (qe *QueryExecutor) requestRelated(ctx context.Context, tenantID string, rel *RelationDefinition, query Query) ([]map[string]interface{}, error) {
+	if qe.nc == nil {
+		return nil, fmt.Errorf("cross-service relations require a NATS connection")
+	}
+
+	payload, err := json.Marshal(QueryRequest{TenantID: tenantID, Query: query})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, relationRequestTimeout)
+	defer cancel()
+
+	subject := fmt.Sprintf("dal.%s.%s.relation", rel.TargetService, rel.TargetNode)
+	msg, err := qe.nc.RequestWithContext(ctx, subject, payload)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", subject, err)
+	}
+
+	var response struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+		Data    struct {
+			Data []map[string]interface{} `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Data, &response); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", subject, err)
+	}
+	if !response.Success {
+		return nil, fmt.Errorf("%s: %s", subject, response.Error)
+	}
+
+	return response.Data.Data, nil
+}
+
+func findRelation(node *NodeDefinition, name string) *RelationDefinition {
+	for i := range node.Relations {
+		if node.Relations[i].Name == name {
+			return &node.Relations[i]
+		}
+	}
+	return nil
+}
+
+// relationKey normalizes key values so rows from Postgres and from NATS
+// responses can be matched against each other
+func relationKey(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case [16]byte:
+		return uuid.UUID(v).String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/nats-io/nats.go"
+)
+
+// ticketNode is a soft-deleted node with a property of each kind the
+// query builders treat differently
+func ticketNode() *NodeDefinition {
+	return &NodeDefinition{
+		Name:  "Ticket",
+		Table: "tickets",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "title", Type: "string"},
+			{Name: "status", Type: "enum", Values: []string{"open", "pending", "closed"}},
+			{Name: "priority", Type: "integer"},
+			{Name: "assigned_to", Type: "uuid"},
+			{Name: "metadata", Type: "jsonb"},
+		},
+		DAL: DALConfig{SoftDelete: true},
+	}
+}
+
+func TestBuildWhereClauseGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions []Condition
+		wantClause string
+		wantParams []interface{}
+	}{
+		{
+			name:       "no conditions",
+			wantClause: `tenant_id = $1 AND deleted_at IS NULL`,
+			wantParams: []interface{}{"acme"},
+		},
+		{
+			name: "top-level conditions are ANDed",
+			conditions: []Condition{
+				{Field: "status", Operator: "eq", Value: "open"},
+				{Field: "priority", Operator: "gte", Value: 2},
+			},
+			wantClause: `tenant_id = $1 AND deleted_at IS NULL AND "status" = $2 AND "priority" >= $3`,
+			wantParams: []interface{}{"acme", "open", 2},
+		},
+		{
+			name: "or group",
+			conditions: []Condition{{Or: []Condition{
+				{Field: "status", Operator: "eq", Value: "open"},
+				{Field: "status", Operator: "eq", Value: "pending"},
+			}}},
+			wantClause: `tenant_id = $1 AND deleted_at IS NULL AND ("status" = $2 OR "status" = $3)`,
+			wantParams: []interface{}{"acme", "open", "pending"},
+		},
+		{
+			name: "and group nested in an or group",
+			conditions: []Condition{{Or: []Condition{
+				{Field: "assigned_to", Operator: "is_null"},
+				{And: []Condition{
+					{Field: "status", Operator: "eq", Value: "open"},
+					{Field: "priority", Operator: "gt", Value: 3},
+				}},
+			}}},
+			wantClause: `tenant_id = $1 AND deleted_at IS NULL AND ("assigned_to" IS NULL OR ("status" = $2 AND "priority" > $3))`,
+			wantParams: []interface{}{"acme", "open", 3},
+		},
+		{
+			name: "field alongside its groups",
+			conditions: []Condition{{
+				Field: "title", Operator: "contains", Value: "disk",
+				Or: []Condition{
+					{Field: "priority", Operator: "eq", Value: 1},
+					{Field: "priority", Operator: "eq", Value: 2},
+				},
+				And: []Condition{
+					{Field: "status", Operator: "ne", Value: "closed"},
+				},
+			}},
+			wantClause: `tenant_id = $1 AND deleted_at IS NULL AND "title" LIKE $2 AND ("priority" = $3 OR "priority" = $4) AND ("status" != $5)`,
+			wantParams: []interface{}{"acme", "%disk%", 1, 2, "closed"},
+		},
+		{
+			name: "empty groups are dropped",
+			conditions: []Condition{
+				{Or: []Condition{}},
+				{And: []Condition{{Or: []Condition{}}}},
+			},
+			wantClause: `tenant_id = $1 AND deleted_at IS NULL`,
+			wantParams: []interface{}{"acme"},
+		},
+	}
+
+	qe := &QueryExecutor{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clause, params, err := qe.buildWhereClause(tt.conditions, "acme", ticketNode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clause != tt.wantClause {
+				t.Errorf("clause = %s\nwant %s", clause, tt.wantClause)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("params = %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestBuildWhereClauseRejectsUnknownFieldInGroup(t *testing.T) {
+	conditions := []Condition{{Or: []Condition{
+		{Field: "status", Operator: "eq", Value: "open"},
+		{And: []Condition{{Field: "status; DROP TABLE tickets", Operator: "eq", Value: "x"}}},
+	}}}
+
+	_, _, err := (&QueryExecutor{}).buildWhereClause(conditions, "acme", ticketNode())
+	if _, ok := err.(*UnknownFieldError); !ok {
+		t.Errorf("got error %v, want *UnknownFieldError", err)
+	}
+}
+
+func TestBuildPredicateOperators(t *testing.T) {
+	tests := []struct {
+		cond       Condition
+		wantClause string
+		wantParams []interface{}
+	}{
+		{Condition{Field: "status", Operator: "eq", Value: "open"}, `"status" = $1`, []interface{}{"open"}},
+		{Condition{Field: "status", Operator: "=", Value: "open"}, `"status" = $1`, []interface{}{"open"}},
+		{Condition{Field: "status", Operator: "ne", Value: "open"}, `"status" != $1`, []interface{}{"open"}},
+		{Condition{Field: "status", Operator: "neq", Value: "open"}, `"status" != $1`, []interface{}{"open"}},
+		{Condition{Field: "status", Operator: "!=", Value: "open"}, `"status" != $1`, []interface{}{"open"}},
+		{Condition{Field: "priority", Operator: "gt", Value: 1}, `"priority" > $1`, []interface{}{1}},
+		{Condition{Field: "priority", Operator: ">", Value: 1}, `"priority" > $1`, []interface{}{1}},
+		{Condition{Field: "priority", Operator: "gte", Value: 1}, `"priority" >= $1`, []interface{}{1}},
+		{Condition{Field: "priority", Operator: ">=", Value: 1}, `"priority" >= $1`, []interface{}{1}},
+		{Condition{Field: "priority", Operator: "lt", Value: 1}, `"priority" < $1`, []interface{}{1}},
+		{Condition{Field: "priority", Operator: "<", Value: 1}, `"priority" < $1`, []interface{}{1}},
+		{Condition{Field: "priority", Operator: "lte", Value: 1}, `"priority" <= $1`, []interface{}{1}},
+		{Condition{Field: "priority", Operator: "<=", Value: 1}, `"priority" <= $1`, []interface{}{1}},
+		{Condition{Field: "title", Operator: "like", Value: "disk%"}, `"title" LIKE $1`, []interface{}{"disk%"}},
+		{Condition{Field: "title", Operator: "ilike", Value: "disk%"}, `"title" ILIKE $1`, []interface{}{"disk%"}},
+		{Condition{Field: "title", Operator: "contains", Value: "100%_"}, `"title" LIKE $1`, []interface{}{`%100\%\_%`}},
+		{Condition{Field: "title", Operator: "starts_with", Value: `C:\`}, `"title" LIKE $1`, []interface{}{`C:\\%`}},
+		{Condition{Field: "title", Operator: "ends_with", Value: "full"}, `"title" LIKE $1`, []interface{}{"%full"}},
+		{
+			Condition{Field: "status", Operator: "in", Value: []interface{}{"open", "pending"}},
+			`"status" IN ($1, $2)`, []interface{}{"open", "pending"},
+		},
+		{
+			Condition{Field: "status", Operator: "not_in", Value: []interface{}{"closed"}},
+			`"status" NOT IN ($1)`, []interface{}{"closed"},
+		},
+		{Condition{Field: "status", Operator: "in", Value: []interface{}{}}, `FALSE`, nil},
+		{Condition{Field: "status", Operator: "not_in", Value: []interface{}{}}, `TRUE`, nil},
+		{
+			Condition{Field: "priority", Operator: "between", Value: []interface{}{1, 3}},
+			`"priority" BETWEEN $1 AND $2`, []interface{}{1, 3},
+		},
+		{Condition{Field: "assigned_to", Operator: "is_null"}, `"assigned_to" IS NULL`, nil},
+		{Condition{Field: "assigned_to", Operator: "is_not_null"}, `"assigned_to" IS NOT NULL`, nil},
+		{
+			Condition{Field: "metadata", Operator: "contains", Value: map[string]interface{}{"vip": true}},
+			`"metadata" @> $1::jsonb`, []interface{}{`{"vip":true}`},
+		},
+		{Condition{Field: "metadata", Operator: "has_key", Value: "vip"}, `"metadata" ? $1`, []interface{}{"vip"}},
+		{
+			Condition{Field: "metadata", Operator: "has_any_keys", Value: []interface{}{"vip", "sla"}},
+			`"metadata" ?| $1::text[]`, []interface{}{[]string{"vip", "sla"}},
+		},
+		{
+			Condition{Field: "metadata", Operator: "has_all_keys", Value: []interface{}{"vip", "sla"}},
+			`"metadata" ?& $1::text[]`, []interface{}{[]string{"vip", "sla"}},
+		},
+		{
+			Condition{Field: "metadata.plan.tier", Operator: "eq", Value: "gold"},
+			`("metadata" #>> $1::text[]) = $2`, []interface{}{[]string{"plan", "tier"}, "gold"},
+		},
+		{
+			Condition{Field: "metadata.seats", Operator: "gt", Value: float64(10)},
+			`("metadata" #>> $1::text[])::numeric > $2`, []interface{}{[]string{"seats"}, float64(10)},
+		},
+		{
+			Condition{Field: "metadata.vip", Operator: "in", Value: []interface{}{true}},
+			`("metadata" #>> $1::text[])::boolean IN ($2)`, []interface{}{[]string{"vip"}, true},
+		},
+	}
+
+	qe := &QueryExecutor{}
+	for _, tt := range tests {
+		t.Run(tt.cond.Field+" "+tt.cond.Operator, func(t *testing.T) {
+			var params []interface{}
+			clause, err := qe.buildPredicate(tt.cond, ticketNode(), &params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clause != tt.wantClause {
+				t.Errorf("clause = %s\nwant %s", clause, tt.wantClause)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("params = %#v, want %#v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestBuildPredicateRejectsInvalidConditions(t *testing.T) {
+	tests := []struct {
+		name string
+		cond Condition
+	}{
+		{"unknown operator", Condition{Field: "status", Operator: "regex", Value: ".*"}},
+		{"missing operator", Condition{Field: "status", Value: "open"}},
+		{"SQL as operator", Condition{Field: "status", Operator: "= 'x' OR 1=1 --", Value: "open"}},
+		{"in without an array", Condition{Field: "status", Operator: "in", Value: "open"}},
+		{"between with one bound", Condition{Field: "priority", Operator: "between", Value: []interface{}{1}}},
+		{"between without an array", Condition{Field: "priority", Operator: "between", Value: 1}},
+		{"has_key on a text property", Condition{Field: "title", Operator: "has_key", Value: "vip"}},
+		{"has_any_keys without an array", Condition{Field: "metadata", Operator: "has_any_keys", Value: "vip"}},
+	}
+
+	qe := &QueryExecutor{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var params []interface{}
+			if clause, err := qe.buildPredicate(tt.cond, ticketNode(), &params); err == nil {
+				t.Errorf("got clause %s, want an error", clause)
+			}
+		})
+	}
+}
+
+func TestQuoteField(t *testing.T) {
+	locked := ticketNode()
+	locked.DAL = DALConfig{OptimisticLock: true}
+
+	tests := []struct {
+		name  string
+		node  *NodeDefinition
+		field string
+		want  string // "" for an UnknownFieldError
+	}{
+		{"property", ticketNode(), "status", `"status"`},
+		{"system field", ticketNode(), "created_by", `"created_by"`},
+		{"soft delete field", ticketNode(), "deleted_at", `"deleted_at"`},
+		{"soft delete field without soft delete", locked, "deleted_by", ""},
+		{"version with optimistic lock", locked, "version", `"version"`},
+		{"version without optimistic lock", ticketNode(), "version", ""},
+		{"unknown", ticketNode(), "severity", ""},
+		{"different case", ticketNode(), "Status", ""},
+		{"empty", ticketNode(), "", ""},
+		{"injection", ticketNode(), `status" = '' OR 1=1 --`, ""},
+		{"json path", ticketNode(), "metadata.plan", ""},
+	}
+
+	qe := &QueryExecutor{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := qe.quoteField(tt.field, tt.node)
+			if tt.want == "" {
+				if _, ok := err.(*UnknownFieldError); !ok {
+					t.Errorf("got %s with error %v, want *UnknownFieldError", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildPredicateRejectsUnknownFields(t *testing.T) {
+	for _, field := range []string{
+		"severity",
+		"status = 'open' OR 1=1",
+		`"status"`,
+		"metadata->>'plan'",
+		"title.length",
+		"version",
+	} {
+		t.Run(field, func(t *testing.T) {
+			var params []interface{}
+			_, err := (&QueryExecutor{}).buildPredicate(Condition{Field: field, Operator: "eq", Value: "x"}, ticketNode(), &params)
+			if _, ok := err.(*UnknownFieldError); !ok {
+				t.Errorf("got error %v, want *UnknownFieldError", err)
+			}
+			if len(params) != 0 {
+				t.Errorf("bound %v for a rejected field", params)
+			}
+		})
+	}
+}
+
+func TestCreateRejectsSystemFields(t *testing.T) {
+	node := ticketNode()
+	node.DAL = DALConfig{SoftDelete: true, OptimisticLock: true}
+	qe := &QueryExecutor{service: newServiceDefinition("itsm", DSLDefinition{Nodes: []NodeDefinition{*node}})}
+
+	for _, field := range systemFields(node) {
+		t.Run(field, func(t *testing.T) {
+			data := map[string]interface{}{"title": "Disk full", field: "x"}
+			if _, err := qe.create(context.Background(), "acme", "Ticket", data); err == nil {
+				t.Errorf("create accepted %s", field)
+			}
+		})
+	}
+}
+
+// testNATS connects to DAL_TEST_NATS_URL. Tests that need it are skipped
+// when it is not set.
+func testNATS(t *testing.T) *nats.Conn {
+	t.Helper()
+
+	url := os.Getenv("DAL_TEST_NATS_URL")
+	if url == "" {
+		t.Skip("DAL_TEST_NATS_URL is not set")
+	}
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func TestFetchRelationsRequestsOtherServicesOncePerRelation(t *testing.T) {
+	ctx := context.Background()
+	nc := testNATS(t)
+
+	// Unique service names keep concurrent runs on the same server apart
+	suffix := strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+	crm, support := "crm"+suffix, "support"+suffix
+
+	// Stand in for the DAL serving the other services
+	var mu sync.Mutex
+	requests := make(map[string][]QueryRequest)
+	respond := func(subject string, rows []map[string]interface{}) {
+		sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+			var req QueryRequest
+			if err := json.Unmarshal(msg.Data, &req); err != nil {
+				t.Errorf("invalid request on %s: %v", subject, err)
+			}
+			mu.Lock()
+			requests[subject] = append(requests[subject], req)
+			mu.Unlock()
+
+			payload, _ := json.Marshal(map[string]interface{}{
+				"success": true,
+				"data":    map[string]interface{}{"data": rows},
+			})
+			msg.Respond(payload)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sub.Unsubscribe() })
+	}
+	respond("dal."+crm+".Customer.relation", []map[string]interface{}{
+		{"id": "c1", "name": "Acme"},
+		{"id": "c2", "name": "Globex"},
+	})
+	respond("dal."+support+".Comment.relation", []map[string]interface{}{
+		{"id": "m1", "ticket_id": "t1"},
+		{"id": "m2", "ticket_id": "t1"},
+		{"id": "m3", "ticket_id": "t3"},
+	})
+
+	node := ticketNode()
+	node.Properties = append(node.Properties, PropertyDefinition{Name: "customer_id", Type: "string"})
+	node.Relations = []RelationDefinition{
+		{Name: "customer", Type: "belongs_to", TargetService: crm, TargetNode: "Customer", LocalField: "customer_id", TargetField: "id"},
+		{Name: "comments", Type: "has_many", TargetService: support, TargetNode: "Comment", LocalField: "id", TargetField: "ticket_id"},
+	}
+	results := []map[string]interface{}{
+		{"id": "t1", "customer_id": "c1"},
+		{"id": "t2", "customer_id": "c1"},
+		{"id": "t3", "customer_id": "c2"},
+		{"id": "t4", "customer_id": nil},
+	}
+
+	qe := &QueryExecutor{nc: nc, service: newServiceDefinition("itsm", DSLDefinition{Nodes: []NodeDefinition{*node}})}
+	err := qe.fetchRelations(ctx, "acme", node, results, []RelationQuery{
+		{Name: "customer", Select: []string{"name"}},
+		{Name: "comments", Where: []Condition{{Field: "internal", Operator: "eq", Value: false}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantRequests := map[string][]QueryRequest{
+		"dal." + crm + ".Customer.relation": {{TenantID: "acme", Query: Query{
+			Select: []string{"name", "id"},
+			Where:  []Condition{{Field: "id", Operator: "in", Value: []interface{}{"c1", "c2"}}},
+		}}},
+		"dal." + support + ".Comment.relation": {{TenantID: "acme", Query: Query{
+			Where: []Condition{
+				{Field: "internal", Operator: "eq", Value: false},
+				{Field: "ticket_id", Operator: "in", Value: []interface{}{"t1", "t2", "t3", "t4"}},
+			},
+		}}},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("requests:\n%+v\nwant:\n%+v", requests, wantRequests)
+	}
+
+	customer := func(i int) interface{} {
+		if c, ok := results[i]["customer"].(map[string]interface{}); ok {
+			return c["id"]
+		}
+		return results[i]["customer"]
+	}
+	comments := func(i int) []interface{} {
+		ids := []interface{}{}
+		for _, c := range results[i]["comments"].([]map[string]interface{}) {
+			ids = append(ids, c["id"])
+		}
+		return ids
+	}
+	for i, want := range []struct {
+		customer interface{}
+		comments []interface{}
+	}{
+		{"c1", []interface{}{"m1", "m2"}},
+		{"c1", []interface{}{}},
+		{"c2", []interface{}{"m3"}},
+		{nil, []interface{}{}},
+	} {
+		if got := customer(i); got != want.customer {
+			t.Errorf("ticket %d: customer %v, want %v", i, got, want.customer)
+		}
+		if got := comments(i); !reflect.DeepEqual(got, want.comments) {
+			t.Errorf("ticket %d: comments %v, want %v", i, got, want.comments)
+		}
+	}
+}
+
+// recordingTx records the queries run through it
+type recordingTx struct {
+	pgx.Tx
+	queries []string
+}
+
+func (tx *recordingTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	tx.queries = append(tx.queries, sql)
+	return tx.Tx.Query(ctx, sql, args...)
+}
+
+func TestFetchRelationsQueriesOncePerRelation(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	dsl := DSLDefinition{
+		Metadata: ServiceMetadata{Service: "rel-test"},
+		Nodes: []NodeDefinition{
+			{
+				Name:  "Customer",
+				Table: "customers",
+				Properties: []PropertyDefinition{
+					{Name: "id", Type: "uuid", Primary: true},
+					{Name: "name", Type: "string"},
+					{Name: "created_at", Type: "timestamp"},
+					{Name: "updated_at", Type: "timestamp"},
+				},
+			},
+			{
+				Name:  "Ticket",
+				Table: "tickets",
+				Properties: []PropertyDefinition{
+					{Name: "id", Type: "uuid", Primary: true},
+					{Name: "title", Type: "string"},
+					{Name: "customer_id", Type: "uuid"},
+					{Name: "created_at", Type: "timestamp"},
+					{Name: "updated_at", Type: "timestamp"},
+				},
+				Relations: []RelationDefinition{
+					{Name: "customer", Type: "belongs_to", TargetNode: "Customer", LocalField: "customer_id", TargetField: "id"},
+					{Name: "comments", Type: "has_many", TargetNode: "Comment", LocalField: "id", TargetField: "ticket_id"},
+				},
+			},
+			{
+				Name:  "Comment",
+				Table: "comments",
+				Properties: []PropertyDefinition{
+					{Name: "id", Type: "uuid", Primary: true},
+					{Name: "ticket_id", Type: "uuid"},
+					{Name: "body", Type: "string"},
+					{Name: "created_at", Type: "timestamp"},
+					{Name: "updated_at", Type: "timestamp"},
+				},
+			},
+		},
+	}
+	tenantID, router := testTenant(t, db, dsl)
+
+	service := newServiceDefinition("rel-test", dsl)
+	qe := NewQueryExecutor(db, nil, service, router)
+	create := func(entity string, data map[string]interface{}) map[string]interface{} {
+		t.Helper()
+		row, err := qe.Create(ctx, tenantID, entity, data)
+		if err != nil {
+			t.Fatalf("create %s: %v", entity, err)
+		}
+		return row
+	}
+	acme := create("Customer", map[string]interface{}{"name": "Acme"})
+	globex := create("Customer", map[string]interface{}{"name": "Globex"})
+	tickets := []map[string]interface{}{
+		create("Ticket", map[string]interface{}{"title": "one", "customer_id": acme["id"]}),
+		create("Ticket", map[string]interface{}{"title": "two", "customer_id": acme["id"]}),
+		create("Ticket", map[string]interface{}{"title": "three", "customer_id": globex["id"]}),
+	}
+	create("Comment", map[string]interface{}{"ticket_id": tickets[0]["id"], "body": "a"})
+	create("Comment", map[string]interface{}{"ticket_id": tickets[0]["id"], "body": "b"})
+	create("Comment", map[string]interface{}{"ticket_id": tickets[2]["id"], "body": "c"})
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback(ctx)
+	if err := setTenant(ctx, tx, tenantID); err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingTx{Tx: tx}
+
+	qe = &QueryExecutor{db: recorder, service: service, router: router}
+	err = qe.fetchRelations(ctx, tenantID, service.GetNode("Ticket"), tickets,
+		[]RelationQuery{{Name: "customer"}, {Name: "comments"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.queries) != 2 {
+		t.Errorf("ran %d queries, want one per relation:\n%s", len(recorder.queries), strings.Join(recorder.queries, "\n"))
+	}
+	for _, sql := range recorder.queries {
+		if !strings.Contains(sql, " IN (") {
+			t.Errorf("query does not batch its keys: %s", sql)
+		}
+	}
+
+	for i, want := range []struct {
+		customer string
+		comments []string
+	}{
+		{"Acme", []string{"a", "b"}},
+		{"Acme", nil},
+		{"Globex", []string{"c"}},
+	} {
+		if got := tickets[i]["customer"].(map[string]interface{})["name"]; got != want.customer {
+			t.Errorf("ticket %d: customer %v, want %s", i, got, want.customer)
+		}
+		var bodies []string
+		for _, c := range tickets[i]["comments"].([]map[string]interface{}) {
+			bodies = append(bodies, c["body"].(string))
+		}
+		sort.Strings(bodies)
+		if !reflect.DeepEqual(bodies, want.comments) {
+			t.Errorf("ticket %d: comments %v, want %v", i, bodies, want.comments)
+		}
+	}
+}
+
+func TestUpdateReportsVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	dsl := DSLDefinition{
+		Metadata: ServiceMetadata{Service: "lock-test"},
+		Nodes: []NodeDefinition{{
+			Name:  "Ticket",
+			Table: "tickets",
+			Properties: []PropertyDefinition{
+				{Name: "id", Type: "uuid", Primary: true},
+				{Name: "title", Type: "string"},
+				{Name: "created_at", Type: "timestamp"},
+				{Name: "updated_at", Type: "timestamp"},
+			},
+			DAL: DALConfig{OptimisticLock: true},
+		}},
+	}
+	tenantID, router := testTenant(t, db, dsl)
+	qe := NewQueryExecutor(db, nil, newServiceDefinition("lock-test", dsl), router)
+
+	created, err := qe.Create(ctx, tenantID, "Ticket", map[string]interface{}{"title": "draft"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := relationKey(created["id"])
+
+	updated, err := qe.Update(ctx, tenantID, "Ticket", id, 1, map[string]interface{}{"title": "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated["version"] != int32(2) {
+		t.Fatalf("version after update is %v, want 2", updated["version"])
+	}
+
+	// A writer still holding version 1 loses and gets the current row back
+	_, err = qe.Update(ctx, tenantID, "Ticket", id, 1, map[string]interface{}{"title": "stale"})
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatalf("got error %v, want a ConflictError", err)
+	}
+	if conflict.Entity != "Ticket" || conflict.ID != id || conflict.ExpectedVersion != 1 {
+		t.Errorf("conflict on %s %s expecting %d, want Ticket %s expecting 1",
+			conflict.Entity, conflict.ID, conflict.ExpectedVersion, id)
+	}
+	if conflict.Current["version"] != int32(2) || conflict.Current["title"] != "first" {
+		t.Errorf("conflict reports current row %v, want version 2 titled first", conflict.Current)
+	}
+
+	if _, err := qe.Update(ctx, tenantID, "Ticket", uuid.NewString(), 1, map[string]interface{}{"title": "x"}); err == nil || errors.As(err, &conflict) {
+		t.Errorf("updating a missing row: got error %v, want not found", err)
+	}
+}
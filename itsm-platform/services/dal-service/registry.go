@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
 	"sync"
+
+	"github.com/nats-io/nats.go"
 )
 
-// ServiceRegistry manages all registered service DSLs
+// registryChangedSubject is broadcast to every DAL instance when a service
+// DSL has been saved or removed, so that instances holding it in memory
+// reload it
+const registryChangedSubject = "dal.registry.changed"
+
+// ServiceRegistry manages all registered service DSLs. When backed by a
+// RegistryStore, registrations are written through to Postgres and services
+// missing from memory are looked up there. Once watching, it also reloads
+// services saved by other DAL instances.
 type ServiceRegistry struct {
 	mu       sync.RWMutex
 	services map[string]*ServiceDefinition
+	store    *RegistryStore
+	nc       *nats.Conn
 }
 
 type ServiceDefinition struct {
@@ -18,12 +32,38 @@ type ServiceDefinition struct {
 	Nodes map[string]*NodeDefinition
 }
 
-func NewServiceRegistry() *ServiceRegistry {
+// NewServiceRegistry creates a registry. store may be nil for an in-memory
+// only registry.
+func NewServiceRegistry(store *RegistryStore) *ServiceRegistry {
 	return &ServiceRegistry{
 		services: make(map[string]*ServiceDefinition),
+		store:    store,
 	}
 }
 
+// Load replaces the registry's services with those stored in Postgres, so
+// services removed by another instance are dropped too
+func (sr *ServiceRegistry) Load(ctx context.Context) error {
+	if sr.store == nil {
+		return nil
+	}
+
+	services, err := sr.store.LoadAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[string]*ServiceDefinition, len(services))
+	for name, dsl := range services {
+		loaded[name] = newServiceDefinition(name, dsl)
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.services = loaded
+	return nil
+}
+
 // RegisterService registers a new service DSL
 func (sr *ServiceRegistry) RegisterService(name string, dslInterface interface{}) error {
 	sr.mu.Lock()
@@ -47,7 +87,106 @@ func (sr *ServiceRegistry) RegisterService(name string, dslInterface interface{}
 		return fmt.Errorf("unsupported DSL type: %T", dslInterface)
 	}
 
-	// Create service definition
+	// Keep index and graph references in step with renamed properties
+	dsl = applyRenames(dsl)
+
+	// Write through before updating memory so a failed save is not
+	// served by this instance only
+	if sr.store != nil {
+		if err := sr.store.Save(context.Background(), name, dsl); err != nil {
+			return err
+		}
+	}
+
+	sr.services[name] = newServiceDefinition(name, dsl)
+	sr.announce(name)
+	return nil
+}
+
+// UnregisterService removes a service registered by an operation that then
+// failed, such as an import. It does not touch the service's tables.
+func (sr *ServiceRegistry) UnregisterService(name string) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	if sr.store != nil {
+		if err := sr.store.Delete(context.Background(), name); err != nil {
+			return err
+		}
+	}
+
+	delete(sr.services, name)
+	sr.announce(name)
+	return nil
+}
+
+// announce tells the other DAL instances that a service changed. The
+// caller holds sr.mu.
+func (sr *ServiceRegistry) announce(name string) {
+	if sr.nc == nil {
+		return
+	}
+	notice, _ := json.Marshal(map[string]string{"service": name})
+	if err := sr.nc.Publish(registryChangedSubject, notice); err != nil {
+		log.Printf("Failed to announce registry change of %s: %v", name, err)
+	}
+}
+
+// Watch announces this registry's saves and removals on nc and reloads a
+// service from the store, or drops it, whenever any instance announces a
+// change to it. After a reconnect, when notices may have been missed, the
+// whole registry is reloaded.
+func (sr *ServiceRegistry) Watch(nc *nats.Conn) error {
+	if sr.store == nil {
+		return nil
+	}
+
+	_, err := nc.Subscribe(registryChangedSubject, func(msg *nats.Msg) {
+		var notice struct {
+			Service string `json:"service"`
+		}
+		if err := json.Unmarshal(msg.Data, &notice); err != nil || notice.Service == "" {
+			log.Printf("Ignoring invalid registry change notice: %s", msg.Data)
+			return
+		}
+		if err := sr.reload(context.Background(), notice.Service); err != nil {
+			log.Printf("Failed to reload service %s: %v", notice.Service, err)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", registryChangedSubject, err)
+	}
+
+	nc.SetReconnectHandler(func(*nats.Conn) {
+		if err := sr.Load(context.Background()); err != nil {
+			log.Printf("Failed to reload service registry: %v", err)
+		}
+	})
+
+	sr.mu.Lock()
+	sr.nc = nc
+	sr.mu.Unlock()
+	return nil
+}
+
+// reload replaces a service with its stored definition
+func (sr *ServiceRegistry) reload(ctx context.Context, name string) error {
+	dsl, err := sr.store.Load(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if dsl == nil {
+		delete(sr.services, name)
+		return nil
+	}
+	sr.services[name] = newServiceDefinition(name, *dsl)
+	return nil
+}
+
+func newServiceDefinition(name string, dsl DSLDefinition) *ServiceDefinition {
 	serviceDef := &ServiceDefinition{
 		Name:  name,
 		DSL:   dsl,
@@ -60,23 +199,39 @@ func (sr *ServiceRegistry) RegisterService(name string, dslInterface interface{}
 		serviceDef.Nodes[node.Name] = node
 	}
 
-	sr.services[name] = serviceDef
-	return nil
+	return serviceDef
 }
 
-// GetService returns a service definition
+// GetService returns a service definition. A service registered through
+// another DAL instance is loaded from the store on first use.
 func (sr *ServiceRegistry) GetService(name string) *ServiceDefinition {
 	sr.mu.RLock()
-	defer sr.mu.RUnlock()
-	return sr.services[name]
+	serviceDef := sr.services[name]
+	sr.mu.RUnlock()
+
+	if serviceDef != nil || sr.store == nil {
+		return serviceDef
+	}
+
+	dsl, err := sr.store.Load(context.Background(), name)
+	if err != nil || dsl == nil {
+		return nil
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if existing, ok := sr.services[name]; ok {
+		return existing
+	}
+	serviceDef = newServiceDefinition(name, *dsl)
+	sr.services[name] = serviceDef
+	return serviceDef
 }
 
-// GetServiceDSL returns the DSL for a service
+// GetServiceDSL returns the DSL for a service, loading it from the store
+// like GetService
 func (sr *ServiceRegistry) GetServiceDSL(name string) DSLDefinition {
-	sr.mu.RLock()
-	defer sr.mu.RUnlock()
-
-	if service, ok := sr.services[name]; ok {
+	if service := sr.GetService(name); service != nil {
 		return service.DSL
 	}
 	return DSLDefinition{}
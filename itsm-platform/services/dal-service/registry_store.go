@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// RegistryStore persists registered service DSLs in
+// dal_system.service_registry, keeping every distinct DSL version in
+// dal_system.service_registry_history
+type RegistryStore struct {
+	db *pgxpool.Pool
+}
+
+func NewRegistryStore(db *pgxpool.Pool) *RegistryStore {
+	return &RegistryStore{db: db}
+}
+
+// Save stores dsl as the current definition of a service. A history row is
+// only added when the definition actually changed.
+func (rs *RegistryStore) Save(ctx context.Context, serviceName string, dsl DSLDefinition) error {
+	dslJSON, err := json.Marshal(dsl)
+	if err != nil {
+		return fmt.Errorf("failed to marshal DSL: %w", err)
+	}
+
+	tx, err := rs.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO dal_system.service_registry (service_name, dsl_definition, version)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (service_name) DO UPDATE
+		SET dsl_definition = EXCLUDED.dsl_definition,
+		    version = EXCLUDED.version,
+		    updated_at = NOW()
+		WHERE service_registry.dsl_definition IS DISTINCT FROM EXCLUDED.dsl_definition
+		   OR service_registry.version IS DISTINCT FROM EXCLUDED.version`,
+		serviceName, dslJSON, dsl.Metadata.Version)
+	if err != nil {
+		return fmt.Errorf("failed to save service %s: %w", serviceName, err)
+	}
+
+	if tag.RowsAffected() > 0 {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO dal_system.service_registry_history (service_name, dsl_definition, version)
+			VALUES ($1, $2, $3)`,
+			serviceName, dslJSON, dsl.Metadata.Version); err != nil {
+			return fmt.Errorf("failed to record history for service %s: %w", serviceName, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Delete removes a service and its history, for a registration that is
+// being undone
+func (rs *RegistryStore) Delete(ctx context.Context, serviceName string) error {
+	tx, err := rs.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, query := range []string{
+		`DELETE FROM dal_system.service_registry_history WHERE service_name = $1`,
+		`DELETE FROM dal_system.service_registry WHERE service_name = $1`,
+	} {
+		if _, err := tx.Exec(ctx, query, serviceName); err != nil {
+			return fmt.Errorf("failed to delete service %s: %w", serviceName, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// Load returns the current DSL of a service, or nil if it was never stored
+func (rs *RegistryStore) Load(ctx context.Context, serviceName string) (*DSLDefinition, error) {
+	var dslJSON []byte
+	err := rs.db.QueryRow(ctx, `
+		SELECT dsl_definition FROM dal_system.service_registry
+		WHERE service_name = $1`, serviceName).Scan(&dslJSON)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service %s: %w", serviceName, err)
+	}
+
+	var dsl DSLDefinition
+	if err := json.Unmarshal(dslJSON, &dsl); err != nil {
+		return nil, fmt.Errorf("invalid stored DSL for service %s: %w", serviceName, err)
+	}
+	return &dsl, nil
+}
+
+// LoadAll returns the current DSL of every stored service
+func (rs *RegistryStore) LoadAll(ctx context.Context) (map[string]DSLDefinition, error) {
+	rows, err := rs.db.Query(ctx, `SELECT service_name, dsl_definition FROM dal_system.service_registry`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service registry: %w", err)
+	}
+	defer rows.Close()
+
+	services := make(map[string]DSLDefinition)
+	for rows.Next() {
+		var name string
+		var dslJSON []byte
+		if err := rows.Scan(&name, &dslJSON); err != nil {
+			return nil, err
+		}
+
+		var dsl DSLDefinition
+		if err := json.Unmarshal(dslJSON, &dsl); err != nil {
+			return nil, fmt.Errorf("invalid stored DSL for service %s: %w", name, err)
+		}
+		services[name] = dsl
+	}
+
+	return services, rows.Err()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testService returns a uniquely named service with a single node, removed
+// from the store when the test ends
+func testService(t *testing.T, store *RegistryStore) (string, DSLDefinition) {
+	t.Helper()
+
+	name := "reg-" + strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+	t.Cleanup(func() {
+		if err := store.Delete(context.Background(), name); err != nil {
+			t.Errorf("failed to delete service %s: %v", name, err)
+		}
+	})
+	return name, DSLDefinition{
+		Metadata: ServiceMetadata{Service: name},
+		Nodes: []NodeDefinition{{
+			Name:       "Ticket",
+			Table:      "tickets",
+			Properties: []PropertyDefinition{{Name: "id", Type: "uuid", Primary: true}},
+		}},
+	}
+}
+
+func TestRegistrySharesServicesThroughTheStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewRegistryStore(testDB(t))
+	name, dsl := testService(t, store)
+
+	writer := NewServiceRegistry(store)
+	reader := NewServiceRegistry(store)
+	if err := reader.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.RegisterService(name, dsl); err != nil {
+		t.Fatal(err)
+	}
+	if got := reader.GetServiceDSL(name); got.Metadata.Service != name || len(got.Nodes) != 1 {
+		t.Errorf("reader got DSL %+v, want the registered one", got)
+	}
+
+	if err := writer.UnregisterService(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if containsString(reader.ListServices(), name) {
+		t.Errorf("reader still lists %s after it was removed and reloaded", name)
+	}
+}
+
+func TestWatchDropsServicesRemovedElsewhere(t *testing.T) {
+	store := NewRegistryStore(testDB(t))
+	nc := testNATS(t)
+	name, dsl := testService(t, store)
+
+	writer := NewServiceRegistry(store)
+	reader := NewServiceRegistry(store)
+	for _, registry := range []*ServiceRegistry{writer, reader} {
+		if err := registry.Watch(nc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.RegisterService(name, dsl); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return containsString(reader.ListServices(), name) })
+
+	if err := writer.UnregisterService(name); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !containsString(reader.ListServices(), name) })
+}
+
+// waitFor polls done until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the change to propagate")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import "fmt"
+
+// applyRenames rewrites the references to renamed properties of each node
+// (index fields, graph sync_properties and graph edge via fields) to the new
+// property names. The input DSL is not modified.
+func applyRenames(dsl DSLDefinition) DSLDefinition {
+	nodes := make([]NodeDefinition, len(dsl.Nodes))
+	for i, node := range dsl.Nodes {
+		renames := make(map[string]string)
+		for _, prop := range node.Properties {
+			if prop.RenamedFrom != "" {
+				renames[prop.RenamedFrom] = prop.Name
+			}
+		}
+		if len(renames) > 0 {
+			node = renameReferences(node, renames)
+		}
+		nodes[i] = node
+	}
+
+	dsl.Nodes = nodes
+	return dsl
+}
+
+// renameReferences returns a copy of node whose indexes and graph config
+// use the renamed property names
+func renameReferences(node NodeDefinition, renames map[string]string) NodeDefinition {
+	rename := func(name string) string {
+		if newName, ok := renames[name]; ok {
+			return newName
+		}
+		return name
+	}
+
+	indexes := make([]IndexDefinition, len(node.Indexes))
+	for i, idx := range node.Indexes {
+		fields := make([]string, len(idx.Fields))
+		for j, field := range idx.Fields {
+			fields[j] = rename(field)
+		}
+		idx.Fields = fields
+		indexes[i] = idx
+	}
+	node.Indexes = indexes
+
+	syncProperties := make([]string, len(node.Graph.SyncProperties))
+	for i, prop := range node.Graph.SyncProperties {
+		syncProperties[i] = rename(prop)
+	}
+	node.Graph.SyncProperties = syncProperties
+
+	edges := make([]GraphEdgeDefinition, len(node.Graph.Edges))
+	for i, edge := range node.Graph.Edges {
+		edge.Via = rename(edge.Via)
+		edges[i] = edge
+	}
+	node.Graph.Edges = edges
+
+	return node
+}
+
+// renamedNode returns old as it looks after its table and columns are
+// renamed, so its physical indexes can be compared with the new node's
+func renamedNode(old NodeDefinition, table string, renames map[string]string) NodeDefinition {
+	node := renameReferences(old, renames)
+	node.Table = table
+
+	properties := make([]PropertyDefinition, len(old.Properties))
+	for i, prop := range old.Properties {
+		if newName, ok := renames[prop.Name]; ok {
+			prop.Name = newName
+		}
+		properties[i] = prop
+	}
+	node.Properties = properties
+
+	return node
+}
+
+// compareRenamedObjects renames the indexes and CHECK constraints whose
+// physical names derive from a renamed table or column
+func (m *Migrator) compareRenamedObjects(old, renamed NodeDefinition) []Migration {
+	var migrations []Migration
+
+	oldIndexes := nodeIndexes(old)
+	for i, idx := range nodeIndexes(renamed) {
+		if oldIndexes[i].Name != idx.Name {
+			migrations = append(migrations, Migration{
+				Type:      "RENAME_INDEX",
+				Table:     renamed.Table,
+				IndexName: oldIndexes[i].Name,
+				NewName:   idx.Name,
+			})
+		}
+	}
+
+	// Indexes every table gets from createIndexesSQL
+	if old.Table != renamed.Table {
+		for _, pattern := range []string{"idx_%s_tenant_id", "idx_%s_not_deleted"} {
+			migrations = append(migrations, Migration{
+				Type:      "RENAME_INDEX",
+				Table:     renamed.Table,
+				IndexName: fmt.Sprintf(pattern, old.Table),
+				NewName:   fmt.Sprintf(pattern, renamed.Table),
+			})
+		}
+	}
+
+	for i, prop := range renamed.Properties {
+		if checkExpression(prop) == "" {
+			continue
+		}
+		oldName := checkConstraintName(old.Table, old.Properties[i].Name)
+		newName := checkConstraintName(renamed.Table, prop.Name)
+		if oldName != newName {
+			migrations = append(migrations, Migration{
+				Type:       "RENAME_CONSTRAINT",
+				Table:      renamed.Table,
+				Constraint: oldName,
+				NewName:    newName,
+			})
+		}
+	}
+
+	return migrations
+}
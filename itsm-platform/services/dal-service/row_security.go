@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// tenantPolicy is the row-level security policy on every entity table. It
+// only admits rows of the tenant set in app.tenant_id, so a query that
+// reaches the wrong schema or misses its tenant_id filter still returns
+// nothing. current_setting is called with missing_ok so a connection that
+// never set the tenant sees no rows instead of failing.
+const tenantPolicy = "tenant_isolation"
+
+const tenantPolicyCondition = "tenant_id = current_setting('app.tenant_id', true)"
+
+// rowLevelSecuritySQL enables and forces row-level security on a table and
+// (re)creates its tenant policy. The DAL connects as the owner of its
+// tables (dal_app in scripts/roles.sql), which FORCE subjects to the
+// policy. Superusers and BYPASSRLS roles are never subject to it, so
+// checkRoles refuses them.
+func rowLevelSecuritySQL(schema, table string) []string {
+	tableName := qualifiedTable(schema, table)
+	return []string{
+		fmt.Sprintf("ALTER TABLE %s ENABLE ROW LEVEL SECURITY", tableName),
+		fmt.Sprintf("ALTER TABLE %s FORCE ROW LEVEL SECURITY", tableName),
+		fmt.Sprintf("DROP POLICY IF EXISTS %s ON %s", tenantPolicy, tableName),
+		fmt.Sprintf("CREATE POLICY %s ON %s USING (%s) WITH CHECK (%s)",
+			tenantPolicy, tableName, tenantPolicyCondition, tenantPolicyCondition),
+	}
+}
+
+// checkRoles makes sure the policies hold for the DAL: db must be subject
+// to them, while admin, used for cross-tenant jobs, must bypass them
+func checkRoles(ctx context.Context, db, admin *pgxpool.Pool) error {
+	const query = `SELECT current_user, rolsuper OR rolbypassrls FROM pg_roles WHERE rolname = current_user`
+
+	var role string
+	var bypass bool
+	if err := db.QueryRow(ctx, query).Scan(&role, &bypass); err != nil {
+		return fmt.Errorf("failed to check database role: %w", err)
+	}
+	if bypass {
+		return fmt.Errorf("database role %s bypasses row-level security; connect as a role without SUPERUSER or BYPASSRLS", role)
+	}
+
+	if err := admin.QueryRow(ctx, query).Scan(&role, &bypass); err != nil {
+		return fmt.Errorf("failed to check admin database role: %w", err)
+	}
+	if !bypass {
+		return fmt.Errorf("admin database role %s needs BYPASSRLS", role)
+	}
+	return nil
+}
+
+// setTenant applies tenantID to app.tenant_id for the rest of tx
+func setTenant(ctx context.Context, tx pgx.Tx, tenantID string) error {
+	if _, err := tx.Exec(ctx, "SELECT set_config('app.tenant_id', $1, true)", tenantID); err != nil {
+		return fmt.Errorf("failed to set tenant: %w", err)
+	}
+	return nil
+}
+
+// forTenant runs fn in a transaction where app.tenant_id is tenantID. If
+// the executor is already in a transaction, fn runs in it after the tenant
+// has been applied.
+func (qe *QueryExecutor) forTenant(ctx context.Context, tenantID string, fn func(qe *QueryExecutor) error) error {
+	if tx, ok := qe.db.(pgx.Tx); ok {
+		if err := setTenant(ctx, tx, tenantID); err != nil {
+			return err
+		}
+		return fn(qe)
+	}
+
+	tx, err := qe.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setTenant(ctx, tx, tenantID); err != nil {
+		return err
+	}
+	if err := fn(qe.withTx(tx)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
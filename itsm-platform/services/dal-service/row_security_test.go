@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testDB connects to DAL_TEST_DATABASE_URL, a database set up by
+// scripts/init.sql and scripts/roles.sql and reached as the role the DAL
+// connects as (dal_app). Tests that need it are skipped when it is not set.
+func testDB(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+
+	url := os.Getenv("DAL_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("DAL_TEST_DATABASE_URL is not set")
+	}
+	db, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// testTenant creates a schema tenant with the tables of dsl, discarded when
+// the test ends
+func testTenant(t *testing.T, db *pgxpool.Pool, dsl DSLDefinition) (string, *TenantRouter) {
+	t.Helper()
+	ctx := context.Background()
+
+	tenantID := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+	router := NewTenantRouter(db)
+	schemas := NewSchemaManager(db, router)
+	tenants := NewTenantManager(db, schemas)
+	if _, err := tenants.Create(ctx, tenantID, "", nil, TenancySchema); err != nil {
+		t.Fatalf("failed to create tenant: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := tenants.Discard(ctx, tenantID); err != nil {
+			t.Errorf("failed to discard tenant %s: %v", tenantID, err)
+		}
+	})
+
+	if err := schemas.CreateServiceSchema(ctx, tenantID, dsl.Metadata.Service, dsl); err != nil {
+		t.Fatalf("failed to create tables: %v", err)
+	}
+	return tenantID, router
+}
+
+func TestRowSecurityHidesOtherTenantsRows(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	var superuser, bypass bool
+	if err := db.QueryRow(ctx, `SELECT rolsuper, rolbypassrls FROM pg_roles WHERE rolname = current_user`).
+		Scan(&superuser, &bypass); err != nil {
+		t.Fatalf("failed to check role: %v", err)
+	}
+	if superuser || bypass {
+		t.Fatalf("test role bypasses row-level security (superuser %v, bypassrls %v); connect as dal_app", superuser, bypass)
+	}
+
+	suffix := strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+	tenantA, tenantB := "rls_a_"+suffix, "rls_b_"+suffix
+	table := "rls_notes_" + suffix
+
+	router := NewTenantRouter(db)
+	schemas := NewSchemaManager(db, router)
+	tenants := NewTenantManager(db, schemas)
+
+	// Shared tenants keep their rows in the same table, so only the
+	// tenant_id filter and the policy stand between them
+	for _, tenantID := range []string{tenantA, tenantB} {
+		if _, err := tenants.Create(ctx, tenantID, "", nil, TenancyShared); err != nil {
+			t.Fatalf("failed to create tenant %s: %v", tenantID, err)
+		}
+		tenantID := tenantID
+		t.Cleanup(func() {
+			if _, err := tenants.MarkDeleted(ctx, tenantID, 0); err != nil {
+				t.Errorf("failed to delete tenant %s: %v", tenantID, err)
+				return
+			}
+			if err := tenants.purge(ctx, tenantID); err != nil {
+				t.Errorf("failed to purge tenant %s: %v", tenantID, err)
+			}
+		})
+	}
+
+	dsl := DSLDefinition{
+		Metadata: ServiceMetadata{Service: "rls-test"},
+		Nodes: []NodeDefinition{{
+			Name:  "Note",
+			Table: table,
+			Properties: []PropertyDefinition{
+				{Name: "id", Type: "uuid", Primary: true},
+				{Name: "title", Type: "string"},
+				{Name: "created_at", Type: "timestamp"},
+				{Name: "updated_at", Type: "timestamp"},
+			},
+		}},
+	}
+	if err := schemas.CreateServiceSchema(ctx, sharedTarget, "rls-test", dsl); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	tableName := qualifiedTable(sharedSchema, table)
+	t.Cleanup(func() {
+		if _, err := db.Exec(ctx, "DROP TABLE IF EXISTS "+tableName); err != nil {
+			t.Errorf("failed to drop %s: %v", table, err)
+		}
+	})
+
+	qe := NewQueryExecutor(db, nil, newServiceDefinition("rls-test", dsl), router)
+	created, err := qe.Create(ctx, tenantA, "Note", map[string]interface{}{"title": "only for A"})
+	if err != nil {
+		t.Fatalf("create as %s: %v", tenantA, err)
+	}
+	id := relationKey(created["id"])
+
+	// Through the executor
+	if _, err := qe.GetByID(ctx, tenantB, "Note", id); !errors.Is(err, pgx.ErrNoRows) {
+		t.Errorf("get as %s: got error %v, want pgx.ErrNoRows", tenantB, err)
+	}
+	result, err := qe.Execute(ctx, tenantB, "Note", Query{})
+	if err != nil {
+		t.Fatalf("query as %s: %v", tenantB, err)
+	}
+	if len(result.Data) != 0 {
+		t.Errorf("query as %s returned %d rows of %s", tenantB, len(result.Data), tenantA)
+	}
+	history, err := qe.History(ctx, tenantB, "Note", id)
+	if err != nil {
+		t.Fatalf("history as %s: %v", tenantB, err)
+	}
+	if len(history) != 0 {
+		t.Errorf("history as %s returned %d audit entries of %s", tenantB, len(history), tenantA)
+	}
+
+	// Without the tenant_id filter, only the policy is left
+	asTenant := func(tenantID string, fn func(tx pgx.Tx)) {
+		t.Helper()
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			t.Fatalf("failed to begin: %v", err)
+		}
+		defer tx.Rollback(ctx)
+		if err := setTenant(ctx, tx, tenantID); err != nil {
+			t.Fatal(err)
+		}
+		fn(tx)
+	}
+	count := func(tx pgx.Tx) int {
+		t.Helper()
+		var n int
+		if err := tx.QueryRow(ctx, "SELECT count(*) FROM "+tableName).Scan(&n); err != nil {
+			t.Fatalf("count failed: %v", err)
+		}
+		return n
+	}
+
+	for _, tc := range []struct {
+		tenantID string
+		want     int
+	}{
+		{tenantA, 1},
+		{tenantB, 0},
+		{"*", 0},
+		{"", 0},
+	} {
+		asTenant(tc.tenantID, func(tx pgx.Tx) {
+			if got := count(tx); got != tc.want {
+				t.Errorf("with app.tenant_id %q: counted %d rows, want %d", tc.tenantID, got, tc.want)
+			}
+		})
+	}
+
+	asTenant(tenantB, func(tx pgx.Tx) {
+		tag, err := tx.Exec(ctx, "UPDATE "+tableName+" SET title = 'changed by B'")
+		if err != nil {
+			t.Fatalf("update as %s: %v", tenantB, err)
+		}
+		if tag.RowsAffected() != 0 {
+			t.Errorf("update as %s changed %d rows of %s", tenantB, tag.RowsAffected(), tenantA)
+		}
+	})
+
+	asTenant(tenantB, func(tx pgx.Tx) {
+		_, err := tx.Exec(ctx, "INSERT INTO "+tableName+" (id, tenant_id, title) VALUES ($1, $2, 'planted by B')",
+			uuid.NewString(), tenantA)
+		if err == nil {
+			t.Errorf("insert as %s of a row for %s succeeded", tenantB, tenantA)
+		}
+	})
+}
+
+func TestRowLevelSecuritySQLHasNoBypass(t *testing.T) {
+	got := rowLevelSecuritySQL("tenant_acme", "tickets")
+	want := []string{
+		`ALTER TABLE "tenant_acme"."tickets" ENABLE ROW LEVEL SECURITY`,
+		`ALTER TABLE "tenant_acme"."tickets" FORCE ROW LEVEL SECURITY`,
+		`DROP POLICY IF EXISTS tenant_isolation ON "tenant_acme"."tickets"`,
+		`CREATE POLICY tenant_isolation ON "tenant_acme"."tickets"` +
+			` USING (tenant_id = current_setting('app.tenant_id', true))` +
+			` WITH CHECK (tenant_id = current_setting('app.tenant_id', true))`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("statements:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The policy admits exactly one tenant: no alternative branch, wildcard
+	// or role exemption may widen it
+	for _, sql := range got {
+		upper := strings.ToUpper(sql)
+		for _, bypass := range []string{" OR ", "'*'", "CURRENT_USER", "SESSION_USER", "PG_HAS_ROLE"} {
+			if strings.Contains(upper, strings.ToUpper(bypass)) {
+				t.Errorf("%s contains %q", sql, bypass)
+			}
+		}
+	}
+}
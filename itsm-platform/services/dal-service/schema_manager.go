@@ -5,32 +5,39 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type SchemaManager struct {
-	db *pgxpool.Pool
+	db     *pgxpool.Pool
+	router *TenantRouter
 }
 
-func NewSchemaManager(db *pgxpool.Pool) *SchemaManager {
-	return &SchemaManager{db: db}
+func NewSchemaManager(db *pgxpool.Pool, router *TenantRouter) *SchemaManager {
+	return &SchemaManager{db: db, router: router}
 }
 
-// CreateTenantSchema creates a new schema for a tenant
+// CreateTenantSchema creates the schema for a tenant, or for a shared
+// tenant makes sure the shared schema exists
 func (sm *SchemaManager) CreateTenantSchema(ctx context.Context, tenantID string) error {
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
+	schemaName, err := sm.router.Schema(ctx, tenantID)
+	if err != nil {
+		return err
+	}
 
 	// Create schema if not exists
-	query := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", schemaName)
-	_, err := sm.db.Exec(ctx, query)
+	query := fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", quoteIdent(schemaName))
+	_, err = sm.db.Exec(ctx, query)
 	if err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
 
 	// Create audit table for tenant
 	auditTable := fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS %s.audit_log (
+		CREATE TABLE IF NOT EXISTS %s (
 			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			tenant_id VARCHAR(100) NOT NULL,
 			entity_type VARCHAR(100),
 			entity_id UUID,
 			action VARCHAR(50),
@@ -38,15 +45,27 @@ func (sm *SchemaManager) CreateTenantSchema(ctx context.Context, tenantID string
 			user_id UUID,
 			timestamp TIMESTAMPTZ DEFAULT NOW(),
 			metadata JSONB
-		)`, schemaName)
+		)`, qualifiedTable(schemaName, auditLogTable))
 
-	_, err = sm.db.Exec(ctx, auditTable)
-	return err
+	// Serves the history of a record
+	auditIndex := fmt.Sprintf("CREATE INDEX IF NOT EXISTS audit_log_entity_idx ON %s (entity_id, timestamp)",
+		qualifiedTable(schemaName, auditLogTable))
+
+	for _, query := range append([]string{auditTable, auditIndex}, rowLevelSecuritySQL(schemaName, auditLogTable)...) {
+		if _, err := sm.db.Exec(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// CreateServiceSchema creates tables for a service in tenant schema
+// CreateServiceSchema creates tables for a service where a tenant's tables
+// live; tenantID may be sharedTarget
 func (sm *SchemaManager) CreateServiceSchema(ctx context.Context, tenantID, service string, dsl DSLDefinition) error {
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
+	schemaName, err := sm.router.Schema(ctx, tenantID)
+	if err != nil {
+		return err
+	}
 
 	for _, node := range dsl.Nodes {
 		if err := sm.createTable(ctx, schemaName, node); err != nil {
@@ -62,6 +81,17 @@ func (sm *SchemaManager) CreateServiceSchema(ctx context.Context, tenantID, serv
 }
 
 func (sm *SchemaManager) createTable(ctx context.Context, schema string, node NodeDefinition) error {
+	queries := append([]string{sm.createTableSQL(schema, node)}, rowLevelSecuritySQL(schema, node.Table)...)
+	for _, query := range queries {
+		if _, err := sm.db.Exec(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTableSQL builds the CREATE TABLE statement for a node
+func (sm *SchemaManager) createTableSQL(schema string, node NodeDefinition) string {
 	var columns []string
 	existingCols := make(map[string]bool)
 
@@ -74,13 +104,14 @@ func (sm *SchemaManager) createTable(ctx context.Context, schema string, node No
 
 	// Add system columns if not already defined in DSL
 	systemCols := map[string]string{
+		"tenant_id":  "VARCHAR(100) NOT NULL",
 		"created_by": "UUID",
 		"updated_by": "UUID",
 	}
 
 	for colName, colDef := range systemCols {
 		if !existingCols[colName] {
-			columns = append(columns, fmt.Sprintf("%s %s", colName, colDef))
+			columns = append(columns, fmt.Sprintf("%s %s", quoteIdent(colName), colDef))
 		}
 	}
 
@@ -102,60 +133,20 @@ func (sm *SchemaManager) createTable(ctx context.Context, schema string, node No
 	}
 
 	// Build CREATE TABLE statement
-	tableName := fmt.Sprintf("%s.%s", schema, node.Table)
-	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n%s\n)",
+	tableName := qualifiedTable(schema, node.Table)
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n%s\n)",
 		tableName, strings.Join(columns, ",\n"))
-
-	_, err := sm.db.Exec(ctx, query)
-	return err
 }
 
 func (sm *SchemaManager) buildColumnDefinition(prop PropertyDefinition) string {
 	var col strings.Builder
-	col.WriteString(prop.Name)
+	col.WriteString(quoteIdent(prop.Name))
 	col.WriteString(" ")
 
 	// Map DSL type to PostgreSQL type
-	switch prop.Type {
-	case "string":
-		if prop.MaxLength > 0 {
-			col.WriteString(fmt.Sprintf("VARCHAR(%d)", prop.MaxLength))
-		} else {
-			col.WriteString("TEXT")
-		}
-	case "int", "integer":
-		col.WriteString("INTEGER")
-	case "bigint":
-		col.WriteString("BIGINT")
-	case "decimal":
-		col.WriteString(fmt.Sprintf("DECIMAL(%d,%d)", prop.Precision, prop.Scale))
-	case "boolean", "bool":
-		col.WriteString("BOOLEAN")
-	case "uuid":
-		col.WriteString("UUID")
-	case "date":
-		col.WriteString("DATE")
-	case "datetime", "timestamp":
-		col.WriteString("TIMESTAMPTZ")
-	case "json", "jsonb":
-		col.WriteString("JSONB")
-	case "enum":
-		// For enums, use VARCHAR with CHECK constraint
-		col.WriteString("VARCHAR(50)")
-		if len(prop.Values) > 0 {
-			values := make([]string, len(prop.Values))
-			for i, v := range prop.Values {
-				values[i] = fmt.Sprintf("'%s'", v)
-			}
-			col.WriteString(fmt.Sprintf(" CHECK (%s IN (%s))",
-				prop.Name, strings.Join(values, ", ")))
-		}
-	case "text":
-		col.WriteString("TEXT")
-	case "array":
-		col.WriteString("JSONB") // Store arrays as JSONB
-	default:
-		col.WriteString("TEXT")
+	col.WriteString(columnType(prop))
+	if check := checkExpression(prop); check != "" {
+		col.WriteString(fmt.Sprintf(" CHECK (%s)", check))
 	}
 
 	// Add constraints
@@ -168,20 +159,8 @@ func (sm *SchemaManager) buildColumnDefinition(prop PropertyDefinition) string {
 		col.WriteString(" NOT NULL")
 	}
 
-	if prop.Default != nil {
-		// Handle different default value types
-		switch v := prop.Default.(type) {
-		case string:
-			if v == "now()" {
-				col.WriteString(" DEFAULT NOW()")
-			} else if v != "" {
-				col.WriteString(fmt.Sprintf(" DEFAULT '%s'", v))
-			}
-		case bool:
-			col.WriteString(fmt.Sprintf(" DEFAULT %t", v))
-		case int, int64, float64:
-			col.WriteString(fmt.Sprintf(" DEFAULT %v", v))
-		}
+	if def := defaultExpression(prop); def != "" {
+		col.WriteString(" DEFAULT " + def)
 	}
 
 	if prop.UniquePerTenant {
@@ -191,98 +170,184 @@ func (sm *SchemaManager) buildColumnDefinition(prop PropertyDefinition) string {
 	return col.String()
 }
 
-func (sm *SchemaManager) createIndexes(ctx context.Context, schema string, node NodeDefinition) error {
-	tableName := fmt.Sprintf("%s.%s", schema, node.Table)
+// defaultExpression renders a property's DSL default as SQL, or "" if it
+// has none
+func defaultExpression(prop PropertyDefinition) string {
+	switch v := prop.Default.(type) {
+	case string:
+		if v == "now()" {
+			return "NOW()"
+		} else if v != "" {
+			return quoteLiteral(v)
+		}
+	case bool:
+		return fmt.Sprintf("%t", v)
+	case int, int64, float64:
+		return fmt.Sprintf("%v", v)
+	}
+	return ""
+}
 
-	// Create index on tenant_id (always)
-	tenantIdx := fmt.Sprintf("CREATE INDEX IF NOT EXISTS idx_%s_tenant_id ON %s(tenant_id)",
-		node.Table, tableName)
-	if _, err := sm.db.Exec(ctx, tenantIdx); err != nil {
-		return err
+// checkExpression renders the CHECK condition of an enum property, or ""
+// if it has none. Postgres names the inline constraint
+// checkConstraintName(table, column).
+func checkExpression(prop PropertyDefinition) string {
+	if prop.Type != "enum" || len(prop.Values) == 0 {
+		return ""
 	}
 
-	// Create indexes for properties marked as indexed
-	for _, prop := range node.Properties {
-		if prop.Indexed {
-			idxName := fmt.Sprintf("idx_%s_%s", node.Table, prop.Name)
-			query := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(%s)",
-				idxName, tableName, prop.Name)
-			if _, err := sm.db.Exec(ctx, query); err != nil {
-				return err
-			}
-		}
+	values := make([]string, len(prop.Values))
+	for i, v := range prop.Values {
+		values[i] = quoteLiteral(v)
+	}
+	return fmt.Sprintf("%s IN (%s)", quoteIdent(prop.Name), strings.Join(values, ", "))
+}
 
-		// Create unique index for unique_per_tenant fields
-		if prop.UniquePerTenant {
-			idxName := fmt.Sprintf("uniq_%s_%s_tenant", node.Table, prop.Name)
-			query := fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s(tenant_id, %s)",
-				idxName, tableName, prop.Name)
-			if _, err := sm.db.Exec(ctx, query); err != nil {
-				return err
-			}
-		}
+// checkConstraintName matches the name Postgres gives an inline column
+// CHECK constraint
+func checkConstraintName(table, column string) string {
+	name := fmt.Sprintf("%s_%s_check", table, column)
+	if len(name) > maxIdentifierLength {
+		name = name[:maxIdentifierLength]
 	}
+	return name
+}
 
-	// Create custom indexes
-	for _, idx := range node.Indexes {
-		idxName := fmt.Sprintf("%s_%s", node.Table, idx.Name)
-		fields := strings.Join(idx.Fields, ", ")
-		unique := ""
-		if idx.Unique {
-			unique = "UNIQUE "
-		}
-		query := fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s(%s)",
-			unique, idxName, tableName, fields)
+func quoteLiteral(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+func (sm *SchemaManager) createIndexes(ctx context.Context, schema string, node NodeDefinition) error {
+	for _, query := range sm.createIndexesSQL(schema, node) {
 		if _, err := sm.db.Exec(ctx, query); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// createIndexesSQL builds the CREATE INDEX statements for a node
+func (sm *SchemaManager) createIndexesSQL(schema string, node NodeDefinition) []string {
+	tableName := qualifiedTable(schema, node.Table)
+
+	// Create index on tenant_id (always)
+	queries := []string{
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(tenant_id)",
+			quoteIdent(fmt.Sprintf("idx_%s_tenant_id", node.Table)), tableName),
+	}
+
+	// Create property and custom indexes
+	for _, idx := range nodeIndexes(node) {
+		queries = append(queries, createIndexSQL(schema, node.Table, idx))
+	}
 
 	// Create soft delete partial index
 	if node.DAL.SoftDelete {
 		idxName := fmt.Sprintf("idx_%s_not_deleted", node.Table)
-		query := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(tenant_id) WHERE deleted_at IS NULL",
-			idxName, tableName)
-		if _, err := sm.db.Exec(ctx, query); err != nil {
-			return err
-		}
+		queries = append(queries, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(tenant_id) WHERE deleted_at IS NULL",
+			quoteIdent(idxName), tableName))
 	}
 
-	return nil
+	return queries
 }
 
-// ListTenants returns all tenant IDs
-func (sm *SchemaManager) ListTenants(ctx context.Context) ([]string, error) {
-	query := `
-		SELECT schema_name 
-		FROM information_schema.schemata 
-		WHERE schema_name LIKE 'tenant_%'
-	`
+// nodeIndexes returns the indexes a node declares, under their physical
+// names: indexed properties, unique_per_tenant properties and custom indexes
+func nodeIndexes(node NodeDefinition) []IndexDefinition {
+	var indexes []IndexDefinition
 
-	rows, err := sm.db.Query(ctx, query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	for _, prop := range node.Properties {
+		if prop.Indexed {
+			indexes = append(indexes, IndexDefinition{
+				Name:   fmt.Sprintf("idx_%s_%s", node.Table, prop.Name),
+				Fields: []string{prop.Name},
+			})
+		}
 
-	var tenants []string
-	for rows.Next() {
-		var schemaName string
-		if err := rows.Scan(&schemaName); err != nil {
-			continue
+		// Unique index for unique_per_tenant fields
+		if prop.UniquePerTenant {
+			indexes = append(indexes, IndexDefinition{
+				Name:   fmt.Sprintf("uniq_%s_%s_tenant", node.Table, prop.Name),
+				Fields: []string{"tenant_id", prop.Name},
+				Unique: true,
+			})
 		}
-		// Extract tenant ID from schema name
-		tenantID := strings.TrimPrefix(schemaName, "tenant_")
-		tenants = append(tenants, tenantID)
 	}
 
-	return tenants, nil
+	for _, idx := range node.Indexes {
+		indexes = append(indexes, IndexDefinition{
+			Name:   fmt.Sprintf("%s_%s", node.Table, idx.Name),
+			Fields: idx.Fields,
+			Unique: idx.Unique,
+		})
+	}
+
+	return indexes
 }
 
-// DropTenantSchema removes a tenant's schema (careful!)
+func createIndexSQL(schema, table string, idx IndexDefinition) string {
+	unique := ""
+	if idx.Unique {
+		unique = "UNIQUE "
+	}
+	columns := make([]string, len(idx.Fields))
+	for i, field := range idx.Fields {
+		columns[i] = quoteIdent(field)
+	}
+	return fmt.Sprintf("CREATE %sINDEX IF NOT EXISTS %s ON %s(%s)",
+		unique, quoteIdent(idx.Name), qualifiedTable(schema, table), strings.Join(columns, ", "))
+}
+
+// DropTenantSchema removes a tenant's schema (careful!). A shared tenant's
+// rows are deleted from every shared table instead.
 func (sm *SchemaManager) DropTenantSchema(ctx context.Context, tenantID string) error {
-	schemaName := fmt.Sprintf("tenant_%s", tenantID)
-	query := fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", schemaName)
-	_, err := sm.db.Exec(ctx, query)
+	tenancy, err := sm.router.Tenancy(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+	if tenancy == TenancyShared {
+		return sm.deleteSharedRows(ctx, tenantID)
+	}
+
+	schemaName, err := TenantSchema(tenantID)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf("DROP SCHEMA IF EXISTS %s CASCADE", quoteIdent(schemaName))
+	_, err = sm.db.Exec(ctx, query)
 	return err
 }
+
+// deleteSharedRows deletes a shared tenant's rows from every table of the
+// shared schema, in one transaction
+func (sm *SchemaManager) deleteSharedRows(ctx context.Context, tenantID string) error {
+	rows, err := sm.db.Query(ctx, `
+		SELECT table_name FROM information_schema.columns
+		WHERE table_schema = $1 AND column_name = 'tenant_id'`, sharedSchema)
+	if err != nil {
+		return fmt.Errorf("failed to list shared tables: %w", err)
+	}
+	tables, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to list shared tables: %w", err)
+	}
+
+	tx, err := sm.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setTenant(ctx, tx, tenantID); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		query := fmt.Sprintf("DELETE FROM %s WHERE tenant_id = $1", qualifiedTable(sharedSchema, table))
+		if _, err := tx.Exec(ctx, query, tenantID); err != nil {
+			return fmt.Errorf("failed to delete rows from %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
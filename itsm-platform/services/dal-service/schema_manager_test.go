@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBuildColumnDefinitionQuotesName(t *testing.T) {
+	tests := []struct {
+		prop PropertyDefinition
+		want string
+	}{
+		{
+			PropertyDefinition{Name: "id", Type: "uuid", Primary: true},
+			`"id" UUID PRIMARY KEY DEFAULT gen_random_uuid()`,
+		},
+		{
+			PropertyDefinition{Name: "order", Type: "integer", Required: true, Default: 1},
+			`"order" INTEGER NOT NULL DEFAULT 1`,
+		},
+		{
+			PropertyDefinition{Name: "status", Type: "enum", Values: []string{"open", "won't fix"}},
+			`"status" VARCHAR(50) CHECK ("status" IN ('open', 'won''t fix'))`,
+		},
+	}
+
+	sm := &SchemaManager{}
+	for _, tt := range tests {
+		t.Run(tt.prop.Name, func(t *testing.T) {
+			if got := sm.buildColumnDefinition(tt.prop); got != tt.want {
+				t.Errorf("got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateIndexesSQLQuotesNames(t *testing.T) {
+	node := NodeDefinition{
+		Name:  "Ticket",
+		Table: "tickets",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "user", Type: "uuid", Indexed: true},
+			{Name: "code", Type: "string", UniquePerTenant: true},
+		},
+		Indexes: []IndexDefinition{{Name: "by_group", Fields: []string{"tenant_id", "group"}}},
+		DAL:     DALConfig{SoftDelete: true},
+	}
+
+	got := (&SchemaManager{}).createIndexesSQL("tenant_acme", node)
+	want := []string{
+		`CREATE INDEX IF NOT EXISTS "idx_tickets_tenant_id" ON "tenant_acme"."tickets"(tenant_id)`,
+		`CREATE INDEX IF NOT EXISTS "idx_tickets_user" ON "tenant_acme"."tickets"("user")`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "uniq_tickets_code_tenant" ON "tenant_acme"."tickets"("tenant_id", "code")`,
+		`CREATE INDEX IF NOT EXISTS "tickets_by_group" ON "tenant_acme"."tickets"("tenant_id", "group")`,
+		`CREATE INDEX IF NOT EXISTS "idx_tickets_not_deleted" ON "tenant_acme"."tickets"(tenant_id) WHERE deleted_at IS NULL`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("statements:\n%v\nwant:\n%v", got, want)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// systemSchemaUpgrades bring a dal_system created by an older
+// scripts/init.sql up to date. init.sql only runs when the database is
+// first created, so whatever it gained since is also applied here, at
+// startup. Every statement is idempotent.
+var systemSchemaUpgrades = []string{
+	`CREATE TABLE IF NOT EXISTS dal_system.service_registry_history (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		service_name VARCHAR(100) NOT NULL,
+		dsl_definition JSONB NOT NULL,
+		version VARCHAR(20),
+		registered_at TIMESTAMPTZ DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_service_registry_history_name ON dal_system.service_registry_history(service_name, registered_at DESC)`,
+	`ALTER TABLE dal_system.migration_history ADD COLUMN IF NOT EXISTS run_id UUID`,
+	`ALTER TABLE dal_system.migration_history ADD COLUMN IF NOT EXISTS target_version VARCHAR(20)`,
+	`CREATE INDEX IF NOT EXISTS idx_migration_history_run ON dal_system.migration_history(run_id)`,
+	`CREATE TABLE IF NOT EXISTS dal_system.tenant_migrations (
+		service_name VARCHAR(100) NOT NULL,
+		tenant_id VARCHAR(100) NOT NULL,
+		target_hash VARCHAR(64) NOT NULL,
+		target_version VARCHAR(20),
+		status VARCHAR(20) NOT NULL,
+		error_message TEXT,
+		run_id UUID,
+		updated_at TIMESTAMPTZ DEFAULT NOW(),
+		PRIMARY KEY (service_name, tenant_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS dal_system.deprecated_objects (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		service_name VARCHAR(100) NOT NULL,
+		tenant_id VARCHAR(100) NOT NULL,
+		table_name VARCHAR(63) NOT NULL,
+		column_name VARCHAR(63),
+		deprecated_name VARCHAR(63) NOT NULL,
+		deprecated_at TIMESTAMPTZ DEFAULT NOW(),
+		purged_at TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_deprecated_objects_service ON dal_system.deprecated_objects(service_name, tenant_id) WHERE purged_at IS NULL`,
+	`ALTER TABLE dal_system.tenants ADD COLUMN IF NOT EXISTS purge_after TIMESTAMPTZ`,
+	`ALTER TABLE dal_system.tenants ADD COLUMN IF NOT EXISTS tenancy VARCHAR(20) NOT NULL DEFAULT 'schema'`,
+}
+
+// upgradeSystemSchema applies systemSchemaUpgrades and backfills
+// dal_system.tenants in one transaction
+func upgradeSystemSchema(ctx context.Context, db *pgxpool.Pool) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	for _, query := range systemSchemaUpgrades {
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to upgrade dal_system: %w", err)
+		}
+	}
+
+	if err := backfillTenants(ctx, tx); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// backfillTenants registers the tenant_<id> schemas created before tenants
+// were tracked in dal_system.tenants. Without a row, CheckAccess refuses
+// the tenant and TenantRouter.Targets leaves it out of migrations. It runs
+// before services are loaded or registered.
+func backfillTenants(ctx context.Context, tx pgx.Tx) error {
+	rows, err := tx.Query(ctx, `
+		SELECT substr(schema_name, 8) FROM information_schema.schemata
+		WHERE schema_name LIKE 'tenant\_%'
+		AND substr(schema_name, 8) NOT IN (SELECT tenant_id FROM dal_system.tenants)`)
+	if err != nil {
+		return fmt.Errorf("failed to list tenant schemas: %w", err)
+	}
+	tenantIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("failed to list tenant schemas: %w", err)
+	}
+
+	for _, tenantID := range tenantIDs {
+		// Such a schema could not be routed to, so it is left alone
+		if err := ValidateTenantID(tenantID); err != nil {
+			log.Printf("Skipping schema %s: %v", "tenant_"+tenantID, err)
+			continue
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO dal_system.tenants (tenant_id, tenant_name, status)
+			VALUES ($1, $1, $2)
+			ON CONFLICT (tenant_id) DO NOTHING`, tenantID, TenantActive); err != nil {
+			return fmt.Errorf("failed to backfill tenant %s: %w", tenantID, err)
+		}
+		log.Printf("Registered existing schema %s as tenant %s", "tenant_"+tenantID, tenantID)
+	}
+
+	return nil
+}
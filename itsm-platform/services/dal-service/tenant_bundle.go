@@ -0,0 +1,664 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// bundleFormatVersion is written to every manifest; Import refuses bundles
+// of another format
+const bundleFormatVersion = 1
+
+// importBatchSize is the number of rows loaded per COPY during an import
+const importBatchSize = 1000
+
+const (
+	bundleManifestFile = "manifest.json"
+	bundleAuditFile    = "audit_log.ndjson"
+)
+
+// Bundler exports tenants as portable bundles and imports them again. A
+// bundle is a .tar.gz file in dir holding manifest.json, then the DSL of
+// each service, then one NDJSON file per table and the tenant's audit_log.
+type Bundler struct {
+	db       *pgxpool.Pool
+	registry *ServiceRegistry
+	schemas  *SchemaManager
+	tenants  *TenantManager
+	dir      string
+}
+
+func NewBundler(db *pgxpool.Pool, registry *ServiceRegistry, schemas *SchemaManager, tenants *TenantManager, dir string) *Bundler {
+	return &Bundler{
+		db:       db,
+		registry: registry,
+		schemas:  schemas,
+		tenants:  tenants,
+		dir:      dir,
+	}
+}
+
+// Export writes a bundle of a tenant, all services or only req.Services,
+// and returns its manifest. Rows are read in a single snapshot. The audit
+// log is limited to the exported entities when services are selected.
+func (b *Bundler) Export(ctx context.Context, req ExportRequest) (*BundleManifest, error) {
+	if err := ValidateTenantID(req.TenantID); err != nil {
+		return nil, err
+	}
+	tenant, err := b.tenants.Get(ctx, req.TenantID)
+	if err == pgx.ErrNoRows {
+		return nil, &TenantUnavailableError{TenantID: req.TenantID, Status: "not_found"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	services := req.Services
+	if len(services) == 0 {
+		services = b.registry.ListServices()
+		sort.Strings(services)
+	}
+
+	staging, err := os.MkdirTemp("", "dal-export-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	tx, err := b.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setTenant(ctx, tx, req.TenantID); err != nil {
+		return nil, err
+	}
+
+	manifest := &BundleManifest{
+		FormatVersion: bundleFormatVersion,
+		TenantID:      req.TenantID,
+		TenantName:    tenant.Name,
+		ExportedAt:    time.Now().UTC(),
+	}
+
+	// Files in archive order after the manifest, staged under staging
+	var files []string
+	var entities []string
+
+	for _, name := range services {
+		service := b.registry.GetService(name)
+		if service == nil {
+			return nil, fmt.Errorf("service %s not registered", name)
+		}
+
+		hash, err := dslHash(service.DSL)
+		if err != nil {
+			return nil, err
+		}
+		exported := BundleService{
+			Service: name,
+			Version: service.DSL.Metadata.Version,
+			DSLHash: hash,
+			DSLFile: path.Join("services", name, "dsl.json"),
+		}
+		if err := writeStagedJSON(staging, exported.DSLFile, service.DSL); err != nil {
+			return nil, err
+		}
+		files = append(files, exported.DSLFile)
+
+		for _, node := range service.DSL.Nodes {
+			tableName, err := b.schemas.router.Table(ctx, req.TenantID, node.Table)
+			if err != nil {
+				return nil, err
+			}
+
+			table := BundleTable{
+				Entity: node.Name,
+				Table:  node.Table,
+				File:   path.Join("services", name, node.Table+".ndjson"),
+			}
+			table.Rows, err = exportRows(ctx, tx, filepath.Join(staging, table.File),
+				fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t WHERE tenant_id = $1", tableName), req.TenantID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to export %s: %w", node.Table, err)
+			}
+
+			exported.Tables = append(exported.Tables, table)
+			files = append(files, table.File)
+			entities = append(entities, node.Name)
+		}
+
+		manifest.Services = append(manifest.Services, exported)
+	}
+
+	auditTable, err := b.schemas.router.Table(ctx, req.TenantID, "audit_log")
+	if err != nil {
+		return nil, err
+	}
+	auditQuery := fmt.Sprintf("SELECT row_to_json(a)::text FROM %s a WHERE tenant_id = $1", auditTable)
+	auditArgs := []interface{}{req.TenantID}
+	if len(req.Services) > 0 {
+		auditQuery += " AND entity_type = ANY($2)"
+		auditArgs = append(auditArgs, entities)
+	}
+
+	manifest.AuditLog = BundleTable{Table: "audit_log", File: bundleAuditFile}
+	manifest.AuditLog.Rows, err = exportRows(ctx, tx, filepath.Join(staging, bundleAuditFile), auditQuery, auditArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export audit_log: %w", err)
+	}
+	files = append(files, bundleAuditFile)
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	manifest.Bundle = fmt.Sprintf("%s-%s.tar.gz", req.TenantID, manifest.ExportedAt.Format("20060102T150405Z"))
+	if err := b.writeBundle(manifest, staging, files); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// exportRows writes the single text column of every row of query to file,
+// one row per line, and returns the number of rows
+func exportRows(ctx context.Context, tx pgx.Tx, file, query string, args ...interface{}) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	w := bufio.NewWriter(f)
+	var count int64
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return 0, err
+		}
+		w.WriteString(line)
+		w.WriteByte('\n')
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return count, f.Close()
+}
+
+func writeStagedJSON(staging, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(staging, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0o644)
+}
+
+// writeBundle archives the manifest and the staged files into the bundle.
+// The bundle only appears under its name once it is complete.
+func (b *Bundler) writeBundle(manifest *BundleManifest, staging string, files []string) (err error) {
+	if err := os.MkdirAll(b.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create bundle directory: %w", err)
+	}
+
+	target := filepath.Join(b.dir, manifest.Bundle)
+	partial := target + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+	defer func() {
+		f.Close()
+		if err != nil {
+			os.Remove(partial)
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addTarEntry(tw, bundleManifestFile, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		if err := addTarFile(tw, name, filepath.Join(staging, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, target)
+}
+
+func addTarFile(tw *tar.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return addTarEntry(tw, name, info.Size(), f)
+}
+
+func addTarEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to add %s to bundle: %w", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("failed to add %s to bundle: %w", name, err)
+	}
+	return nil
+}
+
+// Import loads a bundle into a tenant, creating the tenant and the tables
+// of the bundle's services first. The bundle's services must be registered
+// with the same DSL, or not at all, in which case they are registered from
+// the bundle and, as on dal.register, get their tables in every tenant. All
+// rows are loaded in one transaction, which is rolled back unless every
+// table ends up with exactly the rows of the bundle. A failed import
+// discards the tenant if it created it and unregisters the services it
+// registered, so that it can be retried.
+//
+// Row IDs are kept, except in a shared tenant, whose tables also hold other
+// tenants' rows: there every row gets a new ID, and UUID columns referring
+// to a row of the bundle are rewritten to match.
+func (b *Bundler) Import(ctx context.Context, req ImportRequest) (_ *BundleManifest, err error) {
+	if req.Bundle == "" || req.Bundle != filepath.Base(req.Bundle) || strings.HasPrefix(req.Bundle, ".") {
+		return nil, fmt.Errorf("invalid bundle name %q", req.Bundle)
+	}
+
+	f, err := os.Open(filepath.Join(b.dir, req.Bundle))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	var manifest BundleManifest
+	if err := readBundleJSON(tr, bundleManifestFile, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.FormatVersion != bundleFormatVersion {
+		return nil, fmt.Errorf("unsupported bundle format %d", manifest.FormatVersion)
+	}
+
+	tenantID := req.TenantID
+	if tenantID == "" {
+		tenantID = manifest.TenantID
+	}
+
+	// The DSLs follow the manifest. Check them all before changing anything.
+	dsls := make([]DSLDefinition, len(manifest.Services))
+	var unregistered []int
+	for i, service := range manifest.Services {
+		if err := readBundleJSON(tr, service.DSLFile, &dsls[i]); err != nil {
+			return nil, err
+		}
+		registered, err := b.checkBundleDSL(service, dsls[i])
+		if err != nil {
+			return nil, err
+		}
+		if !registered {
+			unregistered = append(unregistered, i)
+		}
+	}
+
+	existing, err := b.tenants.Get(ctx, tenantID)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+
+	var registered []string
+	created := false
+	defer func() {
+		if err == nil {
+			return
+		}
+		if created {
+			if discardErr := b.tenants.Discard(ctx, tenantID); discardErr != nil {
+				log.Printf("Failed to discard tenant %s after failed import: %v", tenantID, discardErr)
+			}
+		}
+		for _, name := range registered {
+			if unregisterErr := b.registry.UnregisterService(name); unregisterErr != nil {
+				log.Printf("Failed to unregister service %s after failed import: %v", name, unregisterErr)
+			}
+		}
+	}()
+
+	for _, i := range unregistered {
+		name := manifest.Services[i].Service
+		if err := b.registry.RegisterService(name, dsls[i]); err != nil {
+			return nil, err
+		}
+		registered = append(registered, name)
+	}
+
+	tenant, err := b.tenants.Create(ctx, tenantID, manifest.TenantName, nil, req.Tenancy)
+	if err != nil {
+		return nil, err
+	}
+	created = existing == nil
+	remap := tenant.Tenancy == TenancyShared
+	if err := b.tenants.CheckAccess(ctx, tenantID, true); err != nil {
+		return nil, err
+	}
+	if len(unregistered) > 0 {
+		targets, err := b.schemas.router.Targets(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			for _, i := range unregistered {
+				name := manifest.Services[i].Service
+				if err := b.schemas.CreateServiceSchema(ctx, target, name, dsls[i]); err != nil {
+					return nil, fmt.Errorf("failed to create schema for service %s in %s: %w", name, target, err)
+				}
+			}
+		}
+	}
+	for i, service := range manifest.Services {
+		if err := b.schemas.CreateServiceSchema(ctx, tenantID, service.Service, dsls[i]); err != nil {
+			return nil, fmt.Errorf("failed to create schema for service %s: %w", service.Service, err)
+		}
+	}
+
+	pending := map[string]BundleTable{manifest.AuditLog.File: manifest.AuditLog}
+	for _, service := range manifest.Services {
+		for _, table := range service.Tables {
+			pending[table.File] = table
+		}
+	}
+
+	tx, err := b.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setTenant(ctx, tx, tenantID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `CREATE TEMP TABLE dal_import_rows (doc JSONB) ON COMMIT DROP`); err != nil {
+		return nil, fmt.Errorf("failed to create staging table: %w", err)
+	}
+	if remap {
+		if _, err := tx.Exec(ctx, `CREATE TEMP TABLE dal_import_ids (old_id UUID PRIMARY KEY, new_id UUID NOT NULL) ON COMMIT DROP`); err != nil {
+			return nil, fmt.Errorf("failed to create ID map: %w", err)
+		}
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+
+		table, ok := pending[header.Name]
+		if !ok {
+			return nil, fmt.Errorf("unexpected file %s in bundle", header.Name)
+		}
+		delete(pending, header.Name)
+
+		if err := b.importRows(ctx, tx, tenantID, table, tr, remap); err != nil {
+			return nil, err
+		}
+	}
+	if len(pending) > 0 {
+		missing := make([]string, 0, len(pending))
+		for file := range pending {
+			missing = append(missing, file)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("bundle is missing %s", strings.Join(missing, ", "))
+	}
+
+	if remap {
+		tables := []string{manifest.AuditLog.Table}
+		for _, service := range manifest.Services {
+			for _, table := range service.Tables {
+				tables = append(tables, table.Table)
+			}
+		}
+		if err := b.remapReferences(ctx, tx, tenantID, tables); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit import: %w", err)
+	}
+	return &manifest, nil
+}
+
+// checkBundleDSL verifies a bundled DSL against its manifest entry and the
+// registry. It reports whether the service is already registered.
+func (b *Bundler) checkBundleDSL(service BundleService, dsl DSLDefinition) (bool, error) {
+	hash, err := dslHash(dsl)
+	if err != nil {
+		return false, err
+	}
+	if hash != service.DSLHash {
+		return false, fmt.Errorf("DSL of %s does not match the bundle manifest", service.Service)
+	}
+
+	registered := b.registry.GetService(service.Service)
+	if registered == nil {
+		return false, nil
+	}
+	current, err := dslHash(registered.DSL)
+	if err != nil {
+		return false, err
+	}
+	if current != hash {
+		return false, fmt.Errorf("service %s is registered with a different DSL (version %q) than the bundle (version %q); migrate it to the bundle's DSL first",
+			service.Service, registered.DSL.Metadata.Version, service.Version)
+	}
+	return true, nil
+}
+
+// readBundleJSON decodes the next bundle file, which must be name
+func readBundleJSON(tr *tar.Reader, name string, v interface{}) error {
+	header, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("failed to read %s from bundle: %w", name, err)
+	}
+	if header.Name != name {
+		return fmt.Errorf("bundle has %s where %s was expected", header.Name, name)
+	}
+	if err := json.NewDecoder(tr).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// importRows loads one NDJSON file into an empty table, importBatchSize
+// rows per COPY. Rows are staged as JSON and converted to the table's row
+// type, with tenant_id set to the importing tenant. With remap, each row
+// gets a new ID, recorded in dal_import_ids.
+func (b *Bundler) importRows(ctx context.Context, tx pgx.Tx, tenantID string, table BundleTable, r io.Reader, remap bool) error {
+	tableName, err := b.schemas.router.Table(ctx, tenantID, table.Table)
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s WHERE tenant_id = $1)", tableName),
+		tenantID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check %s: %w", table.Table, err)
+	}
+	if exists {
+		return fmt.Errorf("tenant %s already has rows in %s", tenantID, table.Table)
+	}
+
+	insert := fmt.Sprintf(`INSERT INTO %s
+		SELECT (jsonb_populate_record(NULL::%s, doc || jsonb_build_object('tenant_id', $1::text))).*
+		FROM dal_import_rows`, tableName, tableName)
+	if remap {
+		insert = fmt.Sprintf(`INSERT INTO %s
+			SELECT (jsonb_populate_record(NULL::%s, doc || jsonb_build_object('tenant_id', $1::text, 'id', ids.new_id))).*
+			FROM dal_import_rows JOIN dal_import_ids ids ON ids.old_id = (doc->>'id')::uuid`, tableName, tableName)
+	}
+
+	var loaded int64
+	batch := make([][]interface{}, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"dal_import_rows"}, []string{"doc"}, pgx.CopyFromRows(batch)); err != nil {
+			return fmt.Errorf("failed to copy rows into %s: %w", table.Table, err)
+		}
+		if remap {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO dal_import_ids (old_id, new_id)
+				SELECT (doc->>'id')::uuid, gen_random_uuid() FROM dal_import_rows`); err != nil {
+				return fmt.Errorf("failed to assign IDs to rows of %s: %w", table.Table, err)
+			}
+		}
+		if _, err := tx.Exec(ctx, insert, tenantID); err != nil {
+			return fmt.Errorf("failed to load rows into %s: %w", table.Table, err)
+		}
+		if _, err := tx.Exec(ctx, `TRUNCATE dal_import_rows`); err != nil {
+			return err
+		}
+		loaded += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	reader := bufio.NewReader(r)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			batch = append(batch, []interface{}{json.RawMessage(line)})
+			if len(batch) == importBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read %s: %w", table.File, readErr)
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	var count int64
+	if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s WHERE tenant_id = $1", tableName),
+		tenantID).Scan(&count); err != nil {
+		return fmt.Errorf("failed to count %s: %w", table.Table, err)
+	}
+	if loaded != table.Rows || count != table.Rows {
+		return fmt.Errorf("row count mismatch in %s: manifest lists %d, bundle has %d, table has %d",
+			table.Table, table.Rows, loaded, count)
+	}
+	return nil
+}
+
+// remapReferences rewrites the UUID columns of a tenant's imported rows
+// that hold the bundle ID of an imported row, such as relation fields and
+// audit_log.entity_id, to the row's new ID. IDs inside JSON values are
+// left as they are.
+func (b *Bundler) remapReferences(ctx context.Context, tx pgx.Tx, tenantID string, tables []string) error {
+	schema, err := b.schemas.router.Schema(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		rows, err := tx.Query(ctx, `
+			SELECT column_name FROM information_schema.columns
+			WHERE table_schema = $1 AND table_name = $2 AND data_type = 'uuid' AND column_name <> 'id'`,
+			schema, table)
+		if err != nil {
+			return fmt.Errorf("failed to list columns of %s: %w", table, err)
+		}
+		columns, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("failed to list columns of %s: %w", table, err)
+		}
+
+		for _, column := range columns {
+			query := fmt.Sprintf(`UPDATE %s t SET %s = ids.new_id
+				FROM dal_import_ids ids
+				WHERE t.%s = ids.old_id AND t.tenant_id = $1`,
+				qualifiedTable(schema, table), quoteIdent(column), quoteIdent(column))
+			if _, err := tx.Exec(ctx, query, tenantID); err != nil {
+				return fmt.Errorf("failed to remap %s.%s: %w", table, column, err)
+			}
+		}
+	}
+	return nil
+}
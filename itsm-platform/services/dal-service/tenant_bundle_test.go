@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func bundleDSL(service, table string) DSLDefinition {
+	return DSLDefinition{
+		Metadata: ServiceMetadata{Service: service, Version: "1.0.0"},
+		Nodes: []NodeDefinition{{
+			Name:       "Item",
+			Table:      table,
+			Properties: []PropertyDefinition{{Name: "id", Type: "uuid", Primary: true}},
+		}},
+	}
+}
+
+// openBundle returns a reader positioned before the bundle's manifest
+func openBundle(t *testing.T, file string) *tar.Reader {
+	t.Helper()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(gz)
+}
+
+func TestBundleManifestRoundTrip(t *testing.T) {
+	b := &Bundler{registry: NewServiceRegistry(nil), dir: t.TempDir()}
+	staging := t.TempDir()
+
+	manifest := &BundleManifest{
+		FormatVersion: bundleFormatVersion,
+		Bundle:        "acme-20260101T000000Z.tar.gz",
+		TenantID:      "acme",
+		TenantName:    "Acme",
+		ExportedAt:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		AuditLog:      BundleTable{Table: "audit_log", File: bundleAuditFile, Rows: 0},
+	}
+	var files []string
+	dsls := []DSLDefinition{bundleDSL("assets", "assets"), bundleDSL("tickets", "tickets")}
+	for _, dsl := range dsls {
+		hash, err := dslHash(dsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		service := BundleService{
+			Service: dsl.Metadata.Service,
+			Version: dsl.Metadata.Version,
+			DSLHash: hash,
+			DSLFile: "services/" + dsl.Metadata.Service + "/dsl.json",
+			Tables:  []BundleTable{{Entity: "Item", Table: dsl.Nodes[0].Table, File: "services/" + dsl.Metadata.Service + "/items.ndjson"}},
+		}
+		if err := writeStagedJSON(staging, service.DSLFile, dsl); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Services = append(manifest.Services, service)
+		files = append(files, service.DSLFile)
+	}
+
+	if err := b.writeBundle(manifest, staging, files); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(b.dir, manifest.Bundle)
+	if _, err := os.Stat(file + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial bundle left behind: %v", err)
+	}
+
+	tr := openBundle(t, file)
+	var got BundleManifest
+	if err := readBundleJSON(tr, bundleManifestFile, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, manifest) {
+		t.Errorf("manifest:\n%+v\nwant:\n%+v", got, *manifest)
+	}
+
+	// The DSLs follow in manifest order and match their hashes
+	for i, service := range got.Services {
+		var dsl DSLDefinition
+		if err := readBundleJSON(tr, service.DSLFile, &dsl); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(dsl, dsls[i]) {
+			t.Errorf("DSL of %s:\n%+v\nwant:\n%+v", service.Service, dsl, dsls[i])
+		}
+		if registered, err := b.checkBundleDSL(service, dsl); err != nil || registered {
+			t.Errorf("%s: registered %v, %v; want false, nil", service.Service, registered, err)
+		}
+	}
+
+	// Files are read in archive order only
+	tr = openBundle(t, file)
+	if err := readBundleJSON(tr, files[0], &got); err == nil || !strings.Contains(err.Error(), "was expected") {
+		t.Errorf("got %v reading %s first, want an order error", err, files[0])
+	}
+}
+
+func TestCheckBundleDSL(t *testing.T) {
+	registry := NewServiceRegistry(nil)
+	registered := bundleDSL("tickets", "tickets")
+	if err := registry.RegisterService("tickets", registered); err != nil {
+		t.Fatal(err)
+	}
+	b := &Bundler{registry: registry}
+
+	changed := bundleDSL("tickets", "tickets")
+	changed.Metadata.Version = "2.0.0"
+	changed.Nodes[0].Properties = append(changed.Nodes[0].Properties, PropertyDefinition{Name: "title", Type: "string"})
+
+	hashOf := func(dsl DSLDefinition) string {
+		hash, err := dslHash(dsl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+
+	tests := []struct {
+		name           string
+		service        BundleService
+		dsl            DSLDefinition
+		wantRegistered bool
+		wantErr        string
+	}{
+		{
+			name:    "unregistered service",
+			service: BundleService{Service: "assets", DSLHash: hashOf(bundleDSL("assets", "assets"))},
+			dsl:     bundleDSL("assets", "assets"),
+		},
+		{
+			name:           "registered with the same DSL",
+			service:        BundleService{Service: "tickets", DSLHash: hashOf(registered)},
+			dsl:            registered,
+			wantRegistered: true,
+		},
+		{
+			name:    "registered with another DSL",
+			service: BundleService{Service: "tickets", Version: "2.0.0", DSLHash: hashOf(changed)},
+			dsl:     changed,
+			wantErr: "registered with a different DSL",
+		},
+		{
+			name:    "DSL does not match the manifest",
+			service: BundleService{Service: "assets", DSLHash: hashOf(registered)},
+			dsl:     bundleDSL("assets", "assets"),
+			wantErr: "does not match the bundle manifest",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.checkBundleDSL(tt.service, tt.dsl)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.wantRegistered {
+				t.Errorf("registered %v, want %v", got, tt.wantRegistered)
+			}
+		})
+	}
+}
+
+func TestImportCreatesBundledServicesInEveryTenant(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	router := NewTenantRouter(db)
+	schemas := NewSchemaManager(db, router)
+	tenants := NewTenantManager(db, schemas)
+	dir := t.TempDir()
+
+	newTenant := func() string {
+		tenantID := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+		t.Cleanup(func() {
+			if err := tenants.Discard(ctx, tenantID); err != nil {
+				t.Errorf("failed to discard tenant %s: %v", tenantID, err)
+			}
+		})
+		return tenantID
+	}
+
+	// The exporting instance knows two services, the importing one none
+	suffix := strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+	exported := bundleDSL("bundled_"+suffix, "bundled_items")
+	skipped := bundleDSL("skipped_"+suffix, "skipped_items")
+	source := NewServiceRegistry(nil)
+	for _, dsl := range []DSLDefinition{exported, skipped} {
+		if err := source.RegisterService(dsl.Metadata.Service, dsl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sourceID := newTenant()
+	if _, err := tenants.Create(ctx, sourceID, "", nil, TenancySchema); err != nil {
+		t.Fatal(err)
+	}
+	for _, dsl := range []DSLDefinition{exported, skipped} {
+		if err := schemas.CreateServiceSchema(ctx, sourceID, dsl.Metadata.Service, dsl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A tenant that is neither exported nor imported into
+	bystanderID := newTenant()
+	if _, err := tenants.Create(ctx, bystanderID, "", nil, TenancySchema); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := NewBundler(db, source, schemas, tenants, dir).Export(ctx, ExportRequest{
+		TenantID: sourceID,
+		Services: []string{exported.Metadata.Service},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Services) != 1 || manifest.Services[0].Service != exported.Metadata.Service {
+		t.Fatalf("exported services %+v, want only %s", manifest.Services, exported.Metadata.Service)
+	}
+
+	target := NewServiceRegistry(nil)
+	importID := newTenant()
+	if _, err := NewBundler(db, target, schemas, tenants, dir).Import(ctx, ImportRequest{
+		Bundle:   manifest.Bundle,
+		TenantID: importID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if target.GetService(exported.Metadata.Service) == nil {
+		t.Errorf("service %s not registered by the import", exported.Metadata.Service)
+	}
+	if target.GetService(skipped.Metadata.Service) != nil {
+		t.Errorf("service %s registered although it was not exported", skipped.Metadata.Service)
+	}
+
+	for _, tenantID := range []string{importID, bystanderID} {
+		table, err := router.Table(ctx, tenantID, "bundled_items")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exists bool
+		if err := db.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("table %s not created", table)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Anonymization strategies for AnonymizeRule. NULL values stay NULL except
+// with AnonymizeFixed.
+const (
+	AnonymizeMask  = "mask"  // letters and digits replaced by '*', except the last four characters of values longer than four
+	AnonymizeEmail = "email" // distinct fake address at example.invalid
+	AnonymizeHash  = "hash"  // md5 of the value, so distinct values stay distinct
+	AnonymizeNull  = "null"  // NULL; the property must not be required
+	AnonymizeFixed = "fixed" // the rule's value, cast to the column type
+)
+
+// TenantCloner creates tenants as copies of other tenants, e.g. sandboxes
+// for training
+type TenantCloner struct {
+	db       *pgxpool.Pool
+	registry *ServiceRegistry
+	schemas  *SchemaManager
+	tenants  *TenantManager
+}
+
+func NewTenantCloner(db *pgxpool.Pool, registry *ServiceRegistry, schemas *SchemaManager, tenants *TenantManager) *TenantCloner {
+	return &TenantCloner{
+		db:       db,
+		registry: registry,
+		schemas:  schemas,
+		tenants:  tenants,
+	}
+}
+
+// Clone creates tenant req.TenantID with the tables of every registered
+// service and copies the source tenant's rows into it, applying the
+// anonymization rules. The copy runs in one transaction that also records
+// the clone's lineage under "cloned_from" in its metadata; if it fails the
+// new tenant is discarded. Rows keep their IDs; the audit log is not copied.
+func (c *TenantCloner) Clone(ctx context.Context, req CloneRequest) (*Tenant, error) {
+	if err := ValidateTenantID(req.TenantID); err != nil {
+		return nil, err
+	}
+	if req.SourceTenantID == req.TenantID {
+		return nil, fmt.Errorf("a tenant cannot be cloned into itself")
+	}
+	if err := c.tenants.CheckAccess(ctx, req.SourceTenantID, false); err != nil {
+		return nil, err
+	}
+
+	_, err := c.tenants.Get(ctx, req.TenantID)
+	if err == nil {
+		return nil, fmt.Errorf("tenant %s already exists", req.TenantID)
+	}
+	if err != pgx.ErrNoRows {
+		return nil, err
+	}
+
+	// Rows keep their IDs, so a clone cannot share tables with its source
+	// or with other clones of it
+	if req.Tenancy == TenancyShared {
+		return nil, fmt.Errorf("tenants can only be cloned with %s tenancy", TenancySchema)
+	}
+
+	services := c.registry.ListServices()
+	sort.Strings(services)
+
+	expressions, err := c.anonymizeExpressions(services, req.Anonymize)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.tenants.Create(ctx, req.TenantID, req.TenantName, nil, req.Tenancy); err != nil {
+		return nil, err
+	}
+
+	if err := c.copyData(ctx, req, services, expressions); err != nil {
+		// Leave no half-made clone behind
+		if discardErr := c.tenants.Discard(ctx, req.TenantID); discardErr != nil {
+			log.Printf("Failed to discard clone %s: %v", req.TenantID, discardErr)
+		}
+		return nil, err
+	}
+
+	log.Printf("Cloned tenant %s into %s", req.SourceTenantID, req.TenantID)
+	return c.tenants.Get(ctx, req.TenantID)
+}
+
+// copyData creates the clone's tables and copies every table's rows and the
+// lineage in one transaction
+func (c *TenantCloner) copyData(ctx context.Context, req CloneRequest, services []string, expressions map[string]map[string]map[string]string) error {
+	for _, service := range services {
+		if err := c.schemas.CreateServiceSchema(ctx, req.TenantID, service, c.registry.GetServiceDSL(service)); err != nil {
+			return fmt.Errorf("failed to create schema for service %s: %w", service, err)
+		}
+	}
+
+	tx, err := c.db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	versions := make(map[string]string, len(services))
+	copied := make(map[string]int64)
+	for _, service := range services {
+		dsl := c.registry.GetServiceDSL(service)
+		versions[service] = dsl.Metadata.Version
+
+		for _, node := range dsl.Nodes {
+			count, err := c.copyTable(ctx, tx, req.SourceTenantID, req.TenantID, node, expressions[service][node.Name])
+			if err != nil {
+				return fmt.Errorf("failed to copy %s: %w", node.Table, err)
+			}
+			copied[service+"."+node.Table] = count
+		}
+	}
+
+	anonymized := make([]string, len(req.Anonymize))
+	for i, rule := range req.Anonymize {
+		anonymized[i] = fmt.Sprintf("%s.%s:%s", rule.Entity, rule.Property, rule.Strategy)
+	}
+
+	lineage := map[string]interface{}{
+		"source_tenant_id": req.SourceTenantID,
+		"cloned_at":        time.Now().UTC(),
+		"services":         versions,
+		"rows":             copied,
+		"anonymized":       anonymized,
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE dal_system.tenants
+		SET metadata = COALESCE(metadata, '{}'::jsonb) || jsonb_build_object('cloned_from', $2::jsonb),
+		    updated_at = NOW()
+		WHERE tenant_id = $1`, req.TenantID, lineage); err != nil {
+		return fmt.Errorf("failed to record lineage: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit clone: %w", err)
+	}
+	return nil
+}
+
+// copyTable copies a node's rows from source to target. Row-level security
+// admits one tenant per statement, so rows are read as the source into a
+// temporary table, with tenant_id and anonymized columns rewritten, and
+// written from there as the target.
+func (c *TenantCloner) copyTable(ctx context.Context, tx pgx.Tx, source, target string, node NodeDefinition, expressions map[string]string) (int64, error) {
+	sourceTable, err := c.schemas.router.Table(ctx, source, node.Table)
+	if err != nil {
+		return 0, err
+	}
+	targetSchema, err := c.schemas.router.Schema(ctx, target)
+	if err != nil {
+		return 0, err
+	}
+	targetTable := qualifiedTable(targetSchema, node.Table)
+
+	rows, err := tx.Query(ctx, `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2
+		ORDER BY ordinal_position`, targetSchema, node.Table)
+	if err != nil {
+		return 0, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	columns := make([]string, len(names))
+	values := make([]string, len(names))
+	for i, name := range names {
+		columns[i] = quoteIdent(name)
+		expr, anonymized := expressions[name]
+		switch {
+		case name == "tenant_id":
+			values[i] = "$2::varchar"
+		case anonymized:
+			values[i] = expr
+		default:
+			values[i] = quoteIdent(name)
+		}
+	}
+	columnList := strings.Join(columns, ", ")
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE dal_clone_rows ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA",
+		columnList, targetTable)); err != nil {
+		return 0, err
+	}
+
+	if err := setTenant(ctx, tx, source); err != nil {
+		return 0, err
+	}
+	read, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO dal_clone_rows (%s) SELECT %s FROM %s WHERE tenant_id = $1",
+		columnList, strings.Join(values, ", "), sourceTable), source, target)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setTenant(ctx, tx, target); err != nil {
+		return 0, err
+	}
+	written, err := tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM dal_clone_rows",
+		targetTable, columnList, columnList))
+	if err != nil {
+		return 0, err
+	}
+	if written.RowsAffected() != read.RowsAffected() {
+		return 0, fmt.Errorf("read %d rows but wrote %d", read.RowsAffected(), written.RowsAffected())
+	}
+
+	if _, err := tx.Exec(ctx, `DROP TABLE dal_clone_rows`); err != nil {
+		return 0, err
+	}
+	return written.RowsAffected(), nil
+}
+
+// anonymizeExpressions resolves the rules against the registered services
+// into SQL expressions, by service, entity and column
+func (c *TenantCloner) anonymizeExpressions(services []string, rules []AnonymizeRule) (map[string]map[string]map[string]string, error) {
+	expressions := make(map[string]map[string]map[string]string)
+
+	for _, rule := range rules {
+		matched := false
+		for _, service := range services {
+			if rule.Service != "" && rule.Service != service {
+				continue
+			}
+			node := c.registry.GetService(service).GetNode(rule.Entity)
+			if node == nil {
+				continue
+			}
+
+			var prop *PropertyDefinition
+			for i := range node.Properties {
+				if node.Properties[i].Name == rule.Property {
+					prop = &node.Properties[i]
+				}
+			}
+			if prop == nil {
+				return nil, &UnknownFieldError{Entity: rule.Entity, Field: rule.Property}
+			}
+
+			expr, err := anonymizeExpression(*prop, rule)
+			if err != nil {
+				return nil, fmt.Errorf("cannot anonymize %s.%s: %w", rule.Entity, rule.Property, err)
+			}
+
+			if expressions[service] == nil {
+				expressions[service] = make(map[string]map[string]string)
+			}
+			if expressions[service][node.Name] == nil {
+				expressions[service][node.Name] = make(map[string]string)
+			}
+			expressions[service][node.Name][prop.Name] = expr
+			matched = true
+		}
+
+		if !matched {
+			return nil, fmt.Errorf("cannot anonymize %s.%s: entity %s not found", rule.Entity, rule.Property, rule.Entity)
+		}
+	}
+
+	return expressions, nil
+}
+
+// anonymizedWidth is the length of the values written by the strategies
+// that do not keep the original length
+var anonymizedWidth = map[string]int{
+	AnonymizeEmail: len("user-") + 12 + len("@example.invalid"),
+	AnonymizeHash:  32,
+}
+
+// anonymizeExpression returns the SQL expression that replaces a
+// property's value according to rule
+func anonymizeExpression(prop PropertyDefinition, rule AnonymizeRule) (string, error) {
+	if prop.Primary {
+		return "", fmt.Errorf("primary keys are kept")
+	}
+	column := quoteIdent(prop.Name)
+
+	switch rule.Strategy {
+	case AnonymizeNull:
+		if prop.Required {
+			return "", fmt.Errorf("property is required")
+		}
+		return "NULL", nil
+	case AnonymizeFixed:
+		if prop.MaxLength > 0 && utf8.RuneCountInString(rule.Value) > prop.MaxLength {
+			return "", fmt.Errorf("value is longer than max_length %d", prop.MaxLength)
+		}
+		return quoteLiteral(rule.Value) + "::" + columnType(prop), nil
+	case AnonymizeMask, AnonymizeEmail, AnonymizeHash:
+		if prop.Type == "enum" || typeFamily(columnType(prop)) != "text" {
+			return "", fmt.Errorf("strategy %s needs a text property", rule.Strategy)
+		}
+	default:
+		return "", fmt.Errorf("unknown strategy %q", rule.Strategy)
+	}
+
+	// Masked values keep their length, the others must fit the column
+	if width := anonymizedWidth[rule.Strategy]; prop.MaxLength > 0 && width > prop.MaxLength {
+		return "", fmt.Errorf("strategy %s writes %d characters, more than max_length %d", rule.Strategy, width, prop.MaxLength)
+	}
+
+	switch rule.Strategy {
+	case AnonymizeMask:
+		// Short values would otherwise be left entirely in the clear
+		return fmt.Sprintf(`CASE WHEN length(%s) <= 4 THEN regexp_replace(%s, '[[:alnum:]]', '*', 'g')
+			ELSE regexp_replace(left(%s, -4), '[[:alnum:]]', '*', 'g') || right(%s, 4) END`,
+			column, column, column, column), nil
+	case AnonymizeEmail:
+		return fmt.Sprintf("'user-' || left(md5(%s), 12) || '@example.invalid'", column), nil
+	default:
+		return fmt.Sprintf("md5(%s)", column), nil
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnonymizeExpression(t *testing.T) {
+	text := PropertyDefinition{Name: "email", Type: "string"}
+	with := func(prop PropertyDefinition, change func(*PropertyDefinition)) PropertyDefinition {
+		change(&prop)
+		return prop
+	}
+
+	tests := []struct {
+		name     string
+		prop     PropertyDefinition
+		strategy string
+		value    string
+		want     string // whitespace collapsed
+		wantErr  string
+	}{
+		{
+			name:     "mask",
+			prop:     text,
+			strategy: AnonymizeMask,
+			want: `CASE WHEN length("email") <= 4 THEN regexp_replace("email", '[[:alnum:]]', '*', 'g') ` +
+				`ELSE regexp_replace(left("email", -4), '[[:alnum:]]', '*', 'g') || right("email", 4) END`,
+		},
+		{
+			name:     "mask keeps the length of short columns",
+			prop:     with(text, func(p *PropertyDefinition) { p.MaxLength = 4 }),
+			strategy: AnonymizeMask,
+			want: `CASE WHEN length("email") <= 4 THEN regexp_replace("email", '[[:alnum:]]', '*', 'g') ` +
+				`ELSE regexp_replace(left("email", -4), '[[:alnum:]]', '*', 'g') || right("email", 4) END`,
+		},
+		{
+			name:     "email",
+			prop:     text,
+			strategy: AnonymizeEmail,
+			want:     `'user-' || left(md5("email"), 12) || '@example.invalid'`,
+		},
+		{
+			name:     "email fitting max_length",
+			prop:     with(text, func(p *PropertyDefinition) { p.MaxLength = 33 }),
+			strategy: AnonymizeEmail,
+			want:     `'user-' || left(md5("email"), 12) || '@example.invalid'`,
+		},
+		{
+			name:     "email longer than max_length",
+			prop:     with(text, func(p *PropertyDefinition) { p.MaxLength = 32 }),
+			strategy: AnonymizeEmail,
+			wantErr:  "writes 33 characters, more than max_length 32",
+		},
+		{
+			name:     "email on a text property",
+			prop:     with(text, func(p *PropertyDefinition) { p.Type = "text" }),
+			strategy: AnonymizeEmail,
+			want:     `'user-' || left(md5("email"), 12) || '@example.invalid'`,
+		},
+		{
+			name:     "hash",
+			prop:     text,
+			strategy: AnonymizeHash,
+			want:     `md5("email")`,
+		},
+		{
+			name:     "hash fitting max_length",
+			prop:     with(text, func(p *PropertyDefinition) { p.MaxLength = 32 }),
+			strategy: AnonymizeHash,
+			want:     `md5("email")`,
+		},
+		{
+			name:     "hash longer than max_length",
+			prop:     with(text, func(p *PropertyDefinition) { p.MaxLength = 20 }),
+			strategy: AnonymizeHash,
+			wantErr:  "writes 32 characters, more than max_length 20",
+		},
+		{
+			name:     "null",
+			prop:     text,
+			strategy: AnonymizeNull,
+			want:     `NULL`,
+		},
+		{
+			name:     "null on a required property",
+			prop:     with(text, func(p *PropertyDefinition) { p.Required = true }),
+			strategy: AnonymizeNull,
+			wantErr:  "property is required",
+		},
+		{
+			name:     "fixed",
+			prop:     with(text, func(p *PropertyDefinition) { p.MaxLength = 40 }),
+			strategy: AnonymizeFixed,
+			value:    "o'brien@example.invalid",
+			want:     `'o''brien@example.invalid'::VARCHAR(40)`,
+		},
+		{
+			name:     "fixed longer than max_length",
+			prop:     with(text, func(p *PropertyDefinition) { p.MaxLength = 4 }),
+			strategy: AnonymizeFixed,
+			value:    "redacted",
+			wantErr:  "longer than max_length 4",
+		},
+		{
+			name:     "fixed on an integer",
+			prop:     PropertyDefinition{Name: "age", Type: "integer"},
+			strategy: AnonymizeFixed,
+			value:    "0",
+			want:     `'0'::INTEGER`,
+		},
+		{
+			name:     "null on a uuid",
+			prop:     PropertyDefinition{Name: "manager_id", Type: "uuid"},
+			strategy: AnonymizeNull,
+			want:     `NULL`,
+		},
+		{
+			name:     "mask on an integer",
+			prop:     PropertyDefinition{Name: "age", Type: "integer"},
+			strategy: AnonymizeMask,
+			wantErr:  "needs a text property",
+		},
+		{
+			name:     "email on a uuid",
+			prop:     PropertyDefinition{Name: "manager_id", Type: "uuid"},
+			strategy: AnonymizeEmail,
+			wantErr:  "needs a text property",
+		},
+		{
+			name:     "hash on jsonb",
+			prop:     PropertyDefinition{Name: "metadata", Type: "jsonb"},
+			strategy: AnonymizeHash,
+			wantErr:  "needs a text property",
+		},
+		{
+			name:     "hash on an enum",
+			prop:     PropertyDefinition{Name: "status", Type: "enum", Values: []string{"open", "closed"}},
+			strategy: AnonymizeHash,
+			wantErr:  "needs a text property",
+		},
+		{
+			name:     "primary key",
+			prop:     PropertyDefinition{Name: "id", Type: "uuid", Primary: true},
+			strategy: AnonymizeNull,
+			wantErr:  "primary keys are kept",
+		},
+		{
+			name:     "text primary key",
+			prop:     with(text, func(p *PropertyDefinition) { p.Primary = true }),
+			strategy: AnonymizeHash,
+			wantErr:  "primary keys are kept",
+		},
+		{
+			name:     "unknown strategy",
+			prop:     text,
+			strategy: "shuffle",
+			wantErr:  `unknown strategy "shuffle"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := anonymizeExpression(tt.prop, AnonymizeRule{Strategy: tt.strategy, Value: tt.value})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %s, %v; want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(strings.Fields(got), " "); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Tenancy strategies, chosen per tenant when it is created and recorded in
+// dal_system.tenants.tenancy
+const (
+	TenancySchema = "schema" // own tenant_<id> schema
+	TenancyShared = "shared" // rows in the tables of sharedSchema
+)
+
+// sharedSchema holds the tables of all shared tenants, whose rows are kept
+// apart by tenant_id and row-level security. It is outside the tenant_
+// namespace, so no tenant ID maps to it.
+const sharedSchema = "dal_shared"
+
+// sharedTarget stands for sharedSchema wherever the migrator keys its work
+// by tenant: plans, reports, tenant_migrations and deprecated_objects. It
+// is not a valid tenant ID.
+const sharedTarget = "_shared"
+
+// TenantRouter resolves where a tenant's tables live. QueryExecutor,
+// SchemaManager and Migrator all locate tables through it.
+type TenantRouter struct {
+	db *pgxpool.Pool
+
+	mu        sync.Mutex
+	tenancies map[string]cachedTenancy
+}
+
+type cachedTenancy struct {
+	tenancy string
+	expires time.Time
+}
+
+func NewTenantRouter(db *pgxpool.Pool) *TenantRouter {
+	return &TenantRouter{
+		db:        db,
+		tenancies: make(map[string]cachedTenancy),
+	}
+}
+
+// Tenancy returns a tenant's strategy. Tenants that are not registered are
+// treated as schema tenants. A tenant keeps its strategy for its whole
+// life, but its ID can be purged and registered again with the other
+// strategy, so the strategy is forgotten on every dal.tenant.changed
+// notice and, in case one was missed, after tenantStatusTTL.
+func (r *TenantRouter) Tenancy(ctx context.Context, tenantID string) (string, error) {
+	if err := ValidateTenantID(tenantID); err != nil {
+		return "", err
+	}
+
+	r.mu.Lock()
+	cached, ok := r.tenancies[tenantID]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.tenancy, nil
+	}
+
+	var tenancy string
+	err := r.db.QueryRow(ctx,
+		`SELECT tenancy FROM dal_system.tenants WHERE tenant_id = $1`, tenantID).Scan(&tenancy)
+	if err == pgx.ErrNoRows {
+		return TenancySchema, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up tenancy of %s: %w", tenantID, err)
+	}
+
+	r.mu.Lock()
+	r.tenancies[tenantID] = cachedTenancy{tenancy: tenancy, expires: time.Now().Add(tenantStatusTTL)}
+	r.mu.Unlock()
+	return tenancy, nil
+}
+
+// Schema returns the schema holding a tenant's tables, or sharedSchema
+// for sharedTarget. The name is unquoted.
+func (r *TenantRouter) Schema(ctx context.Context, tenantID string) (string, error) {
+	if tenantID == sharedTarget {
+		return sharedSchema, nil
+	}
+
+	tenancy, err := r.Tenancy(ctx, tenantID)
+	if err != nil {
+		return "", err
+	}
+	if tenancy == TenancyShared {
+		return sharedSchema, nil
+	}
+	return TenantSchema(tenantID)
+}
+
+// Table returns the quoted schema-qualified name of a tenant's table
+func (r *TenantRouter) Table(ctx context.Context, tenantID, table string) (string, error) {
+	schema, err := r.Schema(ctx, tenantID)
+	if err != nil {
+		return "", err
+	}
+	return qualifiedTable(schema, table), nil
+}
+
+// Targets returns every place service tables are kept, whatever the tenant
+// status: the ID of each schema tenant, and sharedTarget if there are
+// shared tenants
+func (r *TenantRouter) Targets(ctx context.Context) ([]string, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT tenant_id FROM dal_system.tenants WHERE tenancy = $1
+		UNION ALL
+		SELECT $2::varchar WHERE EXISTS (SELECT 1 FROM dal_system.tenants WHERE tenancy = $3)
+		ORDER BY 1`, TenancySchema, sharedTarget, TenancyShared)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %w", err)
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// forget drops a tenant's cached strategy
+func (r *TenantRouter) forget(tenantID string) {
+	r.mu.Lock()
+	delete(r.tenancies, tenantID)
+	r.mu.Unlock()
+}
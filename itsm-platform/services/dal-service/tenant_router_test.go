@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTenantRouterSchemaAndTable(t *testing.T) {
+	// Known tenancies are served from the cache, so no database is needed
+	expires := time.Now().Add(time.Hour)
+	router := &TenantRouter{tenancies: map[string]cachedTenancy{
+		"acme":    {tenancy: TenancySchema, expires: expires},
+		"corner":  {tenancy: TenancyShared, expires: expires},
+		"kiosk-2": {tenancy: TenancyShared, expires: expires},
+	}}
+
+	tests := []struct {
+		tenantID   string
+		wantSchema string
+		wantTable  string
+		wantErr    bool
+	}{
+		{tenantID: "acme", wantSchema: "tenant_acme", wantTable: `"tenant_acme"."tickets"`},
+		{tenantID: "corner", wantSchema: "dal_shared", wantTable: `"dal_shared"."tickets"`},
+		{tenantID: "kiosk-2", wantSchema: "dal_shared", wantTable: `"dal_shared"."tickets"`},
+		{tenantID: sharedTarget, wantSchema: "dal_shared", wantTable: `"dal_shared"."tickets"`},
+		{tenantID: "Acme", wantErr: true},
+		{tenantID: "acme.public", wantErr: true},
+		{tenantID: "", wantErr: true},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.tenantID, func(t *testing.T) {
+			schema, err := router.Schema(ctx, tt.tenantID)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got schema %s, want an error", schema)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if schema != tt.wantSchema {
+				t.Errorf("schema %s, want %s", schema, tt.wantSchema)
+			}
+
+			table, err := router.Table(ctx, tt.tenantID, "tickets")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if table != tt.wantTable {
+				t.Errorf("table %s, want %s", table, tt.wantTable)
+			}
+		})
+	}
+}
+
+func TestTenantRouterFollowsTenantsRecreatedElsewhere(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	nc := testNATS(t)
+
+	newInstance := func() (*TenantRouter, *TenantManager) {
+		router := NewTenantRouter(db)
+		tenants := NewTenantManager(db, NewSchemaManager(db, router))
+		if err := tenants.Watch(nc); err != nil {
+			t.Fatal(err)
+		}
+		return router, tenants
+	}
+	_, writer := newInstance()
+	reader, _ := newInstance()
+
+	tenantID := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+	if _, err := writer.Create(ctx, tenantID, "", nil, TenancySchema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := writer.Discard(ctx, tenantID); err != nil {
+			t.Errorf("failed to discard tenant %s: %v", tenantID, err)
+		}
+	})
+
+	if schema, err := reader.Schema(ctx, tenantID); err != nil || schema != "tenant_"+tenantID {
+		t.Fatalf("got schema %s, %v; want tenant_%s", schema, err, tenantID)
+	}
+
+	// The writer purges the ID and registers it again as a shared tenant
+	if err := writer.Discard(ctx, tenantID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Create(ctx, tenantID, "", nil, TenancyShared); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		schema, err := reader.Schema(ctx, tenantID)
+		return err == nil && schema == sharedSchema
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// tenantIDPattern keeps tenant IDs usable in schema names, NATS subjects and
+// file names: lowercase letters, digits, '_' and '-', at most 56 characters
+// so that "tenant_" + ID fits Postgres' 63 character identifier limit
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,55}$`)
+
+// ValidateTenantID checks a caller-supplied tenant ID
+func ValidateTenantID(tenantID string) error {
+	if !tenantIDPattern.MatchString(tenantID) {
+		return fmt.Errorf("invalid tenant_id %q: use 1-56 lowercase letters, digits, '_' or '-'", tenantID)
+	}
+	return nil
+}
+
+// TenantSchema validates a tenant ID and returns the name of its schema.
+// The name is unquoted; use quoteIdent or qualifiedTable in SQL.
+func TenantSchema(tenantID string) (string, error) {
+	if err := ValidateTenantID(tenantID); err != nil {
+		return "", err
+	}
+	return "tenant_" + tenantID, nil
+}
+
+// qualifiedTable returns the quoted schema-qualified name of a table
+func qualifiedTable(schema, table string) string {
+	return pgx.Identifier{schema, table}.Sanitize()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTenantSchema(t *testing.T) {
+	tests := []struct {
+		tenantID string
+		want     string // "" if the ID is rejected
+	}{
+		{"acme", "tenant_acme"},
+		{"acme-eu_2", "tenant_acme-eu_2"},
+		{"7eleven", "tenant_7eleven"},
+		{"a", "tenant_a"},
+		{strings.Repeat("a", 56), "tenant_" + strings.Repeat("a", 56)},
+
+		{"", ""},
+		{strings.Repeat("a", 57), ""},
+		{"Acme", ""},
+		{"_acme", ""},
+		{"-acme", ""},
+		{"acme.eu", ""},
+		{"acme eu", ""},
+		{"acme\"; DROP SCHEMA public; --", ""},
+		{"acme'", ""},
+		{"acme/../public", ""},
+		{"acme*", ""},
+		{"acme\n", ""},
+		{"café", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tenantID, func(t *testing.T) {
+			got, err := TenantSchema(tt.tenantID)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got schema %s, want %q rejected", got, tt.tenantID)
+				}
+				if ValidateTenantID(tt.tenantID) == nil {
+					t.Errorf("ValidateTenantID accepted %q", tt.tenantID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if len(got) > maxIdentifierLength {
+				t.Errorf("schema %s is longer than %d characters", got, maxIdentifierLength)
+			}
+		})
+	}
+}
+
+func TestQualifiedTableQuotesBothNames(t *testing.T) {
+	tests := []struct {
+		schema, table string
+		want          string
+	}{
+		{"tenant_acme", "tickets", `"tenant_acme"."tickets"`},
+		{"tenant_acme-eu", "order", `"tenant_acme-eu"."order"`},
+		{"shared", `we"ird`, `"shared"."we""ird"`},
+	}
+
+	for _, tt := range tests {
+		if got := qualifiedTable(tt.schema, tt.table); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
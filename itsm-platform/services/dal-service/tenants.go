@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/nats-io/nats.go"
+)
+
+// Tenant lifecycle states in dal_system.tenants
+const (
+	TenantActive    = "active"
+	TenantSuspended = "suspended" // all DAL operations refused
+	TenantArchived  = "archived"  // read only
+	TenantDeleting  = "deleting"  // marked for deletion, purged after the grace period
+)
+
+// defaultDeletionGracePeriod applies when a delete request has none
+const defaultDeletionGracePeriod = 30 * 24 * time.Hour
+
+// tenantStatusTTL bounds how long a tenant status is cached, so a lifecycle
+// change whose notice this instance missed still takes effect within that
+// time
+const tenantStatusTTL = 10 * time.Second
+
+// tenantChangedSubject is broadcast to every DAL instance when a tenant is
+// registered, changes status or is purged, so that instances drop the
+// status and tenancy they cached for it
+const tenantChangedSubject = "dal.tenant.changed"
+
+// TenantManager records tenant lifecycle state in dal_system.tenants and
+// gates DAL operations on it
+type TenantManager struct {
+	db      *pgxpool.Pool
+	schemas *SchemaManager
+
+	mu       sync.Mutex
+	statuses map[string]cachedTenantStatus
+	nc       *nats.Conn
+}
+
+type cachedTenantStatus struct {
+	status  string
+	expires time.Time
+}
+
+// Tenant is a row of dal_system.tenants
+type Tenant struct {
+	TenantID   string                 `json:"tenant_id"`
+	Name       string                 `json:"tenant_name,omitempty"`
+	Status     string                 `json:"status"`
+	Tenancy    string                 `json:"tenancy"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	UpdatedAt  time.Time              `json:"updated_at"`
+	PurgeAfter *time.Time             `json:"purge_after,omitempty"`
+}
+
+func NewTenantManager(db *pgxpool.Pool, schemas *SchemaManager) *TenantManager {
+	return &TenantManager{
+		db:       db,
+		schemas:  schemas,
+		statuses: make(map[string]cachedTenantStatus),
+	}
+}
+
+const tenantColumns = `tenant_id, COALESCE(tenant_name, ''), status, tenancy, metadata, created_at, updated_at, purge_after`
+
+func scanTenant(row pgx.Row) (*Tenant, error) {
+	var t Tenant
+	if err := row.Scan(&t.TenantID, &t.Name, &t.Status, &t.Tenancy, &t.Metadata, &t.CreatedAt, &t.UpdatedAt, &t.PurgeAfter); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Create registers a tenant with a tenancy strategy (TenancySchema if
+// empty) and creates its schema. Creating an existing tenant is a no-op
+// unless it is being deleted or a different strategy is requested.
+func (tm *TenantManager) Create(ctx context.Context, tenantID, name string, metadata map[string]interface{}, tenancy string) (*Tenant, error) {
+	if err := ValidateTenantID(tenantID); err != nil {
+		return nil, err
+	}
+	switch tenancy {
+	case "", TenancySchema, TenancyShared:
+	default:
+		return nil, fmt.Errorf("invalid tenancy %q: use %q or %q", tenancy, TenancySchema, TenancyShared)
+	}
+
+	existing, err := tm.Get(ctx, tenantID)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, err
+	}
+	if existing != nil && existing.Status == TenantDeleting {
+		return nil, fmt.Errorf("tenant %s is being deleted; resume it instead", tenantID)
+	}
+	if existing != nil && tenancy != "" && existing.Tenancy != tenancy {
+		return nil, fmt.Errorf("tenant %s already exists with %s tenancy", tenantID, existing.Tenancy)
+	}
+
+	// Register the tenant first, so the router knows where its schema goes
+	if existing == nil {
+		if tenancy == "" {
+			tenancy = TenancySchema
+		}
+		if _, err := tm.db.Exec(ctx, `
+			INSERT INTO dal_system.tenants (tenant_id, tenant_name, status, tenancy, metadata)
+			VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+			ON CONFLICT (tenant_id) DO NOTHING`,
+			tenantID, name, TenantActive, tenancy, metadata); err != nil {
+			return nil, fmt.Errorf("failed to register tenant %s: %w", tenantID, err)
+		}
+		tm.changed(tenantID)
+	}
+
+	if err := tm.schemas.CreateTenantSchema(ctx, tenantID); err != nil {
+		return nil, err
+	}
+
+	return tm.Get(ctx, tenantID)
+}
+
+// Get returns a tenant, or pgx.ErrNoRows if it is not registered
+func (tm *TenantManager) Get(ctx context.Context, tenantID string) (*Tenant, error) {
+	return scanTenant(tm.db.QueryRow(ctx,
+		`SELECT `+tenantColumns+` FROM dal_system.tenants WHERE tenant_id = $1`, tenantID))
+}
+
+// List returns all tenants, optionally only those with the given status
+func (tm *TenantManager) List(ctx context.Context, status string) ([]*Tenant, error) {
+	rows, err := tm.db.Query(ctx, `
+		SELECT `+tenantColumns+` FROM dal_system.tenants
+		WHERE $1 = '' OR status = $1
+		ORDER BY tenant_id`, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %w", err)
+	}
+	defer rows.Close()
+
+	tenants := []*Tenant{}
+	for rows.Next() {
+		tenant, err := scanTenant(rows)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// Suspend refuses all DAL operations for a tenant until it is resumed
+func (tm *TenantManager) Suspend(ctx context.Context, tenantID string) (*Tenant, error) {
+	return tm.transition(ctx, tenantID, TenantSuspended, nil, TenantActive, TenantArchived)
+}
+
+// Archive makes a tenant read only
+func (tm *TenantManager) Archive(ctx context.Context, tenantID string) (*Tenant, error) {
+	return tm.transition(ctx, tenantID, TenantArchived, nil, TenantActive, TenantSuspended)
+}
+
+// Resume reactivates a suspended or archived tenant, or cancels a pending
+// deletion
+func (tm *TenantManager) Resume(ctx context.Context, tenantID string) (*Tenant, error) {
+	return tm.transition(ctx, tenantID, TenantActive, nil, TenantSuspended, TenantArchived, TenantDeleting)
+}
+
+// MarkDeleted is the first deletion step: the tenant is refused from now on
+// and its schema is purged once the grace period has passed
+func (tm *TenantManager) MarkDeleted(ctx context.Context, tenantID string, grace time.Duration) (*Tenant, error) {
+	if grace <= 0 {
+		grace = defaultDeletionGracePeriod
+	}
+	purgeAfter := time.Now().UTC().Add(grace)
+	return tm.transition(ctx, tenantID, TenantDeleting, &purgeAfter, TenantActive, TenantSuspended, TenantArchived)
+}
+
+// Discard deletes an active tenant right away, without a grace period. It
+// is meant for tenants that were just created, such as a failed import or clone.
+func (tm *TenantManager) Discard(ctx context.Context, tenantID string) error {
+	now := time.Now()
+	if _, err := tm.transition(ctx, tenantID, TenantDeleting, &now, TenantActive); err != nil {
+		return err
+	}
+	return tm.purge(ctx, tenantID)
+}
+
+func (tm *TenantManager) transition(ctx context.Context, tenantID, status string, purgeAfter *time.Time, from ...string) (*Tenant, error) {
+	tenant, err := scanTenant(tm.db.QueryRow(ctx, `
+		UPDATE dal_system.tenants
+		SET status = $2, purge_after = $3, updated_at = NOW()
+		WHERE tenant_id = $1 AND status = ANY($4)
+		RETURNING `+tenantColumns,
+		tenantID, status, purgeAfter, from))
+	if err == pgx.ErrNoRows {
+		current, getErr := tm.Get(ctx, tenantID)
+		if getErr == pgx.ErrNoRows {
+			return nil, fmt.Errorf("tenant %s not found", tenantID)
+		}
+		if getErr != nil {
+			return nil, getErr
+		}
+		return nil, fmt.Errorf("tenant %s cannot become %s while %s", tenantID, status, current.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update tenant %s: %w", tenantID, err)
+	}
+
+	tm.changed(tenantID)
+	return tenant, nil
+}
+
+// PurgeDeleted is the second deletion step: it drops the schema (or the
+// shared rows) and the records of every tenant whose grace period has passed
+func (tm *TenantManager) PurgeDeleted(ctx context.Context) ([]string, error) {
+	rows, err := tm.db.Query(ctx, `
+		SELECT tenant_id FROM dal_system.tenants
+		WHERE status = $1 AND purge_after <= NOW()`, TenantDeleting)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants to purge: %w", err)
+	}
+	due, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants to purge: %w", err)
+	}
+
+	var purged []string
+	for _, tenantID := range due {
+		if err := tm.purge(ctx, tenantID); err != nil {
+			return purged, err
+		}
+		purged = append(purged, tenantID)
+	}
+	return purged, nil
+}
+
+func (tm *TenantManager) purge(ctx context.Context, tenantID string) error {
+	if err := tm.schemas.DropTenantSchema(ctx, tenantID); err != nil {
+		return fmt.Errorf("failed to drop schema of tenant %s: %w", tenantID, err)
+	}
+
+	tx, err := tm.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, query := range []string{
+		`DELETE FROM dal_system.tenant_migrations WHERE tenant_id = $1`,
+		`DELETE FROM dal_system.deprecated_objects WHERE tenant_id = $1`,
+		`DELETE FROM dal_system.tenants WHERE tenant_id = $1 AND status = 'deleting'`,
+	} {
+		if _, err := tx.Exec(ctx, query, tenantID); err != nil {
+			return fmt.Errorf("failed to purge records of tenant %s: %w", tenantID, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	tm.changed(tenantID)
+	tm.schemas.router.forget(tenantID)
+	log.Printf("Purged tenant %s", tenantID)
+	return nil
+}
+
+// RunPurger purges deleted tenants every interval until ctx is done
+func (tm *TenantManager) RunPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := tm.PurgeDeleted(ctx); err != nil {
+				log.Printf("Tenant purge failed: %v", err)
+			}
+		}
+	}
+}
+
+// CheckAccess refuses operations on tenants that are unknown, suspended or
+// being deleted, and writes on archived tenants
+func (tm *TenantManager) CheckAccess(ctx context.Context, tenantID string, write bool) error {
+	if err := ValidateTenantID(tenantID); err != nil {
+		return err
+	}
+
+	status, err := tm.status(ctx, tenantID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case status == "":
+		return &TenantUnavailableError{TenantID: tenantID, Status: "not_found"}
+	case status == TenantActive:
+		return nil
+	case status == TenantArchived && !write:
+		return nil
+	default:
+		return &TenantUnavailableError{TenantID: tenantID, Status: status}
+	}
+}
+
+// status returns a tenant's status, "" if it is not registered
+func (tm *TenantManager) status(ctx context.Context, tenantID string) (string, error) {
+	tm.mu.Lock()
+	cached, ok := tm.statuses[tenantID]
+	tm.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.status, nil
+	}
+
+	var status string
+	err := tm.db.QueryRow(ctx, `SELECT status FROM dal_system.tenants WHERE tenant_id = $1`, tenantID).Scan(&status)
+	if err != nil && err != pgx.ErrNoRows {
+		return "", fmt.Errorf("failed to look up tenant %s: %w", tenantID, err)
+	}
+
+	tm.mu.Lock()
+	tm.statuses[tenantID] = cachedTenantStatus{status: status, expires: time.Now().Add(tenantStatusTTL)}
+	tm.mu.Unlock()
+	return status, nil
+}
+
+func (tm *TenantManager) forget(tenantID string) {
+	tm.mu.Lock()
+	delete(tm.statuses, tenantID)
+	tm.mu.Unlock()
+}
+
+// changed forgets a tenant's cached status and tells the other DAL
+// instances to do the same
+func (tm *TenantManager) changed(tenantID string) {
+	tm.forget(tenantID)
+
+	tm.mu.Lock()
+	nc := tm.nc
+	tm.mu.Unlock()
+	if nc == nil {
+		return
+	}
+	notice, _ := json.Marshal(map[string]string{"tenant_id": tenantID})
+	if err := nc.Publish(tenantChangedSubject, notice); err != nil {
+		log.Printf("Failed to announce change of tenant %s: %v", tenantID, err)
+	}
+}
+
+// Watch announces this manager's tenant changes on nc and forgets the
+// cached status and tenancy of a tenant whenever any instance announces a
+// change to it
+func (tm *TenantManager) Watch(nc *nats.Conn) error {
+	_, err := nc.Subscribe(tenantChangedSubject, func(msg *nats.Msg) {
+		var notice struct {
+			TenantID string `json:"tenant_id"`
+		}
+		if err := json.Unmarshal(msg.Data, &notice); err != nil || notice.TenantID == "" {
+			log.Printf("Ignoring invalid tenant change notice: %s", msg.Data)
+			return
+		}
+		tm.forget(notice.TenantID)
+		tm.schemas.router.forget(notice.TenantID)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", tenantChangedSubject, err)
+	}
+
+	tm.mu.Lock()
+	tm.nc = nc
+	tm.mu.Unlock()
+	return nil
+}
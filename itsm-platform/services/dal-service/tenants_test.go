@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestTenantTransitions(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	tenants := NewTenantManager(db, NewSchemaManager(db, NewTenantRouter(db)))
+
+	tenantID := "test_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:8]
+	if _, err := tenants.Create(ctx, tenantID, "", nil, TenancySchema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Only needed when the test stops before the purge step
+		tenants.MarkDeleted(ctx, tenantID, time.Nanosecond)
+		tenants.purge(ctx, tenantID)
+	})
+
+	purge := func(ctx context.Context, tenantID string) (*Tenant, error) {
+		purged, err := tenants.PurgeDeleted(ctx)
+		if err == nil && !containsString(purged, tenantID) {
+			err = errors.New("tenant was not purged")
+		}
+		return nil, err
+	}
+	markDeleted := func(grace time.Duration) func(context.Context, string) (*Tenant, error) {
+		return func(ctx context.Context, tenantID string) (*Tenant, error) {
+			return tenants.MarkDeleted(ctx, tenantID, grace)
+		}
+	}
+
+	// Steps run in order on the same tenant
+	tests := []struct {
+		name       string
+		transition func(context.Context, string) (*Tenant, error)
+		wantStatus string // status afterwards, "" once purged
+		wantErr    string
+	}{
+		{"suspend", tenants.Suspend, TenantSuspended, ""},
+		{"suspend again", tenants.Suspend, TenantSuspended, "cannot become suspended while suspended"},
+		{"resume", tenants.Resume, TenantActive, ""},
+		{"archive", tenants.Archive, TenantArchived, ""},
+		{"suspend archived", tenants.Suspend, TenantSuspended, ""},
+		{"archive suspended", tenants.Archive, TenantArchived, ""},
+		{"resume archived", tenants.Resume, TenantActive, ""},
+		{"resume active", tenants.Resume, TenantActive, "cannot become active while active"},
+		{"delete", markDeleted(time.Hour), TenantDeleting, ""},
+		{"suspend deleting", tenants.Suspend, TenantDeleting, "cannot become suspended while deleting"},
+		{"archive deleting", tenants.Archive, TenantDeleting, "cannot become archived while deleting"},
+		{"purge before grace period", purge, TenantDeleting, "tenant was not purged"},
+		{"resume cancels deletion", tenants.Resume, TenantActive, ""},
+		{"delete without grace period", markDeleted(time.Nanosecond), TenantDeleting, ""},
+		{"purge", purge, "", ""},
+		{"resume purged", tenants.Resume, "", "not found"},
+	}
+
+	for _, tt := range tests {
+		_, err := tt.transition(ctx, tenantID)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("%s: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+		} else if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var status string
+		tenant, err := tenants.Get(ctx, tenantID)
+		if err == nil {
+			status = tenant.Status
+		}
+		if status != tt.wantStatus {
+			t.Fatalf("%s: status %q, want %q", tt.name, status, tt.wantStatus)
+		}
+
+		// Access follows the new status right away
+		readErr := tenants.CheckAccess(ctx, tenantID, false)
+		writeErr := tenants.CheckAccess(ctx, tenantID, true)
+		wantRead := status == TenantActive || status == TenantArchived
+		wantWrite := status == TenantActive
+		if (readErr == nil) != wantRead || (writeErr == nil) != wantWrite {
+			t.Errorf("%s: read access %v, write access %v for status %q", tt.name, readErr, writeErr, status)
+		}
+	}
+}
+
+func TestTenantChangesReachOtherInstances(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	nc := testNATS(t)
+	tenantID, _ := testTenant(t, db, DSLDefinition{})
+
+	newManager := func() *TenantManager {
+		tenants := NewTenantManager(db, NewSchemaManager(db, NewTenantRouter(db)))
+		if err := tenants.Watch(nc); err != nil {
+			t.Fatal(err)
+		}
+		return tenants
+	}
+	writer, reader := newManager(), newManager()
+
+	// Cache the active status on the reader
+	if err := reader.CheckAccess(ctx, tenantID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := writer.Suspend(ctx, tenantID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		var unavailable *TenantUnavailableError
+		return errors.As(reader.CheckAccess(ctx, tenantID, false), &unavailable)
+	})
+
+	if _, err := writer.Resume(ctx, tenantID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return reader.CheckAccess(ctx, tenantID, true) == nil })
+}
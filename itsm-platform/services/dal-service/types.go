@@ -1,5 +1,10 @@
 package main
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // Request/Response types for NATS communication
 
 // RegisterRequest is now handled dynamically as map[string]interface{}
@@ -9,20 +14,26 @@ type QueryRequest struct {
 	Query    Query  `json:"query"`
 }
 
+// Write requests take an optional UserID, the actor recorded in the audit
+// log; it must be a UUID
 type CreateRequest struct {
 	TenantID string                 `json:"tenant_id"`
 	Data     map[string]interface{} `json:"data"`
+	UserID   string                 `json:"user_id,omitempty"`
 }
 
 type UpdateRequest struct {
 	TenantID string                 `json:"tenant_id"`
 	ID       string                 `json:"id"`
+	Version  int                    `json:"version,omitempty"` // version the caller read, required for optimistic_lock entities
 	Data     map[string]interface{} `json:"data"`
+	UserID   string                 `json:"user_id,omitempty"`
 }
 
 type DeleteRequest struct {
 	TenantID string `json:"tenant_id"`
 	ID       string `json:"id"`
+	UserID   string `json:"user_id,omitempty"`
 }
 
 type GetRequest struct {
@@ -30,13 +41,250 @@ type GetRequest struct {
 	ID       string `json:"id"`
 }
 
-type TenantRequest struct {
+// HistoryRequest asks for the audit entries of one record
+type HistoryRequest struct {
 	TenantID string `json:"tenant_id"`
+	ID       string `json:"id"`
+}
+
+// UpsertRequest inserts Data or updates the row it conflicts with.
+// ConflictFields selects the unique key; when empty the first unique index
+// or unique_per_tenant property whose fields are all present in Data is used.
+type UpsertRequest struct {
+	TenantID       string                 `json:"tenant_id"`
+	Data           map[string]interface{} `json:"data"`
+	ConflictFields []string               `json:"conflict_fields,omitempty"`
+	UserID         string                 `json:"user_id,omitempty"`
+}
+
+// UpdateManyRequest applies Data to every row matching Where. With
+// SummaryEvent set, one updated_many event is published instead of one
+// updated event per row.
+type UpdateManyRequest struct {
+	TenantID     string                 `json:"tenant_id"`
+	Where        []Condition            `json:"where"`
+	Data         map[string]interface{} `json:"data"`
+	SummaryEvent bool                   `json:"summary_event,omitempty"`
+	UserID       string                 `json:"user_id,omitempty"`
+}
+
+// DeleteManyRequest deletes every row matching Where
+type DeleteManyRequest struct {
+	TenantID     string      `json:"tenant_id"`
+	Where        []Condition `json:"where"`
+	SummaryEvent bool        `json:"summary_event,omitempty"`
+	UserID       string      `json:"user_id,omitempty"`
+}
+
+// BatchRequest is an ordered list of writes executed in one transaction
+type BatchRequest struct {
+	TenantID   string           `json:"tenant_id"`
+	Operations []BatchOperation `json:"operations"`
+	UserID     string           `json:"user_id,omitempty"`
+}
+
+// BatchOperation is a single create, update or delete within a batch.
+// Data and ID values of the form {"$ref": "name.field"} are replaced with
+// the field of the result of the earlier operation whose Ref is name.
+type BatchOperation struct {
+	Ref     string                 `json:"ref,omitempty"`
+	Op      string                 `json:"op"`
+	Entity  string                 `json:"entity"`
+	ID      interface{}            `json:"id,omitempty"`
+	Version int                    `json:"version,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// BatchResult is the outcome of one operation of a committed batch
+type BatchResult struct {
+	Ref    string                 `json:"ref,omitempty"`
+	Op     string                 `json:"op"`
+	Entity string                 `json:"entity"`
+	ID     string                 `json:"id"`
+	Data   map[string]interface{} `json:"data"`
+}
+
+// AuditEntry is one write recorded in a tenant's audit_log. Changes holds
+// the fields that changed: for creates every set field with a null Before,
+// for hard deletes every field with a null After.
+type AuditEntry struct {
+	ID         string                 `json:"id"`
+	EntityType string                 `json:"entity_type"`
+	EntityID   string                 `json:"entity_id"`
+	Action     string                 `json:"action"`
+	Changes    map[string]FieldChange `json:"changes"`
+	UserID     string                 `json:"user_id,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+// FieldChange is a field's value before and after a write
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type TenantRequest struct {
+	TenantID    string                 `json:"tenant_id"`
+	TenantName  string                 `json:"tenant_name,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Tenancy     string                 `json:"tenancy,omitempty"`      // create: "schema" (default) or "shared"
+	Status      string                 `json:"status,omitempty"`       // list filter
+	GracePeriod string                 `json:"grace_period,omitempty"` // delete, e.g. "720h"
 }
 
 type MigrateRequest struct {
 	Service string        `json:"service"`
 	DSL     DSLDefinition `json:"dsl"`
+	MigrateOptions
+}
+
+// MigrateOptions controls how a DSL change is applied
+type MigrateOptions struct {
+	// AllowDestructive drops removed tables and columns instead of renaming
+	// them to <name>_deprecated_<timestamp>
+	AllowDestructive bool `json:"allow_destructive,omitempty"`
+	// ConcurrentIndexes builds new and changed indexes with CREATE INDEX
+	// CONCURRENTLY after each tenant's transaction, so writes are not
+	// blocked while large tables are indexed
+	ConcurrentIndexes bool `json:"concurrent_indexes,omitempty"`
+}
+
+// PurgeRequest drops deprecated tables and columns of a service
+type PurgeRequest struct {
+	Service  string     `json:"service"`
+	TenantID string     `json:"tenant_id,omitempty"`
+	Before   *time.Time `json:"before,omitempty"`
+	DryRun   bool       `json:"dry_run,omitempty"`
+}
+
+// ExportRequest exports a tenant as a bundle, optionally only some services
+type ExportRequest struct {
+	TenantID string   `json:"tenant_id"`
+	Services []string `json:"services,omitempty"`
+}
+
+// ImportRequest loads a bundle from the bundle directory into TenantID, the
+// bundle's own tenant if empty. A tenant that does not exist yet is created
+// with Tenancy.
+type ImportRequest struct {
+	Bundle   string `json:"bundle"`
+	TenantID string `json:"tenant_id,omitempty"`
+	Tenancy  string `json:"tenancy,omitempty"`
+}
+
+// CloneRequest creates TenantID as a copy of SourceTenantID's data
+type CloneRequest struct {
+	SourceTenantID string          `json:"source_tenant_id"`
+	TenantID       string          `json:"tenant_id"`
+	TenantName     string          `json:"tenant_name,omitempty"`
+	Tenancy        string          `json:"tenancy,omitempty"`
+	Anonymize      []AnonymizeRule `json:"anonymize,omitempty"`
+}
+
+// AnonymizeRule replaces the values of one property in a clone. Service is
+// only needed when several services have an entity of that name.
+type AnonymizeRule struct {
+	Service  string `json:"service,omitempty"`
+	Entity   string `json:"entity"`
+	Property string `json:"property"`
+	Strategy string `json:"strategy"`        // see the Anonymize* constants
+	Value    string `json:"value,omitempty"` // for AnonymizeFixed
+}
+
+// BundleManifest describes the contents of a tenant bundle. It is the
+// first file of the bundle.
+type BundleManifest struct {
+	FormatVersion int             `json:"format_version"`
+	Bundle        string          `json:"bundle"`
+	TenantID      string          `json:"tenant_id"`
+	TenantName    string          `json:"tenant_name,omitempty"`
+	ExportedAt    time.Time       `json:"exported_at"`
+	Services      []BundleService `json:"services"`
+	AuditLog      BundleTable     `json:"audit_log"`
+}
+
+// BundleService is one exported service: the DSL version its rows match
+// and one file per table
+type BundleService struct {
+	Service string        `json:"service"`
+	Version string        `json:"version,omitempty"`
+	DSLHash string        `json:"dsl_hash"`
+	DSLFile string        `json:"dsl_file"`
+	Tables  []BundleTable `json:"tables"`
+}
+
+// BundleTable is an NDJSON file of a bundle, one row per line
+type BundleTable struct {
+	Entity string `json:"entity,omitempty"`
+	Table  string `json:"table"`
+	File   string `json:"file"`
+	Rows   int64  `json:"rows"`
+}
+
+// DeprecatedObject is a table, or a column when ColumnName is set, renamed
+// by a migration instead of being dropped
+type DeprecatedObject struct {
+	ID             string    `json:"id"`
+	Service        string    `json:"service"`
+	TenantID       string    `json:"tenant_id"`
+	TableName      string    `json:"table"`
+	ColumnName     *string   `json:"column,omitempty"`
+	DeprecatedName string    `json:"deprecated_name"`
+	DeprecatedAt   time.Time `json:"deprecated_at"`
+}
+
+// MigrationPlan is the reviewable output of comparing a service's registered
+// DSL with a new one. Tenants still need the migration; Completed tenants
+// already applied this exact DSL in an earlier, partly failed run.
+type MigrationPlan struct {
+	Service     string          `json:"service"`
+	FromVersion string          `json:"from_version,omitempty"`
+	ToVersion   string          `json:"to_version,omitempty"`
+	TargetHash  string          `json:"target_hash"`
+	NewService  bool            `json:"new_service"`
+	Steps       []MigrationStep `json:"steps"`
+	Tenants     []string        `json:"tenants,omitempty"`
+	Completed   []string        `json:"completed,omitempty"`
+	// IndexesPending tenants have their schema migrated and only need the
+	// online index builds that failed earlier
+	IndexesPending []string `json:"indexes_pending,omitempty"`
+}
+
+// MigrationReport is the outcome of a migration run
+type MigrationReport struct {
+	Service     string          `json:"service"`
+	RunID       string          `json:"run_id,omitempty"`
+	FromVersion string          `json:"from_version,omitempty"`
+	ToVersion   string          `json:"to_version,omitempty"`
+	Migrated    []string        `json:"migrated,omitempty"`
+	Skipped     []string        `json:"skipped,omitempty"` // already migrated by an earlier run
+	Failed      []TenantFailure `json:"failed,omitempty"`
+	IndexBuilds []IndexBuild    `json:"index_builds,omitempty"`
+}
+
+// IndexBuild is the outcome of one online index build in a tenant
+type IndexBuild struct {
+	TenantID string `json:"tenant_id"`
+	Index    string `json:"index"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+}
+
+type TenantFailure struct {
+	TenantID string `json:"tenant_id"`
+	Error    string `json:"error"`
+}
+
+// MigrationStep is one migration with the SQL it runs, rendered for the
+// schema placeholder tenant_{tenant_id}
+type MigrationStep struct {
+	Type     string   `json:"type"`
+	Table    string   `json:"table"`
+	Column   string   `json:"column,omitempty"`
+	Index    string   `json:"index,omitempty"`
+	RenameTo string   `json:"rename_to,omitempty"`
+	Online   bool     `json:"online,omitempty"` // runs outside the tenant's transaction
+	SQL      []string `json:"sql"`
 }
 
 // Query structure from UI/services
@@ -46,13 +294,80 @@ type Query struct {
 	OrderBy   []OrderBy       `json:"order_by,omitempty"`
 	Limit     int             `json:"limit,omitempty"`
 	Offset    int             `json:"offset,omitempty"`
+	Cursor    bool            `json:"cursor,omitempty"` // keyset pagination, returning next_cursor
+	After     string          `json:"after,omitempty"`  // next_cursor of the previous page
+	SkipTotal bool            `json:"skip_total,omitempty"`
 	Relations []RelationQuery `json:"relations,omitempty"`
+
+	// Aggregate mode: when either is set the query returns one row per group
+	GroupBy    []GroupBy   `json:"group_by,omitempty"`
+	Aggregates []Aggregate `json:"aggregates,omitempty"`
 }
 
+// GroupBy groups aggregate results by a field, optionally bucketing a
+// timestamp field with date_trunc (minute, hour, day, week, month, quarter, year)
+type GroupBy struct {
+	Field    string `json:"field"`
+	Interval string `json:"interval,omitempty"`
+	Alias    string `json:"alias,omitempty"`
+}
+
+// UnmarshalJSON accepts a plain field name as shorthand for {"field": name}
+func (g *GroupBy) UnmarshalJSON(data []byte) error {
+	var field string
+	if err := json.Unmarshal(data, &field); err == nil {
+		*g = GroupBy{Field: field}
+		return nil
+	}
+
+	type groupBy GroupBy
+	return json.Unmarshal(data, (*groupBy)(g))
+}
+
+// Aggregate computes count, count_distinct, sum, avg, min or max over a
+// field (count may omit it). With From set, the aggregated value is the
+// duration Field - From in seconds, e.g. avg of resolved_at from created_at.
+type Aggregate struct {
+	Function string `json:"function"`
+	Field    string `json:"field,omitempty"`
+	From     string `json:"from,omitempty"`
+	Alias    string `json:"alias,omitempty"`
+}
+
+// QueryResult is the response to a query. Total is omitted when the query
+// sets skip_total, NextCursor when there are no further pages.
+type QueryResult struct {
+	Data       []map[string]interface{} `json:"data"`
+	Total      *int64                   `json:"total,omitempty"`
+	NextCursor string                   `json:"next_cursor,omitempty"`
+}
+
+// Condition is either a single field predicate or a group of nested
+// conditions. Or/And groups are combined with the field predicate (if any)
+// using AND, so {"or": [...]} on its own yields "(a OR b)".
 type Condition struct {
-	Field    string      `json:"field"`
-	Operator string      `json:"operator"`
-	Value    interface{} `json:"value"`
+	Field    string      `json:"field,omitempty"`
+	Operator string      `json:"operator,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+	Or       []Condition `json:"or,omitempty"`
+	And      []Condition `json:"and,omitempty"`
+}
+
+// UnmarshalJSON accepts "op" as an alias for "operator" (UI query format)
+func (c *Condition) UnmarshalJSON(data []byte) error {
+	type condition Condition
+	aux := struct {
+		*condition
+		Op string `json:"op"`
+	}{condition: (*condition)(c)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if c.Operator == "" {
+		c.Operator = aux.Op
+	}
+	return nil
 }
 
 type OrderBy struct {
@@ -101,18 +416,20 @@ type SubscribeEventDefinition struct {
 }
 
 type NodeDefinition struct {
-	Name       string                `json:"name"`
-	Table      string                `json:"table"`
-	Properties []PropertyDefinition  `json:"properties"`
-	Indexes    []IndexDefinition     `json:"indexes"`
-	DAL        DALConfig             `json:"dal"`
-	Relations  []RelationDefinition  `json:"relations,omitempty"`
-	Hooks      HookConfigDefinition  `json:"hooks,omitempty"`
-	Graph      GraphConfigDefinition `json:"graph,omitempty"`
+	Name        string                `json:"name"`
+	RenamedFrom string                `json:"renamed_from,omitempty"` // previous node name
+	Table       string                `json:"table"`
+	Properties  []PropertyDefinition  `json:"properties"`
+	Indexes     []IndexDefinition     `json:"indexes"`
+	DAL         DALConfig             `json:"dal"`
+	Relations   []RelationDefinition  `json:"relations,omitempty"`
+	Hooks       HookConfigDefinition  `json:"hooks,omitempty"`
+	Graph       GraphConfigDefinition `json:"graph,omitempty"`
 }
 
 type PropertyDefinition struct {
 	Name            string      `json:"name"`
+	RenamedFrom     string      `json:"renamed_from,omitempty"` // previous property name
 	Type            string      `json:"type"`
 	Primary         bool        `json:"primary,omitempty"`
 	Required        bool        `json:"required,omitempty"`
@@ -123,6 +440,9 @@ type PropertyDefinition struct {
 	Values          []string    `json:"values,omitempty"`
 	Precision       int         `json:"precision,omitempty"`
 	Scale           int         `json:"scale,omitempty"`
+	// Backfill is a SQL expression that fills existing rows when the
+	// property becomes required, e.g. "'medium'" or "created_at"
+	Backfill string `json:"backfill,omitempty"`
 }
 
 type IndexDefinition struct {
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Upsert inserts data or, if it conflicts on a unique key, updates the
+// existing row (restoring it if soft deleted). It reports whether the row
+// was created.
+func (qe *QueryExecutor) Upsert(ctx context.Context, tenantID, entityName string, data map[string]interface{}, conflictFields []string) (map[string]interface{}, bool, error) {
+	var result map[string]interface{}
+	var created bool
+	err := qe.forTenant(ctx, tenantID, func(qe *QueryExecutor) (err error) {
+		result, created, err = qe.upsert(ctx, tenantID, entityName, data, conflictFields)
+		return err
+	})
+	return result, created, err
+}
+
+func (qe *QueryExecutor) upsert(ctx context.Context, tenantID, entityName string, data map[string]interface{}, conflictFields []string) (map[string]interface{}, bool, error) {
+	node := qe.service.GetNode(entityName)
+	if node == nil {
+		return nil, false, fmt.Errorf("entity %s not found", entityName)
+	}
+
+	target, err := resolveConflictTarget(node, data, conflictFields)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for col := range data {
+		switch col {
+		case "id", "tenant_id", "version", "created_at", "updated_at":
+			return nil, false, fmt.Errorf("field %s cannot be set by upsert", col)
+		}
+		if !qe.isValidField(col, node) {
+			return nil, false, &UnknownFieldError{Entity: node.Name, Field: col}
+		}
+	}
+
+	now := time.Now().UTC()
+	row := make(map[string]interface{}, len(data)+5)
+	for col, val := range data {
+		row[col] = val
+	}
+	row["id"] = uuid.New().String()
+	row["tenant_id"] = tenantID
+	row["created_at"] = now
+	row["updated_at"] = now
+	if node.DAL.OptimisticLock {
+		row["version"] = 1
+	}
+
+	// Build INSERT part
+	columns := make([]string, 0, len(row))
+	placeholders := make([]string, 0, len(row))
+	values := make([]interface{}, 0, len(row))
+	for col, val := range row {
+		columns = append(columns, quoteIdent(col))
+		placeholders = append(placeholders, bindParam(&values, val))
+	}
+
+	// Build ON CONFLICT DO UPDATE part from the supplied fields only
+	isTarget := make(map[string]bool, len(target))
+	targetColumns := make([]string, len(target))
+	for i, field := range target {
+		isTarget[field] = true
+		targetColumns[i] = quoteIdent(field)
+	}
+
+	tableName, err := qe.tableName(ctx, tenantID, node)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Lock the conflicting row, if any, and keep its values for the audit diff
+	lookupConditions := make([]string, len(target))
+	var lookupValues []interface{}
+	for i, field := range target {
+		lookupConditions[i] = fmt.Sprintf("%s = %s", quoteIdent(field), bindParam(&lookupValues, row[field]))
+	}
+	before, err := qe.queryOne(ctx, fmt.Sprintf("SELECT * FROM %s WHERE %s FOR UPDATE",
+		tableName, strings.Join(lookupConditions, " AND ")), lookupValues...)
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, false, fmt.Errorf("upsert failed: %w", err)
+	}
+
+	setClauses := []string{`updated_at = EXCLUDED.updated_at`}
+	for col := range data {
+		if !isTarget[col] {
+			setClauses = append(setClauses, fmt.Sprintf("%s = EXCLUDED.%s", quoteIdent(col), quoteIdent(col)))
+		}
+	}
+	if node.DAL.SoftDelete {
+		setClauses = append(setClauses, "deleted_at = NULL")
+	}
+	if node.DAL.OptimisticLock {
+		setClauses = append(setClauses, "version = existing.version + 1")
+	}
+
+	// The table is aliased as existing for the conflicting row. xmax is 0
+	// for a freshly inserted row version.
+	query := fmt.Sprintf(`INSERT INTO %s AS existing (%s) VALUES (%s)
+		ON CONFLICT (%s) DO UPDATE SET %s
+		RETURNING *, (xmax = 0) AS _inserted`,
+		tableName, strings.Join(columns, ", "), strings.Join(placeholders, ", "),
+		strings.Join(targetColumns, ", "), strings.Join(setClauses, ", "))
+
+	result, err := qe.queryOne(ctx, query, values...)
+	if err != nil {
+		return nil, false, fmt.Errorf("upsert failed: %w", err)
+	}
+
+	created, _ := result["_inserted"].(bool)
+	delete(result, "_inserted")
+
+	change := auditChange{action: AuditUpdate, before: before, after: result}
+	if created {
+		change = auditChange{action: AuditCreate, after: result}
+	}
+	if err := qe.audit(ctx, tenantID, node, change); err != nil {
+		return nil, false, err
+	}
+
+	return result, created, nil
+}
+
+// resolveConflictTarget picks the unique key to upsert on, from the node's
+// unique indexes and unique_per_tenant properties
+func resolveConflictTarget(node *NodeDefinition, data map[string]interface{}, requested []string) ([]string, error) {
+	var candidates [][]string
+	for _, idx := range node.Indexes {
+		if idx.Unique {
+			candidates = append(candidates, idx.Fields)
+		}
+	}
+	for _, prop := range node.Properties {
+		if prop.UniquePerTenant {
+			candidates = append(candidates, []string{"tenant_id", prop.Name})
+		}
+	}
+
+	for _, fields := range candidates {
+		if len(requested) > 0 {
+			if sameFields(fields, withTenantID(requested)) || sameFields(fields, requested) {
+				return fields, nil
+			}
+			continue
+		}
+
+		complete := true
+		for _, field := range fields {
+			if _, ok := data[field]; !ok && field != "tenant_id" {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			return fields, nil
+		}
+	}
+
+	if len(requested) > 0 {
+		return nil, fmt.Errorf("no unique index on %s matches conflict fields %v", node.Name, requested)
+	}
+	return nil, fmt.Errorf("no unique index on %s is fully covered by the upsert data", node.Name)
+}
+
+func withTenantID(fields []string) []string {
+	if containsString(fields, "tenant_id") {
+		return fields
+	}
+	return append([]string{"tenant_id"}, fields...)
+}
+
+// sameFields compares two field lists ignoring order
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string{}, a...)
+	y := append([]string{}, b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
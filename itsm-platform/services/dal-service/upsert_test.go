@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveConflictTarget(t *testing.T) {
+	node := &NodeDefinition{
+		Name: "Asset",
+		Properties: []PropertyDefinition{
+			{Name: "id", Type: "uuid", Primary: true},
+			{Name: "serial", Type: "string", UniquePerTenant: true},
+			{Name: "vendor", Type: "string"},
+			{Name: "model", Type: "string"},
+			{Name: "name", Type: "string"},
+		},
+		Indexes: []IndexDefinition{
+			{Name: "idx_assets_name", Fields: []string{"name"}},
+			{Name: "idx_assets_vendor_model", Fields: []string{"tenant_id", "vendor", "model"}, Unique: true},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		data      map[string]interface{}
+		requested []string
+		want      []string
+		wantErr   string
+	}{
+		{
+			name:      "explicit fields without tenant_id",
+			data:      map[string]interface{}{"vendor": "acme", "model": "x1", "serial": "s1"},
+			requested: []string{"model", "vendor"},
+			want:      []string{"tenant_id", "vendor", "model"},
+		},
+		{
+			name:      "explicit fields with tenant_id",
+			data:      map[string]interface{}{"serial": "s1"},
+			requested: []string{"serial", "tenant_id"},
+			want:      []string{"tenant_id", "serial"},
+		},
+		{
+			name:      "explicit fields must match a unique key",
+			data:      map[string]interface{}{"name": "laptop"},
+			requested: []string{"name"},
+			wantErr:   "no unique index on Asset matches conflict fields [name]",
+		},
+		{
+			name: "first covered unique index",
+			data: map[string]interface{}{"vendor": "acme", "model": "x1", "serial": "s1"},
+			want: []string{"tenant_id", "vendor", "model"},
+		},
+		{
+			name: "unique_per_tenant property when no index is covered",
+			data: map[string]interface{}{"vendor": "acme", "serial": "s1"},
+			want: []string{"tenant_id", "serial"},
+		},
+		{
+			name:    "no covered key",
+			data:    map[string]interface{}{"vendor": "acme", "name": "laptop"},
+			wantErr: "no unique index on Asset is fully covered by the upsert data",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveConflictTarget(node, tt.data, tt.requested)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}